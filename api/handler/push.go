@@ -6,6 +6,7 @@
 package handler
 
 import (
+	"encoding/json"
 	"strconv"
 
 	"gochat/api/ctxutil"
@@ -57,12 +58,15 @@ func Push(c *gin.Context) {
 		RoomId:       roomId,
 		Op:           config.OpSingleSend,
 	}
-	code, rpcMsg := rpc.RpcLogicObj.Push(ctx, req)
+	code, rpcMsg, seqId, status := rpc.RpcLogicObj.Push(ctx, req)
 	if code == tools.CodeFail {
 		tools.FailWithMsg(c, rpcMsg)
 		return
 	}
-	tools.SuccessWithMsg(c, "ok", nil)
+	tools.SuccessWithMsg(c, "ok", gin.H{
+		"seq":    seqId,
+		"status": status,
+	})
 	return
 }
 
@@ -96,7 +100,11 @@ func PushRoom(c *gin.Context) {
 	}
 	code, msg := rpc.RpcLogicObj.PushRoom(ctx, req)
 	if code == tools.CodeFail {
-		tools.FailWithMsg(c, "rpc push room msg fail!")
+		if msg == "" {
+			// a muted or banned sender gets the reason
+			msg = "rpc push room msg fail!"
+		}
+		tools.FailWithMsg(c, msg)
 		return
 	}
 	tools.SuccessWithMsg(c, "ok", msg)
@@ -152,3 +160,125 @@ func GetRoomInfo(c *gin.Context) {
 	tools.SuccessWithMsg(c, "ok", msg)
 	return
 }
+
+type FormHistory struct {
+	AuthToken string `form:"authToken" json:"authToken" binding:"required"`
+	RoomId    int    `form:"roomId" json:"roomId" binding:"required"`
+	Before    int64  `form:"before" json:"before"`
+	After     int64  `form:"after" json:"after"`
+	Limit     int    `form:"limit" json:"limit"`
+}
+
+func History(c *gin.Context) {
+	var formHistory FormHistory
+	if err := c.ShouldBindBodyWith(&formHistory, binding.JSON); err != nil {
+		tools.FailWithMsg(c, err.Error())
+		return
+	}
+	userId, _, ok := ctxutil.GetAuthFromContext(c)
+	if !ok {
+		tools.FailWithMsg(c, "auth info not found in context")
+		return
+	}
+	req := &proto.GetRoomHistoryRequest{
+		UserId: userId,
+		RoomId: formHistory.RoomId,
+		Before: formHistory.Before,
+		After:  formHistory.After,
+		Limit:  formHistory.Limit,
+	}
+	code, msg, messages, hasMore := rpc.RpcLogicObj.GetRoomHistory(c.Request.Context(), req)
+	if code == tools.CodeFail {
+		if msg == "" {
+			msg = "rpc get room history fail!"
+		}
+		tools.FailWithMsg(c, msg)
+		return
+	}
+	tools.SuccessWithMsg(c, "ok", gin.H{
+		"messages": messages,
+		"hasMore":  hasMore,
+	})
+	return
+}
+
+type FormOffline struct {
+	AuthToken string `form:"authToken" json:"authToken" binding:"required"`
+	AckId     int64  `form:"ackId" json:"ackId"`
+	Limit     int    `form:"limit" json:"limit"`
+}
+
+// Offline clear the user offline inbox up to ackId (the ackId of the previous call),
+// then return the next msgs of it
+func Offline(c *gin.Context) {
+	var formOffline FormOffline
+	if err := c.ShouldBindBodyWith(&formOffline, binding.JSON); err != nil {
+		tools.FailWithMsg(c, err.Error())
+		return
+	}
+	userId, _, ok := ctxutil.GetAuthFromContext(c)
+	if !ok {
+		tools.FailWithMsg(c, "auth info not found in context")
+		return
+	}
+	req := &proto.OfflineMsgRequest{
+		UserId: userId,
+		AckId:  formOffline.AckId,
+		Limit:  formOffline.Limit,
+	}
+	code, msg, reply := rpc.RpcLogicObj.GetOfflineMsg(c.Request.Context(), req)
+	if code == tools.CodeFail {
+		if msg == "" {
+			msg = "rpc get offline msg fail!"
+		}
+		tools.FailWithMsg(c, msg)
+		return
+	}
+	msgs := make([]json.RawMessage, 0, len(reply.Msgs))
+	for _, m := range reply.Msgs {
+		msgs = append(msgs, m)
+	}
+	tools.SuccessWithMsg(c, "ok", gin.H{
+		"msgs":    msgs,
+		"ackId":   reply.AckId,
+		"hasMore": reply.HasMore,
+	})
+	return
+}
+
+type FormMsgStatus struct {
+	AuthToken string `form:"authToken" json:"authToken" binding:"required"`
+	Seq       string `form:"seq" json:"seq" binding:"required"`
+}
+
+// MsgStatus return the delivery status of a single msg sent by the user
+func MsgStatus(c *gin.Context) {
+	var formMsgStatus FormMsgStatus
+	if err := c.ShouldBindBodyWith(&formMsgStatus, binding.JSON); err != nil {
+		tools.FailWithMsg(c, err.Error())
+		return
+	}
+	userId, _, ok := ctxutil.GetAuthFromContext(c)
+	if !ok {
+		tools.FailWithMsg(c, "auth info not found in context")
+		return
+	}
+	req := &proto.MsgStatusRequest{
+		UserId: userId,
+		SeqId:  formMsgStatus.Seq,
+	}
+	code, msg, reply := rpc.RpcLogicObj.GetMsgStatus(c.Request.Context(), req)
+	if code == tools.CodeFail {
+		if msg == "" {
+			msg = "rpc get msg status fail!"
+		}
+		tools.FailWithMsg(c, msg)
+		return
+	}
+	tools.SuccessWithMsg(c, "ok", gin.H{
+		"seq":      reply.SeqId,
+		"toUserId": reply.ToUserId,
+		"status":   reply.Status,
+	})
+	return
+}
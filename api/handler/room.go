@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"context"
+
+	"gochat/api/ctxutil"
+	"gochat/api/rpc"
+	"gochat/proto"
+	"gochat/tools"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type FormModerate struct {
+	AuthToken string `form:"authToken" json:"authToken" binding:"required"`
+	RoomId    int    `form:"roomId" json:"roomId" binding:"required"`
+	UserId    int    `form:"userId" json:"userId" binding:"required"`
+	Duration  int    `form:"duration" json:"duration"` // seconds, mute only, 0 lift the mute
+	Reason    string `form:"reason" json:"reason"`
+}
+
+// moderate call logic as the user of the auth token, logic checks it is a moderator
+func moderate(c *gin.Context, call func(ctx context.Context, req *proto.ModerateRequest) (int, string)) {
+	var formModerate FormModerate
+	if err := c.ShouldBindBodyWith(&formModerate, binding.JSON); err != nil {
+		tools.FailWithMsg(c, err.Error())
+		return
+	}
+	operatorId, operatorName, ok := ctxutil.GetAuthFromContext(c)
+	if !ok {
+		tools.FailWithMsg(c, "auth info not found in context")
+		return
+	}
+	req := &proto.ModerateRequest{
+		OperatorId:   operatorId,
+		OperatorName: operatorName,
+		RoomId:       formModerate.RoomId,
+		UserId:       formModerate.UserId,
+		Duration:     formModerate.Duration,
+		Reason:       formModerate.Reason,
+	}
+	code, msg := call(c.Request.Context(), req)
+	if code == tools.CodeFail {
+		if msg == "" {
+			msg = "rpc moderate fail!"
+		}
+		tools.FailWithMsg(c, msg)
+		return
+	}
+	tools.SuccessWithMsg(c, "ok", nil)
+}
+
+// Kick remove the user from the room, it may join again
+func Kick(c *gin.Context) {
+	moderate(c, rpc.RpcLogicObj.KickUser)
+}
+
+// Mute stop the user from sending to the room for duration seconds
+func Mute(c *gin.Context) {
+	moderate(c, rpc.RpcLogicObj.MuteUser)
+}
+
+// Ban kick the user and keep it out of the room until unbanned
+func Ban(c *gin.Context) {
+	moderate(c, rpc.RpcLogicObj.BanUser)
+}
+
+func Unban(c *gin.Context) {
+	moderate(c, rpc.RpcLogicObj.UnbanUser)
+}
@@ -7,18 +7,22 @@ package router
 
 import (
 	"net/http"
+	"strconv"
 
 	"gochat/api/cache"
 	"gochat/api/ctxutil"
 	"gochat/api/handler"
 	"gochat/api/rpc"
+	"gochat/config"
 	"gochat/pkg/middleware"
+	"gochat/pkg/origin"
 	"gochat/proto"
 	"gochat/tools"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 func Register() *gin.Engine {
@@ -29,6 +33,7 @@ func Register() *gin.Engine {
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	initUserRouter(r)
 	initPushRouter(r)
+	initRoomRouter(r)
 	r.NoRoute(func(c *gin.Context) {
 		tools.FailWithMsg(c, "please check request url !")
 	})
@@ -55,6 +60,21 @@ func initPushRouter(r *gin.Engine) {
 		pushGroup.POST("/pushRoom", handler.PushRoom)
 		pushGroup.POST("/count", handler.Count)
 		pushGroup.POST("/getRoomInfo", handler.GetRoomInfo)
+		pushGroup.POST("/history", handler.History)
+		pushGroup.POST("/offline", handler.Offline)
+		pushGroup.POST("/status", handler.MsgStatus)
+	}
+
+}
+
+func initRoomRouter(r *gin.Engine) {
+	roomGroup := r.Group("/room")
+	roomGroup.Use(CheckSessionId())
+	{
+		roomGroup.POST("/kick", handler.Kick)
+		roomGroup.POST("/mute", handler.Mute)
+		roomGroup.POST("/ban", handler.Ban)
+		roomGroup.POST("/unban", handler.Unban)
 	}
 
 }
@@ -103,19 +123,46 @@ func CheckSessionId() gin.HandlerFunc {
 	}
 }
 
+// CorsMiddleware answer browsers from the origins in [common-cors], a preflight is answered
+// here and not passed to the handlers. requests without an Origin are not from a browser
 func CorsMiddleware() gin.HandlerFunc {
+	corsConf := config.Conf.Common.CommonCors
+	allowlist := origin.New(corsConf.AllowedOrigins)
+	maxAge := strconv.Itoa(corsConf.MaxAge)
 	return func(c *gin.Context) {
-		method := c.Request.Method
-		var openCorsFlag = true
-		if openCorsFlag {
+		requestOrigin := c.GetHeader("Origin")
+		if requestOrigin == "" {
+			c.Next()
+			return
+		}
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !allowlist.Allowed(requestOrigin) {
+			logrus.Warnf("cors deny origin %s %s %s from %s", requestOrigin, c.Request.Method, c.Request.URL.Path, c.ClientIP())
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		// "*" can not be used with credentials, echo the origin then
+		if allowlist.AllowAny() && !corsConf.AllowCredentials {
 			c.Header("Access-Control-Allow-Origin", "*")
-			c.Header("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
-			c.Header("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, DELETE")
-			c.Set("content-type", "application/json")
+		} else {
+			c.Header("Access-Control-Allow-Origin", requestOrigin)
+			c.Header("Vary", "Origin")
 		}
-		if method == "OPTIONS" {
-			c.JSON(http.StatusOK, nil)
+		if corsConf.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
 		}
-		c.Next()
+		if !preflight {
+			c.Next()
+			return
+		}
+		allowHeaders := c.GetHeader("Access-Control-Request-Headers")
+		if allowHeaders == "" {
+			allowHeaders = "Origin, X-Requested-With, Content-Type, Accept"
+		}
+		c.Header("Access-Control-Allow-Headers", allowHeaders)
+		c.Header("Access-Control-Allow-Methods", "GET, OPTIONS, POST, PUT, DELETE")
+		c.Header("Access-Control-Max-Age", maxAge)
+		c.Header("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		c.AbortWithStatus(http.StatusNoContent)
 	}
 }
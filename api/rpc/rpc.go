@@ -12,6 +12,7 @@ import (
 
 	"gochat/config"
 	"gochat/pkg/middleware"
+	"gochat/pkg/tlsreload"
 	"gochat/proto"
 
 	"github.com/rpcxio/libkv/store"
@@ -63,6 +64,12 @@ func InitLogicRpcClient() {
 			SerializeType:       protocol.MsgPack,       // Use MsgPack serialization
 			CompressType:        protocol.None,          // No compression for speed
 		}
+		if logicBase := config.Conf.Logic.LogicBase; logicBase.RpcTls {
+			// logic serves rpc over tls
+			if opt.TLSConfig, err = tlsreload.ClientConfig(logicBase.RpcCaPath, logicBase.RpcServerName); err != nil {
+				logrus.Fatalf("init api rpc client tls fail:%s", err.Error())
+			}
+		}
 		LogicRpcClient = client.NewXClient(config.Conf.Common.CommonEtcd.ServerPathLogic, client.Failtry, client.RandomSelect, d, opt)
 		RpcLogicObj = new(RpcLogic)
 	})
@@ -117,11 +124,13 @@ func (rpc *RpcLogic) Logout(ctx context.Context, req *proto.LogoutRequest) (code
 	return
 }
 
-func (rpc *RpcLogic) Push(ctx context.Context, req *proto.Send) (code int, msg string) {
-	reply := &proto.SuccessReply{}
+func (rpc *RpcLogic) Push(ctx context.Context, req *proto.Send) (code int, msg string, seqId string, status string) {
+	reply := &proto.PushReply{}
 	middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "Push", req, reply)
 	code = reply.Code
 	msg = reply.Msg
+	seqId = reply.SeqId
+	status = reply.Status
 	return
 }
 
@@ -148,3 +157,67 @@ func (rpc *RpcLogic) GetRoomInfo(ctx context.Context, req *proto.Send) (code int
 	msg = reply.Msg
 	return
 }
+
+func (rpc *RpcLogic) GetRoomHistory(ctx context.Context, req *proto.GetRoomHistoryRequest) (code int, msg string, messages []proto.RoomHistoryMsg, hasMore bool) {
+	reply := &proto.GetRoomHistoryReply{}
+	err := middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "GetRoomHistory", req, reply)
+	if err != nil {
+		msg = err.Error()
+	}
+	code = reply.Code
+	messages = reply.Messages
+	hasMore = reply.HasMore
+	return
+}
+
+func (rpc *RpcLogic) GetOfflineMsg(ctx context.Context, req *proto.OfflineMsgRequest) (code int, msg string, reply *proto.OfflineMsgReply) {
+	reply = &proto.OfflineMsgReply{}
+	err := middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "GetOfflineMsg", req, reply)
+	if err != nil {
+		msg = err.Error()
+	}
+	code = reply.Code
+	return
+}
+
+func (rpc *RpcLogic) GetMsgStatus(ctx context.Context, req *proto.MsgStatusRequest) (code int, msg string, reply *proto.MsgStatusReply) {
+	reply = &proto.MsgStatusReply{}
+	err := middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "GetMsgStatus", req, reply)
+	if err != nil {
+		msg = err.Error()
+	}
+	code = reply.Code
+	return
+}
+
+func (rpc *RpcLogic) KickUser(ctx context.Context, req *proto.ModerateRequest) (code int, msg string) {
+	reply := &proto.SuccessReply{}
+	middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "KickUser", req, reply)
+	code = reply.Code
+	msg = reply.Msg
+	return
+}
+
+func (rpc *RpcLogic) MuteUser(ctx context.Context, req *proto.ModerateRequest) (code int, msg string) {
+	reply := &proto.SuccessReply{}
+	middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "MuteUser", req, reply)
+	code = reply.Code
+	msg = reply.Msg
+	return
+}
+
+func (rpc *RpcLogic) BanUser(ctx context.Context, req *proto.ModerateRequest) (code int, msg string) {
+	reply := &proto.SuccessReply{}
+	middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "BanUser", req, reply)
+	code = reply.Code
+	msg = reply.Msg
+	return
+}
+
+func (rpc *RpcLogic) UnbanUser(ctx context.Context, req *proto.ModerateRequest) (code int, msg string) {
+	reply := &proto.SuccessReply{}
+	middleware.InstrumentedCall(ctx, LogicRpcClient, "api", "logic", "UnbanUser", req, reply)
+	code = reply.Code
+	msg = reply.Msg
+	return
+}
@@ -23,14 +23,45 @@ const (
 	SuccessReplyMsg       = "success"
 	RedisBaseValidTime    = 86400
 	RedisPrefix           = "gochat_"
+	RedisUserServerPrefix = "gochat_user_server_"     // hash of a user conns, deviceId => serverId
+	RedisRoomConnPrefix   = "gochat_room_conn_count_" // hash of a room, userId => conn count of the user in room
+	RedisRoomMutePrefix   = "gochat_room_mute_"       // roomId_userId, set while the user is muted in room
+	RedisRoomBanPrefix    = "gochat_room_ban_"        // set of the userIds banned from a room
 	RedisRoomPrefix       = "gochat_room_"
 	RedisRoomOnlinePrefix = "gochat_room_online_count_"
+	RedisRoomMsgIdPrefix  = "gochat_room_msg_id_"
+	RedisOfflinePrefix    = "gochat_offline_"
+	RedisOfflineIdPrefix  = "gochat_offline_id_"
+	RedisOfflineSeqPrefix = "gochat_offline_seq_" // seqId, set while the single msg is kept in an offline inbox
+	RedisMsgStatusPrefix  = "gochat_msg_status_"
+	MsgStatusSent         = "sent"      // single msg pushed to a connect server of the receiver
+	MsgStatusOffline      = "offline"   // single msg kept in the receiver offline inbox
+	MsgStatusDelivered    = "delivered" // single msg acked by a device of the receiver
+	OfflineMsgValidTime   = 7 * 86400   // offline inbox keep time
+	OfflineMsgMaxSize     = 500         // max msgs kept in a user offline inbox, oldest dropped first
+	OfflineMsgBatch       = 50          // max msgs pushed to client in one offline frame
+	RoomHistoryLimit      = 20          // default page size of room history
+	RoomHistoryMaxLimit   = 100         // max page size of room history
 	MsgVersion            = 1
-	OpSingleSend          = 2 // single user
-	OpRoomSend            = 3 // send to room
-	OpRoomCountSend       = 4 // get online user count
-	OpRoomInfoSend        = 5 // send info to room
-	OpBuildTcpConn        = 6 // build tcp conn
+	OpSingleSend          = 2  // single user
+	OpRoomSend            = 3  // send to room
+	OpRoomCountSend       = 4  // get online user count
+	OpRoomInfoSend        = 5  // send info to room
+	OpBuildTcpConn        = 6  // build tcp conn, also the connect frame of an enveloped websocket conn
+	OpOfflineMsg          = 7  // push offline inbox to client
+	OpOfflineAck          = 8  // client ack offline inbox
+	OpRoomJoin            = 9  // client join a room on current conn
+	OpRoomLeave           = 10 // client leave a room on current conn
+	OpReply               = 11 // reply a client op, correlated by seq
+	OpMsgAck              = 12 // client ack a pushed single msg by seq
+	OpSession             = 13 // push the resume token of the session after connect
+	OpReconnect           = 14 // server is draining, the client should reconnect elsewhere
+	OpRateLimit           = 15 // client op over its rate limit, warn/throttle/close
+	OpPing                = 16 // tcp heartbeat, either side, answered by OpPong with the same seq
+	OpPong                = 17 // tcp heartbeat answer
+	OpRoomSignal          = 18 // ephemeral room signal like typing, never stored or acked
+	OpKick                = 19 // the user was kicked or banned from a room
+	OpBatch               = 20 // several server frames in one websocket frame, if batching is enabled
 )
 
 const (
@@ -42,6 +73,8 @@ const (
 	RoutingKeyRoomSend   = "room.send"
 	RoutingKeyRoomCount  = "room.count"
 	RoutingKeyRoomInfo   = "room.info"
+	RoutingKeyRoomSignal = "room.signal"
+	RoutingKeyRoomKick   = "room.kick"
 )
 
 type Config struct {
@@ -162,16 +195,26 @@ type CommonTracing struct {
 	SamplingRate float64 `mapstructure:"samplingRate"`
 }
 
+type CommonCors struct {
+	AllowedOrigins   []string `mapstructure:"allowedOrigins"`   // browser origins allowed by api and websocket, see pkg/origin
+	AllowCredentials bool     `mapstructure:"allowCredentials"` // let browsers send cookies to the api
+	MaxAge           int      `mapstructure:"maxAge"`           // seconds a preflight answer is cached
+}
+
 type Common struct {
 	CommonEtcd     CommonEtcd     `mapstructure:"common-etcd"`
 	CommonRedis    CommonRedis    `mapstructure:"common-redis"`
 	CommonRabbitMQ CommonRabbitMQ `mapstructure:"common-rabbitmq"`
 	CommonTracing  CommonTracing  `mapstructure:"common-tracing"`
+	CommonCors     CommonCors     `mapstructure:"common-cors"`
 }
 
 type ConnectBase struct {
-	CertPath string `mapstructure:"certPath"`
-	KeyPath  string `mapstructure:"keyPath"`
+	CertPath      string `mapstructure:"certPath"` // with keyPath, serve wss and tls tcp
+	KeyPath       string `mapstructure:"keyPath"`
+	RpcTls        bool   `mapstructure:"rpcTls"`        // serve the connect rpc with the same cert
+	RpcCaPath     string `mapstructure:"rpcCaPath"`     // ca rpc clients trust, stable across leaf rotation
+	RpcServerName string `mapstructure:"rpcServerName"` // name rpc clients check in the cert, default the dialed host
 }
 
 type ConnectRpcAddressWebsockts struct {
@@ -182,6 +225,10 @@ type ConnectRpcAddressTcp struct {
 	Address string `mapstructure:"address"`
 }
 
+type ConnectRpcAddressHttp struct {
+	Address string `mapstructure:"address"`
+}
+
 type ConnectBucket struct {
 	CpuNum        int    `mapstructure:"cpuNum"`
 	Channel       int    `mapstructure:"channel"`
@@ -192,8 +239,12 @@ type ConnectBucket struct {
 }
 
 type ConnectWebsocket struct {
-	ServerId string `mapstructure:"serverId"`
-	Bind     string `mapstructure:"bind"`
+	ServerId             string `mapstructure:"serverId"`
+	Bind                 string `mapstructure:"bind"`
+	Compression          bool   `mapstructure:"compression"`          // permessage-deflate if the client offers it
+	CompressionLevel     int    `mapstructure:"compressionLevel"`     // flate level, -2..9
+	CompressionThreshold int    `mapstructure:"compressionThreshold"` // bytes, smaller frames are not compressed
+	RequireUpgradeAuth   bool   `mapstructure:"requireUpgradeAuth"`   // reject upgrades without a valid auth token with 401
 }
 
 type ConnectTcp struct {
@@ -208,6 +259,65 @@ type ConnectTcp struct {
 	Writer        int    `mapstructure:"writer"`
 	WriterBuf     int    `mapstructure:"writerBuf"`
 	WriterBufSize int    `mapstructure:"writeBufSize"`
+	MaxFrameSize  int    `mapstructure:"maxFrameSize"` // bytes with header, larger frames close the conn
+	// ms between server pings, a conn with no inbound frame for HeartbeatMisses pings is closed
+	HeartbeatInterval int `mapstructure:"heartbeatInterval"`
+	HeartbeatMisses   int `mapstructure:"heartbeatMisses"`
+	// epoll event loops instead of two goroutines per conn, linux only, not with tls
+	Netpoll bool `mapstructure:"netpoll"`
+}
+
+type ConnectHttp struct {
+	Bind         string `mapstructure:"bind"`
+	PollTimeout  int    `mapstructure:"pollTimeout"`  // ms a long poll waits for msgs before it returns empty
+	PollIdle     int    `mapstructure:"pollIdle"`     // ms without a poll before a long poll session is closed
+	SseKeepAlive int    `mapstructure:"sseKeepAlive"` // ms between keep alive comments on an idle sse stream
+}
+
+type ConnectChannel struct {
+	SlowConsumerPolicy string `mapstructure:"slowConsumerPolicy"` // drop-newest,drop-oldest,block,disconnect
+	BlockTimeout       int    `mapstructure:"blockTimeout"`       // ms, only used by block policy
+	AckWindow          int    `mapstructure:"ackWindow"`          // max unacked single msgs kept per conn, 0 disable redelivery
+	AckTimeout         int    `mapstructure:"ackTimeout"`         // ms, resend a single msg not acked in time
+	AckMaxRetries      int    `mapstructure:"ackMaxRetries"`      // resend times before the msg goes to offline inbox
+	ResumeGrace        int    `mapstructure:"resumeGrace"`        // ms a dropped session can be resumed, 0 disable resume
+	ResumeBuffer       int    `mapstructure:"resumeBuffer"`       // last msgs kept per session for replay on resume
+	SignalInterval     int    `mapstructure:"signalInterval"`     // ms, the same room signal of a user is relayed once per interval
+	BatchWindow        int    `mapstructure:"batchWindow"`        // ms ws and tcp writers wait to coalesce msgs into one write, 0 disable batching
+	BatchBytes         int    `mapstructure:"batchBytes"`         // bodies of one coalesced write stop at this size
+	MaxMessageSize     int    `mapstructure:"maxMessageSize"`     // bytes, largest frame a ws or http client may send
+}
+
+type ConnectDrain struct {
+	Timeout int `mapstructure:"timeout"` // ms, the whole drain on stop, clients are closed in the first half
+	Batch   int `mapstructure:"batch"`   // conns closed at once, 0 close all in one batch
+}
+
+type ConnectRateRule struct {
+	Rate  float64 `mapstructure:"rate"`  // frames per second
+	Burst int     `mapstructure:"burst"` // frames allowed at once
+}
+
+type ConnectRateLimit struct {
+	ThrottleAfter   int                        `mapstructure:"throttleAfter"`   // violations warned before the conn is throttled
+	CloseAfter      int                        `mapstructure:"closeAfter"`      // violations before the conn is closed, 0 never close
+	ViolationWindow int                        `mapstructure:"violationWindow"` // ms without violation to start counting over
+	Conn            map[string]ConnectRateRule `mapstructure:"conn"`            // by op number or "default", empty disable
+	User            map[string]ConnectRateRule `mapstructure:"user"`            // same, shared by all conns of a user on the server
+}
+
+type ConnectAdmission struct {
+	MaxConns        int      `mapstructure:"maxConns"`        // conns of the server, 0 no limit
+	MaxConnsPerIp   int      `mapstructure:"maxConnsPerIp"`   // conns from one source ip, 0 no limit
+	MaxConnsPerUser int      `mapstructure:"maxConnsPerUser"` // conns of one user on the server, 0 no limit
+	AcceptRate      float64  `mapstructure:"acceptRate"`      // new conns per second, 0 no limit
+	AcceptBurst     int      `mapstructure:"acceptBurst"`     // new conns allowed at once
+	TrustedProxies  []string `mapstructure:"trustedProxies"`  // ips or cidrs whose X-Forwarded-For is trusted
+}
+
+type ConnectDebug struct {
+	Introspect      bool   `mapstructure:"introspect"`      // serve /debug/connect on the metrics port
+	IntrospectToken string `mapstructure:"introspectToken"` // if set, the bearer token /debug/connect requires
 }
 
 type ConnectConfig struct {
@@ -217,18 +327,33 @@ type ConnectConfig struct {
 	ConnectBucket              ConnectBucket              `mapstructure:"connect-bucket"`
 	ConnectWebsocket           ConnectWebsocket           `mapstructure:"connect-websocket"`
 	ConnectTcp                 ConnectTcp                 `mapstructure:"connect-tcp"`
+	ConnectChannel             ConnectChannel             `mapstructure:"connect-channel"`
+	ConnectDrain               ConnectDrain               `mapstructure:"connect-drain"`
+	ConnectDebug               ConnectDebug               `mapstructure:"connect-debug"`
+	ConnectRateLimit           ConnectRateLimit           `mapstructure:"connect-ratelimit"`
+	ConnectHttp                ConnectHttp                `mapstructure:"connect-http"`
+	ConnectRpcAddressHttp      ConnectRpcAddressHttp      `mapstructure:"connect-rpcAddress-http"`
+	ConnectAdmission           ConnectAdmission           `mapstructure:"connect-admission"`
 }
 
 type LogicBase struct {
-	ServerId   string `mapstructure:"serverId"`
-	CpuNum     int    `mapstructure:"cpuNum"`
-	RpcAddress string `mapstructure:"rpcAddress"`
-	CertPath   string `mapstructure:"certPath"`
-	KeyPath    string `mapstructure:"keyPath"`
+	ServerId      string `mapstructure:"serverId"`
+	CpuNum        int    `mapstructure:"cpuNum"`
+	RpcAddress    string `mapstructure:"rpcAddress"`
+	RpcTls        bool   `mapstructure:"rpcTls"`   // serve the logic rpc over tls
+	CertPath      string `mapstructure:"certPath"` // with keyPath, the pair served if rpcTls is on
+	KeyPath       string `mapstructure:"keyPath"`
+	RpcCaPath     string `mapstructure:"rpcCaPath"`     // ca rpc clients trust, stable across leaf rotation
+	RpcServerName string `mapstructure:"rpcServerName"` // name rpc clients check in the cert, default the dialed host
+}
+
+type LogicModeration struct {
+	Moderators []int `mapstructure:"moderators"` // user ids allowed to kick, mute and ban in any room
 }
 
 type LogicConfig struct {
-	LogicBase LogicBase `mapstructure:"logic-base"`
+	LogicBase       LogicBase       `mapstructure:"logic-base"`
+	LogicModeration LogicModeration `mapstructure:"logic-moderation"`
 }
 
 type TaskBase struct {
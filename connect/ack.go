@@ -0,0 +1,221 @@
+package connect
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gochat/proto"
+)
+
+var (
+	errNoSeq       = errors.New("seq empty")
+	errChannelGone = errors.New("channel closed")
+)
+
+// ackWindow keep the single msgs pushed to a channel until the client acks them by seq,
+// a nil ackWindow means redelivery is disabled, all its methods are no-op
+type ackWindow struct {
+	lock       sync.Mutex
+	size       int
+	timeout    time.Duration
+	maxRetries int
+	pending    map[string]*list.Element // seq => element of order
+	order      *list.List               // *unackedMsg, oldest first
+	drained    bool                     // the conn closed, no msg is tracked any more
+}
+
+type unackedMsg struct {
+	msg      *proto.Msg
+	deadline time.Time
+	retries  int
+}
+
+func newAckWindow(size int, timeout time.Duration, maxRetries int) *ackWindow {
+	if size <= 0 || timeout <= 0 {
+		return nil
+	}
+	return &ackWindow{
+		size:       size,
+		timeout:    timeout,
+		maxRetries: maxRetries,
+		pending:    make(map[string]*list.Element, size),
+		order:      list.New(),
+	}
+}
+
+// len is the number of unacked msgs
+func (w *ackWindow) len() int {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.order.Len()
+}
+
+// track add the msg to the window, if the window is full the oldest msg leaves it and is returned.
+// return errChannelGone if the window was drained, the msg would never be flushed to the offline inbox
+func (w *ackWindow) track(msg *proto.Msg, now time.Time) (evicted *proto.Msg, err error) {
+	if w == nil || msg.SeqId == "" {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.drained {
+		return nil, errChannelGone
+	}
+	if _, ok := w.pending[msg.SeqId]; ok {
+		return
+	}
+	if w.order.Len() >= w.size {
+		oldest := w.order.Remove(w.order.Front()).(*unackedMsg)
+		delete(w.pending, oldest.msg.SeqId)
+		evicted = oldest.msg
+	}
+	w.pending[msg.SeqId] = w.order.PushBack(&unackedMsg{msg: msg, deadline: now.Add(w.timeout)})
+	return
+}
+
+// ack remove the msg from the window, return false if it's not in the window
+func (w *ackWindow) ack(seq string) bool {
+	if w == nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	e, ok := w.pending[seq]
+	if !ok {
+		return false
+	}
+	w.order.Remove(e)
+	delete(w.pending, seq)
+	return true
+}
+
+// expired return the msgs not acked in time which should be resent, and the msgs resent
+// maxRetries times already, the latter leave the window
+func (w *ackWindow) expired(now time.Time) (resend []*proto.Msg, giveUp []*proto.Msg) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for e := w.order.Front(); e != nil; {
+		next := e.Next()
+		m := e.Value.(*unackedMsg)
+		if now.Before(m.deadline) {
+			e = next
+			continue
+		}
+		if m.retries >= w.maxRetries {
+			w.order.Remove(e)
+			delete(w.pending, m.msg.SeqId)
+			giveUp = append(giveUp, m.msg)
+		} else {
+			m.retries++
+			m.deadline = now.Add(w.timeout)
+			resend = append(resend, m.msg)
+		}
+		e = next
+	}
+	return
+}
+
+// drain empty the window for good, return the unacked msgs oldest first
+func (w *ackWindow) drain() (msgs []*proto.Msg) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.drained = true
+	for e := w.order.Front(); e != nil; e = e.Next() {
+		msgs = append(msgs, e.Value.(*unackedMsg).msg)
+	}
+	w.order.Init()
+	w.pending = make(map[string]*list.Element, w.size)
+	return
+}
+
+// redeliverTicker tick every half ack timeout, nil channel if redelivery is disabled
+func (w *ackWindow) redeliverTicker() (c <-chan time.Time, stop func()) {
+	if w == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(w.timeout / 2)
+	return ticker.C, ticker.Stop
+}
+
+// pushSingle push a single msg to the channel and keep it until the client acks it
+func (s *Server) pushSingle(ch *Channel, msg *proto.Msg) error {
+	evicted, err := ch.acks.track(msg, time.Now())
+	if evicted != nil {
+		s.saveUnacked(ch, evicted)
+	}
+	if err != nil {
+		return err
+	}
+	return ch.Push(msg)
+}
+
+// pushUser push a single msg to every device of the user on this server. if no device got it,
+// e.g. the user left between the lookup of logic and the push, it goes to the offline inbox
+func (s *Server) pushUser(userId int, msg *proto.Msg) (err error) {
+	pushed := 0
+	for _, ch := range s.Bucket(userId).Channels(userId) {
+		if pushErr := s.pushSingle(ch, msg); pushErr != nil {
+			logrus.Warnf("push single userId=%d deviceId=%s err:%s", userId, ch.deviceId, pushErr.Error())
+			continue
+		}
+		pushed++
+	}
+	if pushed > 0 {
+		return
+	}
+	logrus.Debugf("push single seq=%s userId=%d not online on this server, save it offline", msg.SeqId, userId)
+	return s.saveOffline(userId, msg)
+}
+
+// ackMsg client got a single msg, stop resending it and tell logic it's delivered
+func (s *Server) ackMsg(ch *Channel, seq string) error {
+	if seq == "" {
+		return errNoSeq
+	}
+	ch.acks.ack(seq)
+	return s.operator.AckMsg(&proto.MsgAckRequest{UserId: ch.userId, SeqId: seq})
+}
+
+// redeliver resend the msgs not acked in time, called by the write loop of the conn
+func (s *Server) redeliver(ch *Channel) {
+	resend, giveUp := ch.acks.expired(time.Now())
+	for _, msg := range resend {
+		if err := ch.Push(msg); err != nil {
+			logrus.Warnf("redeliver seq=%s userId=%d err:%s", msg.SeqId, ch.userId, err.Error())
+		}
+	}
+	for _, msg := range giveUp {
+		s.saveUnacked(ch, msg)
+	}
+}
+
+// flushUnacked move the unacked msgs of a closed conn to the offline inbox,
+// so they are pushed again when the user reconnects
+func (s *Server) flushUnacked(ch *Channel) {
+	for _, msg := range ch.acks.drain() {
+		s.saveUnacked(ch, msg)
+	}
+}
+
+func (s *Server) saveUnacked(ch *Channel, msg *proto.Msg) {
+	if err := s.saveOffline(ch.userId, msg); err != nil {
+		logrus.Warnf("save unacked seq=%s userId=%d err:%s", msg.SeqId, ch.userId, err.Error())
+	}
+}
+
+// saveOffline keep the msg in the user offline inbox, logic keeps a seq once
+func (s *Server) saveOffline(userId int, msg *proto.Msg) error {
+	return s.operator.SaveOfflineMsg(&proto.SaveOfflineMsgRequest{UserId: userId, SeqId: msg.SeqId, Msg: msg.Body})
+}
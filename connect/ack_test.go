@@ -0,0 +1,155 @@
+package connect
+
+import (
+	"testing"
+	"time"
+
+	"gochat/proto"
+)
+
+// offlineOperator record the msgs saved to the offline inbox
+type offlineOperator struct {
+	Operator
+	saved []*proto.SaveOfflineMsgRequest
+}
+
+func (o *offlineOperator) SaveOfflineMsg(req *proto.SaveOfflineMsgRequest) error {
+	o.saved = append(o.saved, req)
+	return nil
+}
+
+func (o *offlineOperator) DisConnect(req *proto.DisConnectRequest) error {
+	return nil
+}
+
+func seqMsg(seq string) *proto.Msg {
+	return &proto.Msg{SeqId: seq, Body: []byte(seq)}
+}
+
+func seqs(msgs []*proto.Msg) (s []string) {
+	for _, m := range msgs {
+		s = append(s, m.SeqId)
+	}
+	return
+}
+
+func TestAckWindowDisabled(t *testing.T) {
+	w := newAckWindow(0, time.Second, 3)
+	if w != nil {
+		t.Fatal("window of size 0 should be disabled")
+	}
+	// nil window is a no-op
+	if evicted, _ := w.track(seqMsg("1"), time.Now()); evicted != nil {
+		t.Error("disabled window should not evict")
+	}
+	if w.ack("1") {
+		t.Error("disabled window should not ack")
+	}
+	if msgs := w.drain(); len(msgs) != 0 {
+		t.Error("disabled window should be empty")
+	}
+}
+
+func TestAckWindowEvictOldest(t *testing.T) {
+	now := time.Now()
+	w := newAckWindow(2, time.Second, 3)
+	w.track(seqMsg("1"), now)
+	w.track(seqMsg("2"), now)
+	w.track(seqMsg("2"), now) // same seq tracked once
+	evicted, _ := w.track(seqMsg("3"), now)
+	if evicted == nil || evicted.SeqId != "1" {
+		t.Fatalf("want seq 1 evicted, got %v", evicted)
+	}
+	if !w.ack("2") {
+		t.Error("seq 2 should be in window")
+	}
+	if w.ack("2") {
+		t.Error("seq 2 acked twice")
+	}
+	if got := seqs(w.drain()); len(got) != 1 || got[0] != "3" {
+		t.Errorf("want [3] left, got %v", got)
+	}
+}
+
+func TestAckWindowExpired(t *testing.T) {
+	now := time.Now()
+	w := newAckWindow(10, time.Second, 1)
+	w.track(seqMsg("1"), now)
+	w.track(seqMsg("2"), now.Add(500*time.Millisecond))
+
+	resend, giveUp := w.expired(now.Add(900 * time.Millisecond))
+	if len(resend) != 0 || len(giveUp) != 0 {
+		t.Fatalf("nothing should expire yet, got %v %v", seqs(resend), seqs(giveUp))
+	}
+	resend, giveUp = w.expired(now.Add(1200 * time.Millisecond))
+	if got := seqs(resend); len(got) != 1 || got[0] != "1" || len(giveUp) != 0 {
+		t.Fatalf("want seq 1 resent, got %v %v", got, seqs(giveUp))
+	}
+	// seq 1 resent once already, next timeout gives it up, seq 2 is resent
+	resend, giveUp = w.expired(now.Add(2300 * time.Millisecond))
+	if got := seqs(giveUp); len(got) != 1 || got[0] != "1" {
+		t.Errorf("want seq 1 given up, got %v", got)
+	}
+	if got := seqs(resend); len(got) != 1 || got[0] != "2" {
+		t.Errorf("want seq 2 resent, got %v", got)
+	}
+	if got := seqs(w.drain()); len(got) != 1 || got[0] != "2" {
+		t.Errorf("want [2] left, got %v", got)
+	}
+}
+
+func TestAckWindowDrained(t *testing.T) {
+	w := newAckWindow(2, time.Second, 3)
+	w.drain()
+	if _, err := w.track(seqMsg("1"), time.Now()); err != errChannelGone {
+		t.Errorf("track after drain err %v, want %v", err, errChannelGone)
+	}
+	if got := w.drain(); len(got) != 0 {
+		t.Errorf("drained window tracked %v", seqs(got))
+	}
+}
+
+func TestPushUserOffline(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &offlineOperator{}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{})
+	if err := s.pushUser(1, seqMsg("1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.saved) != 1 || o.saved[0].UserId != 1 || o.saved[0].SeqId != "1" {
+		t.Fatalf("saved %+v, want seq 1 of user 1", o.saved)
+	}
+	ch := NewChannel(4, DropNewest, 0)
+	ch.acks = newAckWindow(4, time.Second, 3)
+	b.Put(1, "a", 0, ch)
+	if err := s.pushUser(1, seqMsg("2")); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.saved) != 1 || ch.acks.len() != 1 {
+		t.Fatalf("online user: saved %d msgs, %d unacked, want 1 and 1", len(o.saved), ch.acks.len())
+	}
+}
+
+// the conn closes after the push found its channel and before the msg is tracked,
+// the flush of the unacked msgs already ran, the msg goes to the offline inbox
+func TestPushUserDisconnectRace(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &offlineOperator{}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{})
+	ch := NewChannel(4, DropNewest, 0)
+	ch.acks = newAckWindow(4, time.Second, 3)
+	b.Put(1, "a", 0, ch)
+	s.pushSingle(ch, seqMsg("1"))
+	// disconnect flushed seq 1, the channel is still found by a push started before
+	s.flushUnacked(ch)
+	if err := s.pushUser(1, seqMsg("2")); err != nil {
+		t.Fatal(err)
+	}
+	var saved []string
+	for _, req := range o.saved {
+		saved = append(saved, req.SeqId)
+	}
+	if len(saved) != 2 || saved[0] != "1" || saved[1] != "2" {
+		t.Errorf("saved seqs %v, want [1 2]", saved)
+	}
+}
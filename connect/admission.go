@@ -0,0 +1,240 @@
+package connect
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/pkg/metrics"
+	"gochat/proto"
+)
+
+// admission control of new conns of every transport. total conns, conns per source ip and
+// the accept rate are checked when a conn comes in, before its upgrade or connect frame.
+// conns per user are checked once logic told who the user is
+
+// reasons a conn is refused, also the reason label of the metric
+const (
+	RejectMaxConns   = "max_conns"
+	RejectMaxPerIp   = "max_conns_per_ip"
+	RejectMaxPerUser = "max_conns_per_user"
+	RejectAcceptRate = "accept_rate"
+)
+
+// AdmissionOptions are the admission limits, a zero limit is no limit
+type AdmissionOptions struct {
+	MaxConns        int
+	MaxConnsPerIp   int
+	MaxConnsPerUser int
+	AcceptRate      RateRule
+	TrustedProxies  []*net.IPNet // peers whose X-Forwarded-For is trusted
+}
+
+// ParseAdmission read the limits from config, a trusted proxy is an ip or a cidr
+func ParseAdmission(conf config.ConnectAdmission) AdmissionOptions {
+	o := AdmissionOptions{
+		MaxConns:        conf.MaxConns,
+		MaxConnsPerIp:   conf.MaxConnsPerIp,
+		MaxConnsPerUser: conf.MaxConnsPerUser,
+	}
+	if conf.AcceptRate > 0 && conf.AcceptBurst > 0 {
+		o.AcceptRate = RateRule{Rate: conf.AcceptRate, Burst: conf.AcceptBurst}
+	}
+	for _, proxy := range conf.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			logrus.Errorf("admission trusted proxy %q is not an ip or cidr, ignore", proxy)
+			continue
+		}
+		o.TrustedProxies = append(o.TrustedProxies, ipNet)
+	}
+	return o
+}
+
+func (o *AdmissionOptions) trusted(ip net.IP) bool {
+	for _, ipNet := range o.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIp is the source ip of a http request. behind trusted proxies it is the last
+// X-Forwarded-For entry not added by one of them, entries before it can be forged by the client
+func (o *AdmissionOptions) requestIp(r *http.Request) string {
+	ip := addrIp(r.RemoteAddr)
+	peer := net.ParseIP(ip)
+	if peer == nil || !o.trusted(peer) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+		if !o.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// addrIp is the ip of a host:port address, the address itself if it has no port
+func addrIp(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// admission count the open conns of the server, in total and per source ip
+type admission struct {
+	opts   AdmissionOptions
+	lock   sync.Mutex
+	total  int
+	perIp  map[string]int
+	accept *tokenBucket // nil if the accept rate is not limited
+}
+
+func newAdmission(opts AdmissionOptions) *admission {
+	a := &admission{opts: opts, perIp: make(map[string]int)}
+	if opts.AcceptRate.Rate > 0 {
+		a.accept = &tokenBucket{rule: opts.AcceptRate, tokens: float64(opts.AcceptRate.Burst), last: time.Now()}
+	}
+	return a
+}
+
+// admit count a new conn from ip, the reason is empty if the conn is admitted,
+// it must then be released once when it closes
+func (a *admission) admit(ip string, now time.Time) (reason string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	switch {
+	case a.opts.MaxConns > 0 && a.total >= a.opts.MaxConns:
+		return RejectMaxConns
+	case a.opts.MaxConnsPerIp > 0 && a.perIp[ip] >= a.opts.MaxConnsPerIp:
+		return RejectMaxPerIp
+	case a.accept != nil && a.accept.take(now) > 0:
+		return RejectAcceptRate
+	}
+	a.total++
+	a.perIp[ip]++
+	metrics.AdmissionSourceIPs.Set(float64(len(a.perIp)))
+	return ""
+}
+
+func (a *admission) release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.total--
+	if a.perIp[ip]--; a.perIp[ip] <= 0 {
+		delete(a.perIp, ip)
+	}
+	metrics.AdmissionSourceIPs.Set(float64(len(a.perIp)))
+}
+
+// admitConn admit a new conn of the transport from ip, the reason is empty if it is admitted
+func (s *Server) admitConn(transport, ip string) (reason string) {
+	if reason = s.admission.admit(ip, time.Now()); reason != "" {
+		logrus.Infof("refuse %s conn from %s: %s", transport, ip, reason)
+		s.rejected(transport, reason)
+		return
+	}
+	metrics.ConnectionsTotal.WithLabelValues("connect", transport, "accepted").Inc()
+	metrics.ConnectionsActive.WithLabelValues("connect", transport).Inc()
+	return
+}
+
+// admitted bind an admitted conn to its channel, so it is released when the channel closes
+func (ch *Channel) admitted(ip string) {
+	ch.remoteIp = ip
+	atomic.StoreInt32(&ch.admit, 1)
+}
+
+// releaseConn release the admission of the channel, once, no-op if it was never admitted
+func (s *Server) releaseConn(ch *Channel) {
+	if atomic.CompareAndSwapInt32(&ch.admit, 1, 0) {
+		s.release(ch.transport(), ch.remoteIp)
+	}
+}
+
+// release an admitted conn which is closed, or which failed before it got a channel
+func (s *Server) release(transport, ip string) {
+	s.admission.release(ip)
+	metrics.ConnectionsActive.WithLabelValues("connect", transport).Dec()
+}
+
+func (s *Server) rejected(transport, reason string) {
+	metrics.ConnectionsTotal.WithLabelValues("connect", transport, "rejected").Inc()
+	metrics.AdmissionRejectedTotal.WithLabelValues(transport, reason).Inc()
+}
+
+var errMaxConnsPerUser = errors.New("too many connections for user")
+
+// admitUser put the channel of the user in its bucket once logic connected it, unless the user
+// has MaxConnsPerUser conns of other devices on this server already. a conn of the same device
+// replaces the old one so it does not count. a refused conn is disconnected from logic again
+// and errMaxConnsPerUser returned, the old channel of the device is returned like Bucket.Put
+func (s *Server) admitUser(ch *Channel, userId int, connReq *proto.ConnectRequest) (old *Channel, err error) {
+	old, err = s.Bucket(userId).Admit(userId, connReq.DeviceId, connReq.RoomId, ch, s.admission.opts.MaxConnsPerUser)
+	if err != errMaxConnsPerUser {
+		return
+	}
+	s.refuseUser(ch, userId)
+	disConnectRequest := &proto.DisConnectRequest{UserId: userId, ServerId: connReq.ServerId, DeviceId: connReq.DeviceId}
+	if connReq.RoomId > 0 {
+		disConnectRequest.RoomIds = []int{connReq.RoomId}
+	}
+	if err := s.operator.DisConnect(disConnectRequest); err != nil {
+		logrus.Warnf("DisConnect refused conn err :%s", err.Error())
+	}
+	return
+}
+
+func (s *Server) refuseUser(ch *Channel, userId int) {
+	logrus.Infof("refuse %s conn of userId=%d: %s", ch.transport(), userId, RejectMaxPerUser)
+	s.rejected(ch.transport(), RejectMaxPerUser)
+}
+
+// refuseTcp answer the connect frame of a refused tcp conn with the reason, the writer
+// closes the conn once it is written
+func (s *Server) refuseTcp(ch *Channel, seq string, err error) {
+	body, _ := json.Marshal(proto.OpReply{
+		Op:    config.OpReply,
+		SeqId: seq,
+		ReqOp: config.OpBuildTcpConn,
+		Code:  config.FailReplyCode,
+		Msg:   err.Error(),
+	})
+	atomic.StoreInt32(&ch.refused, 1)
+	if pushErr := ch.Push(&proto.Msg{Ver: config.MsgVersion, Operation: config.OpReply, SeqId: seq, Body: body}); pushErr != nil {
+		ch.closeRefused()
+	}
+}
+
+// refuse answer a refused upgrade or session, the reason is in the body
+func refuse(w http.ResponseWriter, reason string) {
+	status := http.StatusTooManyRequests
+	if reason == RejectMaxConns {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "connection refused: "+reason, status)
+}
@@ -0,0 +1,143 @@
+package connect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestAdmission(t *testing.T) {
+	now := time.Now()
+	a := newAdmission(AdmissionOptions{MaxConns: 3, MaxConnsPerIp: 2})
+	for _, ip := range []string{"1.1.1.1", "1.1.1.1"} {
+		if reason := a.admit(ip, now); reason != "" {
+			t.Fatalf("conn from %s refused: %s", ip, reason)
+		}
+	}
+	if reason := a.admit("1.1.1.1", now); reason != RejectMaxPerIp {
+		t.Errorf("third conn of an ip got %q", reason)
+	}
+	a.admit("2.2.2.2", now)
+	if reason := a.admit("3.3.3.3", now); reason != RejectMaxConns {
+		t.Errorf("conn over the total got %q", reason)
+	}
+	a.release("1.1.1.1")
+	if reason := a.admit("1.1.1.1", now); reason != "" {
+		t.Errorf("released slot not reused: %s", reason)
+	}
+
+	a = newAdmission(AdmissionOptions{AcceptRate: RateRule{Rate: 1, Burst: 2}})
+	a.admit("1.1.1.1", now)
+	a.admit("1.1.1.1", now)
+	if reason := a.admit("1.1.1.1", now); reason != RejectAcceptRate {
+		t.Errorf("accept over the burst got %q", reason)
+	}
+	if reason := a.admit("1.1.1.1", now.Add(time.Second)); reason != "" {
+		t.Errorf("accept after refill refused: %s", reason)
+	}
+}
+
+func TestRequestIp(t *testing.T) {
+	o := ParseAdmission(config.ConnectAdmission{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "bad"}})
+	if len(o.TrustedProxies) != 2 {
+		t.Fatalf("parsed %d trusted proxies, want 2", len(o.TrustedProxies))
+	}
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"8.8.8.8:1234", "", "8.8.8.8"},
+		{"8.8.8.8:1234", "1.2.3.4", "8.8.8.8"}, // untrusted peer, header ignored
+		{"10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1", "1.2.3.4"}, // client forged the first entry
+		{"10.0.0.1:1234", "10.0.0.2", "10.0.0.2"},                     // only proxies, the first one
+		{"10.0.0.1:1234", "junk, 1.2.3.4", "1.2.3.4"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := o.requestIp(r); got != c.want {
+			t.Errorf("%s via %q: got %s, want %s", c.remote, c.forwarded, got, c.want)
+		}
+	}
+}
+
+func TestAdmitUser(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{Admission: AdmissionOptions{MaxConnsPerUser: 2}})
+	b.Put(1, "a", 7, NewChannel(4, DropNewest, 0))
+	b.Put(1, "b", 7, NewChannel(4, DropNewest, 0))
+
+	// a device reconnecting replaces its conn, it does not count twice
+	if old, err := s.admitUser(NewChannel(4, DropNewest, 0), 1, &proto.ConnectRequest{DeviceId: "a", RoomId: 7}); err != nil || old == nil {
+		t.Errorf("reconnect of a device: old %v err %v", old, err)
+	}
+	if _, err := s.admitUser(NewChannel(4, DropNewest, 0), 1, &proto.ConnectRequest{DeviceId: "c", RoomId: 7}); err != errMaxConnsPerUser {
+		t.Fatalf("third device err %v, want %v", err, errMaxConnsPerUser)
+	}
+	select {
+	case <-o.disconnected:
+	default:
+		t.Error("refused conn not disconnected from logic")
+	}
+	if n := len(b.Channels(1)); n != 2 {
+		t.Errorf("%d channels of the user, want 2", n)
+	}
+}
+
+func TestAdmitUserConcurrent(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &httpOperator{disconnected: make(chan int, 16)}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{Admission: AdmissionOptions{MaxConnsPerUser: 2}})
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.admitUser(NewChannel(4, DropNewest, 0), 1, &proto.ConnectRequest{DeviceId: strconv.Itoa(i)})
+		}(i)
+	}
+	wg.Wait()
+	if n := len(b.Channels(1)); n != 2 {
+		t.Errorf("%d channels of the user admitted at once, want 2", n)
+	}
+}
+
+func TestTakeOverMaxConnsPerUser(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{ResumeGrace: time.Minute, Admission: AdmissionOptions{MaxConnsPerUser: 1}})
+	old := NewChannel(4, DropNewest, 0)
+	old.resumeToken = "token"
+	b.Put(1, "a", 0, old)
+	s.detach(old, "test")
+	// the user is at its limit without the session
+	b.Put(1, "b", 0, NewChannel(4, DropNewest, 0))
+	ch := NewChannel(4, DropNewest, 0)
+	if s.takeOver(ch, &proto.ConnectRequest{AuthToken: "good", ResumeToken: "token"}) {
+		t.Fatal("resume over the user limit admitted")
+	}
+	if n := len(b.Channels(1)); n != 1 || ch.userId != 0 {
+		t.Errorf("%d channels of the user, refused channel of userId=%d", n, ch.userId)
+	}
+}
+
+func TestServeWsRefused(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{Admission: AdmissionOptions{MaxConns: 1}})
+	s.admitConn("ws", "1.1.1.1")
+	w := httptest.NewRecorder()
+	new(Connect).serveWs(s, w, httptest.NewRequest(http.MethodGet, "/ws", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), RejectMaxConns) {
+		t.Errorf("got %d %q, want 503 with the reason", w.Code, w.Body.String())
+	}
+}
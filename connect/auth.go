@@ -0,0 +1,66 @@
+package connect
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// a websocket client can send its auth token in the upgrade request, in one of these
+const (
+	authTokenQuery             = "token"         // ws://host/ws?token=...
+	authTokenCookie            = "gochat_token"  // cookie set by the site
+	authTokenSubprotocolPrefix = "gochat.token." // Sec-WebSocket-Protocol: gochat.v1.json, gochat.token.<token>
+)
+
+// tokenSubprotocol return the token subprotocol offered by the client, empty if there is none
+func tokenSubprotocol(r *http.Request) string {
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(subprotocol, authTokenSubprotocolPrefix) {
+			return subprotocol
+		}
+	}
+	return ""
+}
+
+// upgradeAuthToken find the auth token of an upgrade request, empty if there is none
+func upgradeAuthToken(r *http.Request) string {
+	if token := r.URL.Query().Get(authTokenQuery); token != "" {
+		return token
+	}
+	if subprotocol := tokenSubprotocol(r); subprotocol != "" {
+		// browsers do not allow '=' in a subprotocol, so the base64 padding may be left out
+		token := strings.TrimPrefix(subprotocol, authTokenSubprotocolPrefix)
+		if n := len(token) % 4; n != 0 {
+			token += strings.Repeat("=", 4-n)
+		}
+		return token
+	}
+	if cookie, err := r.Cookie(authTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// authUpgrade check the auth token of the upgrade request before any conn resource is used,
+// on false the request is already answered with 401. the token is empty if the client sent
+// none and none is required, the client then sends it in the connect frame
+func (s *Server) authUpgrade(w http.ResponseWriter, r *http.Request) (authToken string, ok bool) {
+	authToken = upgradeAuthToken(r)
+	if authToken == "" {
+		if s.Options.RequireUpgradeAuth {
+			http.Error(w, "auth token required", http.StatusUnauthorized)
+			return "", false
+		}
+		return "", true
+	}
+	userId, _, err := s.operator.CheckAuth(authToken)
+	if err != nil || userId == 0 {
+		logrus.Infof("websocket upgrade auth fail from %s", r.RemoteAddr)
+		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+		return "", false
+	}
+	return authToken, true
+}
@@ -0,0 +1,130 @@
+package connect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"gochat/pkg/envelope"
+	"gochat/pkg/origin"
+)
+
+// authOperator answer CheckAuth from a token map, other calls are not expected
+type authOperator struct {
+	Operator
+	users map[string]int
+}
+
+func (o *authOperator) CheckAuth(authToken string) (int, string, error) {
+	return o.users[authToken], "", nil
+}
+
+func TestUpgradeAuthToken(t *testing.T) {
+	cases := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  string
+	}{
+		{"none", func(r *http.Request) {}, ""},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "token=abc" }, "abc"},
+		{"subprotocol", func(r *http.Request) {
+			r.Header.Set("Sec-WebSocket-Protocol", "gochat.v1.json, gochat.token.YWJjZA")
+		}, "YWJjZA=="},
+		{"cookie", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: authTokenCookie, Value: "xyz="})
+		}, "xyz="},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		c.setup(r)
+		if got := upgradeAuthToken(r); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAuthUpgrade(t *testing.T) {
+	s := NewServer(nil, &authOperator{users: map[string]int{"good": 7}}, ServerOptions{})
+	check := func(query string, wantOk bool) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/ws"+query, nil)
+		w := httptest.NewRecorder()
+		_, ok := s.authUpgrade(w, r)
+		if ok != wantOk {
+			t.Errorf("%q: ok=%v, want %v", query, ok, wantOk)
+		}
+		if !ok && w.Code != http.StatusUnauthorized {
+			t.Errorf("%q: rejected with %d, want 401", query, w.Code)
+		}
+	}
+	check("?token=good", true)
+	check("?token=bad", false)
+	// a token in the connect frame is still allowed unless required
+	check("", true)
+	s.Options.RequireUpgradeAuth = true
+	check("", false)
+	check("?token=good", true)
+}
+
+func TestUpgradeEchoTokenSubprotocol(t *testing.T) {
+	defer func(u websocket.Upgrader) { sharedUpgrader = u }(sharedUpgrader)
+	sharedUpgrader = websocket.Upgrader{Subprotocols: envelope.Subprotocols}
+	formats := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader(r).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		formats <- wsFormat(conn)
+		conn.Close()
+	}))
+	defer srv.Close()
+	cases := []struct {
+		offer       []string
+		subprotocol string
+		format      string
+	}{
+		// a browser offering only its token fails without an echo
+		{[]string{"gochat.token.YWJjZA"}, "gochat.token.YWJjZA", ""},
+		{[]string{"gochat.v1.json", "gochat.token.YWJjZA"}, envelope.SubprotocolJSON, envelope.SubprotocolJSON},
+		{nil, "", ""},
+	}
+	for _, c := range cases {
+		dialer := websocket.Dialer{Subprotocols: c.offer}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("offer %v: dial: %v", c.offer, err)
+		}
+		if got := conn.Subprotocol(); got != c.subprotocol {
+			t.Errorf("offer %v: subprotocol %q, want %q", c.offer, got, c.subprotocol)
+		}
+		if got := <-formats; got != c.format {
+			t.Errorf("offer %v: format %q, want %q", c.offer, got, c.format)
+		}
+		conn.Close()
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin(origin.New([]string{"https://*.example.com"}))
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true}, // not a browser
+		{"https://chat.example.com", true},
+		{"http://example.com", true}, // same host as the request
+		{"https://evil.com", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := check(r); got != c.want {
+			t.Errorf("origin %q: got %v, want %v", c.origin, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package connect
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/pkg/stickpackage"
+	"gochat/proto"
+)
+
+// batching is opt in with BatchWindow. the ws and tcp writers then take the msgs queued within
+// the window, up to BatchBytes of bodies, and write them at once: one OpBatch frame on an
+// enveloped websocket conn, one vectored write of the frames on a tcp conn. legacy websocket
+// conns only get bodies, they are never batched
+
+// nextBatch take the next msgs to write at once in lane order. after the first msg it waits
+// up to window for more, it stops early at budget bytes of bodies or after a msg which ends the conn
+func (ch *Channel) nextBatch(window time.Duration, budget int) (msgs []*proto.Msg) {
+	var timer *time.Timer
+	size := 0
+	for limit := cap(ch.control) + cap(ch.broadcast); len(msgs) < limit; {
+		msg := ch.dequeue()
+		if msg == nil {
+			if timer == nil {
+				return
+			}
+			select {
+			case <-ch.wake:
+				continue
+			case <-timer.C:
+			case <-ch.done:
+			}
+			return
+		}
+		if timer == nil {
+			timer = time.NewTimer(window)
+			defer timer.Stop()
+		}
+		msgs = append(msgs, msg)
+		size += len(msg.Body)
+		if budget > 0 && size >= budget || endsConn(ch, msg) {
+			return
+		}
+	}
+	return
+}
+
+// endsConn is true if the conn is closed once msg is written, nothing is batched after it
+func endsConn(ch *Channel, msg *proto.Msg) bool {
+	return msg.Operation == config.OpReconnect ||
+		msg.Operation == config.OpKick && atomic.LoadInt32(&ch.kickClose) == 1 ||
+		msg.Operation == config.OpReply && atomic.LoadInt32(&ch.refused) == 1
+}
+
+// writeBatched write the next batch with write, return false if the conn must be closed
+func (ch *Channel) writeBatched(window time.Duration, budget int, write func(msgs []*proto.Msg) error) bool {
+	msgs := ch.nextBatch(window, budget)
+	if len(msgs) == 0 {
+		return true
+	}
+	if err := write(msgs); err != nil {
+		return false
+	}
+	for _, msg := range msgs {
+		if ch.closeAfterWrite(msg) {
+			return false
+		}
+	}
+	if ch.priorityQueued()+len(ch.broadcast) > 0 {
+		// the rest goes in the next batch, after the other events of the writer
+		ch.wakeWriter()
+	}
+	return true
+}
+
+// writeWsBatch write msgs as one OpBatch frame in the envelope of the conn, a single msg as
+// itself. a msg shared by many conns reuses its encoded frame
+func (s *Server) writeWsBatch(ch *Channel, msgs []*proto.Msg) error {
+	if len(msgs) == 1 {
+		return s.writeWsMsg(ch, msgs[0])
+	}
+	subprotocol := wsFormat(ch.conn)
+	frames := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		var data []byte
+		var err error
+		if msg.Frames != nil {
+			var frame *sharedFrame
+			if frame, err = preparedWsFrame(subprotocol, msg); err == nil {
+				data = frame.data
+			}
+		} else {
+			_, data, err = encodeWsFrame(subprotocol, msg)
+		}
+		if err != nil {
+			logrus.Warnf("encodeWsFrame op=%d err:%s", msg.Operation, err.Error())
+			continue
+		}
+		frames = append(frames, data)
+	}
+	if len(frames) == 0 {
+		return nil
+	}
+	if subprotocol == envelope.SubprotocolBinary {
+		data, err := envelope.EncodeBinaryBatch(config.MsgVersion, config.OpBatch, frames)
+		if err != nil {
+			logrus.Warnf("EncodeBinaryBatch err:%s", err.Error())
+			return nil
+		}
+		return s.writeWsData(ch, websocket.BinaryMessage, data)
+	}
+	return s.writeWsData(ch, websocket.TextMessage, envelope.EncodeJSONBatch(config.MsgVersion, config.OpBatch, frames))
+}
+
+// writeTcpBatch write the frames of msgs with one vectored write, the headers share one
+// buffer and the bodies are not copied
+func writeTcpBatch(ch *Channel, msgs []*proto.Msg) error {
+	headers := make([]byte, 0, len(msgs)*stickpackage.V2HeaderLength)
+	bufs := make(net.Buffers, 0, 2*len(msgs))
+	for _, msg := range msgs {
+		f := tcpFrame(ch, msg)
+		start := len(headers)
+		var err error
+		if headers, err = stickpackage.AppendHeader(headers, f); err != nil {
+			logrus.Warnf("drop tcp msg op:%d of %d bytes err:%s", msg.Operation, len(msg.Body), err.Error())
+			continue
+		}
+		bufs = append(bufs, headers[start:len(headers):len(headers)], f.Body)
+	}
+	if len(bufs) == 0 {
+		return nil
+	}
+	logrus.Debugf("send %d tcp msgs to conn in one write", len(bufs)/2)
+	_, err := bufs.WriteTo(ch.connTcp)
+	return err
+}
@@ -0,0 +1,214 @@
+package connect
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/pkg/stickpackage"
+	"gochat/proto"
+)
+
+func chatMsg(seq string, body []byte) *proto.Msg {
+	return &proto.Msg{Ver: config.MsgVersion, Operation: config.OpRoomSend, SeqId: seq, Body: body}
+}
+
+func TestNextBatch(t *testing.T) {
+	ch := NewChannel(8, DropNewest, 0)
+	for i := 0; i < 4; i++ {
+		ch.Push(chatMsg(fmt.Sprint(i), make([]byte, 10)))
+	}
+	if msgs := ch.nextBatch(time.Second, 25); len(msgs) != 3 {
+		t.Errorf("batch of %d msgs, want 3 within the byte budget", len(msgs))
+	}
+	if msgs := ch.nextBatch(10*time.Millisecond, 0); len(msgs) != 1 {
+		t.Errorf("batch of %d msgs, want the one left", len(msgs))
+	}
+	if msgs := ch.nextBatch(time.Second, 0); len(msgs) != 0 {
+		t.Errorf("empty lanes gave %d msgs", len(msgs))
+	}
+
+	// a msg queued within the window joins the batch
+	ch.Push(chatMsg("a", nil))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ch.Push(chatMsg("b", nil))
+	}()
+	if msgs := ch.nextBatch(time.Second, 0); len(msgs) != 2 {
+		t.Errorf("batch of %d msgs, want the late one too", len(msgs))
+	}
+
+	// nothing is written after a kick which closes the conn
+	atomic.StoreInt32(&ch.kickClose, 1)
+	ch.Push(chatMsg("c", nil))
+	ch.Push(&proto.Msg{Operation: config.OpKick})
+	if msgs := ch.nextBatch(time.Second, 0); len(msgs) != 1 || msgs[0].Operation != config.OpKick {
+		t.Errorf("batch %v, want the kick alone", msgs)
+	}
+}
+
+func TestWriteWsBatch(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{})
+	for _, subprotocol := range []string{envelope.SubprotocolJSON, envelope.SubprotocolBinary} {
+		ch, client := wsPair(t, s, subprotocol)
+		shared := chatMsg("1", []byte(`{"msg":"room"}`))
+		shareFrames(shared)
+		if err := s.writeWsBatch(ch, []*proto.Msg{shared, chatMsg("2", []byte(`{"msg":"hi"}`))}); err != nil {
+			t.Fatalf("writeWsBatch: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame *envelope.Frame
+		var frames []*envelope.Frame
+		if subprotocol == envelope.SubprotocolJSON {
+			if frame, err = envelope.DecodeJSON(data); err == nil {
+				frames, err = envelope.DecodeJSONBatch(frame.Body)
+			}
+		} else if frame, err = envelope.DecodeBinary(data); err == nil {
+			frames, err = envelope.DecodeBinaryBatch(frame.Body)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", subprotocol, err)
+		}
+		if frame.Op != config.OpBatch {
+			t.Fatalf("%s: got op %d, want a batch", subprotocol, frame.Op)
+		}
+		if len(frames) != 2 || frames[0].Seq != "1" || frames[1].Seq != "2" || string(frames[1].Body) != `{"msg":"hi"}` {
+			t.Errorf("%s: unpacked %+v", subprotocol, frames)
+		}
+	}
+}
+
+func TestWriteTcpBatch(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	ch := NewChannel(4, DropNewest, 0)
+	ch.connTcp = server
+	ch.tcpVersion = stickpackage.Version2
+	msgs := []*proto.Msg{chatMsg("1", []byte("one")), chatMsg("2", nil), chatMsg("3", []byte("three"))}
+	go func() {
+		writeTcpBatch(ch, msgs)
+		server.Close()
+	}()
+	d := stickpackage.NewDecoder(client, 0)
+	for _, msg := range msgs {
+		f, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(f.Seq) != msg.SeqId || !bytes.Equal(f.Body, msg.Body) {
+			t.Errorf("got frame seq %d body %q, want %s", f.Seq, f.Body, msg.SeqId)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("end of batch: got %v, want io.EOF", err)
+	}
+}
+
+// benchMsgs are the msgs written per op of the benchmarks, a burst in a busy room
+func benchMsgs() []*proto.Msg {
+	body := []byte(`{"msg":"` + strings.Repeat("a", 100) + `"}`)
+	msgs := make([]*proto.Msg, 16)
+	for i := range msgs {
+		msgs[i] = chatMsg(fmt.Sprint(1700000000000+i), body)
+	}
+	return msgs
+}
+
+func BenchmarkWsWrite(b *testing.B) {
+	s := NewServer(nil, nil, ServerOptions{})
+	msgs := benchMsgs()
+	b.Run("single", func(b *testing.B) {
+		ch, client := wsPair(b, s, envelope.SubprotocolJSON)
+		go discardWs(client)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, msg := range msgs {
+				if err := s.writeWsMsg(ch, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		ch, client := wsPair(b, s, envelope.SubprotocolJSON)
+		go discardWs(client)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := s.writeWsBatch(ch, msgs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func discardWs(client *websocket.Conn) {
+	for {
+		_, r, err := client.NextReader()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, r)
+	}
+}
+
+func BenchmarkTcpWrite(b *testing.B) {
+	msgs := benchMsgs()
+	b.Run("single", func(b *testing.B) {
+		ch := tcpBenchChannel(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, msg := range msgs {
+				if err := stickpackage.WriteFrame(ch.connTcp, tcpFrame(ch, msg)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		ch := tcpBenchChannel(b)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := writeTcpBatch(ch, msgs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// tcpBenchChannel is a v2 channel on a loopback tcp conn whose peer discards everything
+func tcpBenchChannel(b *testing.B) *Channel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go io.Copy(io.Discard, client)
+	ch := NewChannel(4, DropNewest, 0)
+	ch.connTcp = server
+	ch.tcpVersion = stickpackage.Version2
+	return ch
+}
@@ -12,13 +12,15 @@ import (
 )
 
 type Bucket struct {
-	cLock         sync.RWMutex     // protect the channels for chs
-	chs           map[int]*Channel // map sub key to a channel
+	cLock         sync.RWMutex                // protect the channels for chs
+	chs           map[int]map[string]*Channel // map userId to the channels of every device
 	bucketOptions BucketOptions
 	rooms         map[int]*Room // bucket room channels
 	routines      []chan *proto.PushRoomMsgRequest
 	routinesNum   uint64
 	broadcast     chan []byte
+	limiters      map[int]*opLimiter // per user inbound rate limit, shared by the user's conns
+	signals       map[int]*signalCoalescer
 }
 
 type BucketOptions struct {
@@ -30,7 +32,9 @@ type BucketOptions struct {
 
 func NewBucket(bucketOptions BucketOptions) (b *Bucket) {
 	b = new(Bucket)
-	b.chs = make(map[int]*Channel, bucketOptions.ChannelSize)
+	b.chs = make(map[int]map[string]*Channel, bucketOptions.ChannelSize)
+	b.limiters = make(map[int]*opLimiter)
+	b.signals = make(map[int]*signalCoalescer)
 	b.bucketOptions = bucketOptions
 	b.routines = make([]chan *proto.PushRoomMsgRequest, bucketOptions.RoutineAmount)
 	b.rooms = make(map[int]*Room, bucketOptions.RoomSize)
@@ -50,7 +54,7 @@ func (b *Bucket) PushRoom(ch chan *proto.PushRoomMsgRequest) {
 		)
 		arg = <-ch
 		if room = b.Room(arg.RoomId); room != nil {
-			room.Push(&arg.Msg)
+			room.Push(&arg.Msg, arg.ExceptUserId)
 		}
 	}
 }
@@ -62,52 +66,214 @@ func (b *Bucket) Room(rid int) (room *Room) {
 	return
 }
 
-func (b *Bucket) Put(userId int, roomId int, ch *Channel) (err error) {
-	var (
-		room *Room
-		ok   bool
-	)
+// Put register the channel of a user device, a user may have many devices online at the same time,
+// the old channel of the same device is returned, so caller can close it
+func (b *Bucket) Put(userId int, deviceId string, roomId int, ch *Channel) (old *Channel, err error) {
+	return b.Admit(userId, deviceId, roomId, ch, 0)
+}
+
+// Admit is Put unless the user already has max channels of other devices, then it puts nothing and
+// return errMaxConnsPerUser. the count and the put are one step, max <= 0 is no limit
+func (b *Bucket) Admit(userId int, deviceId string, roomId int, ch *Channel, max int) (old *Channel, err error) {
 	b.cLock.Lock()
-	if roomId != NoRoom {
-		if room, ok = b.rooms[roomId]; !ok {
-			room = NewRoom(roomId)
-			b.rooms[roomId] = room
-		}
-		ch.Room = room
+	if max > 0 && b.otherDevices(userId, deviceId) >= max {
+		b.cLock.Unlock()
+		return nil, errMaxConnsPerUser
 	}
 	ch.userId = userId
-	b.chs[userId] = ch
+	ch.deviceId = deviceId
+	devices, ok := b.chs[userId]
+	if !ok {
+		devices = make(map[string]*Channel)
+		b.chs[userId] = devices
+	}
+	if old = devices[deviceId]; old == ch {
+		old = nil
+	}
+	devices[deviceId] = ch
 	b.cLock.Unlock()
 
-	if room != nil {
-		err = room.Put(ch)
+	if roomId != NoRoom {
+		err = b.JoinRoom(roomId, ch)
 	}
 	return
 }
 
-func (b *Bucket) DeleteChannel(ch *Channel) {
+// JoinRoom add the channel to a room, a channel can join many rooms
+func (b *Bucket) JoinRoom(roomId int, ch *Channel) (err error) {
 	var (
-		ok   bool
 		room *Room
+		ok   bool
 	)
 	b.cLock.Lock()
-	if ch, ok = b.chs[ch.userId]; ok {
-		room = b.chs[ch.userId].Room
+	if room, ok = b.rooms[roomId]; !ok {
+		room = NewRoom(roomId)
+		b.rooms[roomId] = room
+	}
+	err = room.Put(ch)
+	b.cLock.Unlock()
+	if err == nil {
+		ch.addRoom(room)
+	}
+	return
+}
+
+// otherDevices count the channels of the user but the one of deviceId, cLock must be held
+func (b *Bucket) otherDevices(userId int, deviceId string) (n int) {
+	for id := range b.chs[userId] {
+		if id != deviceId {
+			n++
+		}
+	}
+	return
+}
+
+// TakeOver move the device and rooms of a resumed session from its old channel to the new one,
+// unless the user already has max channels of other devices, then it moves nothing and return false
+func (b *Bucket) TakeOver(old *Channel, ch *Channel, max int) bool {
+	b.cLock.Lock()
+	if max > 0 && b.otherDevices(old.userId, old.deviceId) >= max {
+		b.cLock.Unlock()
+		return false
+	}
+	if devices, ok := b.chs[old.userId]; ok && devices[old.deviceId] == old {
+		devices[old.deviceId] = ch
+	}
+	for _, room := range old.Rooms() {
+		// put the new channel first, so the room never gets empty and dropped
+		if err := room.Put(ch); err == nil {
+			ch.addRoom(room)
+		}
+		b.deleteRoomChannel(room, old)
+	}
+	b.cLock.Unlock()
+	return true
+}
+
+// LeaveRoom remove the channel from a room, return false if channel not in the room
+func (b *Bucket) LeaveRoom(roomId int, ch *Channel) bool {
+	room := ch.delRoom(roomId)
+	if room == nil {
+		return false
+	}
+	b.cLock.Lock()
+	b.deleteRoomChannel(room, ch)
+	b.cLock.Unlock()
+	return true
+}
+
+// DeleteChannel remove the channel from bucket and all its rooms,
+// return false if the device already replaced it by a new channel
+func (b *Bucket) DeleteChannel(ch *Channel) (deleted bool) {
+	b.cLock.Lock()
+	// the device may already have a new channel in bucket, only delete self
+	if devices, ok := b.chs[ch.userId]; ok && devices[ch.deviceId] == ch {
 		//delete from bucket
-		delete(b.chs, ch.userId)
+		delete(devices, ch.deviceId)
+		if len(devices) == 0 {
+			delete(b.chs, ch.userId)
+			delete(b.limiters, ch.userId)
+			delete(b.signals, ch.userId)
+		}
+		deleted = true
+	}
+	for _, room := range ch.Rooms() {
+		b.deleteRoomChannel(room, ch)
 	}
-	if room != nil && room.DeleteChannel(ch) {
+	b.cLock.Unlock()
+	return
+}
+
+// deleteRoomChannel must be called with cLock held
+func (b *Bucket) deleteRoomChannel(room *Room, ch *Channel) {
+	if room.DeleteChannel(ch) {
 		// if room empty delete,will mark room.drop is true
-		if room.drop == true {
+		if b.rooms[room.Id] == room {
 			delete(b.rooms, room.Id)
 		}
 	}
-	b.cLock.Unlock()
 }
 
-func (b *Bucket) Channel(userId int) (ch *Channel) {
+// Channels return the channels of all online devices of the user
+func (b *Bucket) Channels(userId int) (chs []*Channel) {
+	b.cLock.RLock()
+	chs = make([]*Channel, 0, len(b.chs[userId]))
+	for _, ch := range b.chs[userId] {
+		chs = append(chs, ch)
+	}
+	b.cLock.RUnlock()
+	return
+}
+
+// UserLimiter return the rate limiter of the user, created with rules on first use
+func (b *Bucket) UserLimiter(userId int, rules map[int]RateRule) *opLimiter {
+	b.cLock.Lock()
+	defer b.cLock.Unlock()
+	l, ok := b.limiters[userId]
+	if !ok {
+		l = newOpLimiter(rules)
+		b.limiters[userId] = l
+	}
+	return l
+}
+
+// UserSignals return the signal coalescer of the user, shared by the user's conns
+func (b *Bucket) UserSignals(userId int) *signalCoalescer {
+	b.cLock.Lock()
+	defer b.cLock.Unlock()
+	c, ok := b.signals[userId]
+	if !ok {
+		c = newSignalCoalescer()
+		b.signals[userId] = c
+	}
+	return c
+}
+
+// Stats is a snapshot of the bucket sizes and routine queue lengths
+func (b *Bucket) Stats() (stats proto.BucketStats) {
 	b.cLock.RLock()
-	ch = b.chs[userId]
+	stats.Users = len(b.chs)
+	for _, devices := range b.chs {
+		stats.Channels += len(devices)
+	}
+	stats.Rooms = len(b.rooms)
+	b.cLock.RUnlock()
+	stats.RoutineQueues = make([]int, len(b.routines))
+	for i, routine := range b.routines {
+		stats.RoutineQueues[i] = len(routine)
+	}
+	return
+}
+
+// RoomsOnline add the online count of each room in the bucket to online
+func (b *Bucket) RoomsOnline(online map[int]int) {
+	b.cLock.RLock()
+	for roomId, room := range b.rooms {
+		room.rLock.RLock()
+		online[roomId] += room.OnlineCount
+		room.rLock.RUnlock()
+	}
+	b.cLock.RUnlock()
+}
+
+// AllChannels return the channels of all devices in the bucket
+func (b *Bucket) AllChannels() (chs []*Channel) {
+	b.cLock.RLock()
+	for _, devices := range b.chs {
+		for _, ch := range devices {
+			chs = append(chs, ch)
+		}
+	}
+	b.cLock.RUnlock()
+	return
+}
+
+// ChannelCount return the number of online devices in the bucket
+func (b *Bucket) ChannelCount() (n int) {
+	b.cLock.RLock()
+	for _, devices := range b.chs {
+		n += len(devices)
+	}
 	b.cLock.RUnlock()
 	return
 }
@@ -6,36 +6,279 @@
 package connect
 
 import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"gochat/pkg/metrics"
 	"gochat/proto"
-	"net"
 )
 
+// SlowConsumerPolicy decide what Channel.Push does when the channel chat lane is full
+type SlowConsumerPolicy int
+
+const (
+	DropNewest SlowConsumerPolicy = iota // drop the msg being pushed
+	DropOldest                           // drop the oldest queued msg to make room
+	Block                                // wait for room up to a timeout, then drop the msg
+	Disconnect                           // close the slow client conn
+)
+
+var ErrSlowConsumer = errors.New("channel broadcast queue full")
+
+func ParseSlowConsumerPolicy(policy string) SlowConsumerPolicy {
+	switch policy {
+	case "drop-oldest":
+		return DropOldest
+	case "block":
+		return Block
+	case "disconnect":
+		return Disconnect
+	default:
+		return DropNewest
+	}
+}
+
 // in fact, Channel it's a user Connect session
 type Channel struct {
-	Room      *Room
-	Next      *Channel
-	Prev      *Channel
-	broadcast chan *proto.Msg
-	done      chan struct{}
-	userId    int
-	conn      *websocket.Conn
-	connTcp   *net.TCPConn
+	rLock        sync.RWMutex  // protect rooms
+	rooms        map[int]*Room // rooms the channel joined
+	broadcast    chan *proto.Msg
+	done         chan struct{}
+	userId       int
+	userName     string
+	deviceId     string
+	conn         *websocket.Conn
+	connTcp      net.Conn // plain or tls tcp conn
+	tcpVersion   int32    // stickpackage version of the tcp conn, set by its first frame
+	heartbeats   int32    // 1 once the tcp client sent a ping or pong, only then it is timed out
+	policy       SlowConsumerPolicy
+	blockTimeout time.Duration
+	closeOnce    sync.Once
+	acks         *ackWindow // unacked single msgs, nil if redelivery disabled
+	// session resume, see resume.go
+	replay         *replayBuffer
+	resumeToken    string
+	sessTimer      *time.Timer
+	closedByServer int32  // conn closed on purpose, no resume
+	authToken      string // checked during the websocket upgrade, used if the connect frame has none
+	// inbound rate limit, the violations are only counted by the read loop
+	limiterOnce   sync.Once
+	limiter       *opLimiter
+	violations    int
+	lastViolation time.Time
+	deferred      deferredOps // ops of a throttled conn
+	// tcp heartbeat, see heartbeat.go
+	pingSeq    uint64
+	pingSentAt int64 // unix nano of the last ping
+	rtt        int64 // ns, last measured round trip
+	kickClose  int32 // close the conn after the OpKick notice is written
+	refused    int32 // connect refused, close the conn after the OpReply with the reason is written
+	createdAt  time.Time
+	http       *httpConn // sse or long poll, see server_http.go
+	remoteIp   string    // source ip counted by admission control
+	admit      int32     // admitted and not released yet
+	// priority lanes drained before broadcast, the chat lane, see lane.go
+	control chan *proto.Msg
+	system  snapshotLane
+	wake    chan struct{} // a msg was queued in any lane
+	notify  func()        // set on netpoll conns, which have no writer waiting on wake
 }
 
-func NewChannel(size int) (c *Channel) {
+func NewChannel(size int, policy SlowConsumerPolicy, blockTimeout time.Duration) (c *Channel) {
 	c = new(Channel)
 	c.broadcast = make(chan *proto.Msg, size)
+	c.control = make(chan *proto.Msg, size)
+	c.wake = make(chan struct{}, 1)
 	c.done = make(chan struct{})
-	c.Next = nil
-	c.Prev = nil
+	c.policy = policy
+	c.blockTimeout = blockTimeout
+	c.rooms = make(map[int]*Room)
+	c.createdAt = time.Now()
+	return
+}
+
+// transport is the kind of conn of the channel: ws, tcp, sse or poll
+func (ch *Channel) transport() string {
+	switch {
+	case ch.conn != nil:
+		return "ws"
+	case ch.http != nil:
+		return ch.http.transport
+	default:
+		return "tcp"
+	}
+}
+
+func (ch *Channel) addRoom(room *Room) {
+	ch.rLock.Lock()
+	ch.rooms[room.Id] = room
+	ch.rLock.Unlock()
+}
+
+func (ch *Channel) delRoom(roomId int) (room *Room) {
+	ch.rLock.Lock()
+	if room = ch.rooms[roomId]; room != nil {
+		delete(ch.rooms, roomId)
+	}
+	ch.rLock.Unlock()
+	return
+}
+
+func (ch *Channel) InRoom(roomId int) (ok bool) {
+	ch.rLock.RLock()
+	_, ok = ch.rooms[roomId]
+	ch.rLock.RUnlock()
+	return
+}
+
+func (ch *Channel) Rooms() (rooms []*Room) {
+	ch.rLock.RLock()
+	rooms = make([]*Room, 0, len(ch.rooms))
+	for _, room := range ch.rooms {
+		rooms = append(rooms, room)
+	}
+	ch.rLock.RUnlock()
+	return
+}
+
+func (ch *Channel) RoomIds() (roomIds []int) {
+	ch.rLock.RLock()
+	roomIds = make([]int, 0, len(ch.rooms))
+	for roomId := range ch.rooms {
+		roomIds = append(roomIds, roomId)
+	}
+	ch.rLock.RUnlock()
 	return
 }
 
 func (ch *Channel) Push(msg *proto.Msg) (err error) {
+	return ch.push(msg, "none")
+}
+
+func (ch *Channel) PushRoom(roomId int, msg *proto.Msg) (err error) {
+	return ch.push(msg, strconv.Itoa(roomId))
+}
+
+func (ch *Channel) push(msg *proto.Msg, room string) (err error) {
+	if replayable(msg) {
+		if ch.replay.record(msg) {
+			// session detached, the msg is sent when the client resumes
+			return
+		}
+	} else if ch.replay.isDetached() {
+		// replies, pings, signals and notices are stale once the client resumes, they are lost
+		return
+	}
+	switch msgLane(msg.Operation) {
+	case laneControl:
+		return ch.pushControl(msg, room)
+	case laneSystem:
+		ch.system.put(room, msg)
+		ch.wakeWriter()
+		return
+	}
 	select {
 	case ch.broadcast <- msg:
+		ch.wakeWriter()
+		return
 	default:
 	}
-	return
+	switch ch.policy {
+	case DropOldest:
+		for {
+			select {
+			case <-ch.broadcast:
+				metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "drop_oldest").Inc()
+			default:
+			}
+			select {
+			case ch.broadcast <- msg:
+				ch.wakeWriter()
+				return
+			default:
+			}
+		}
+	case Block:
+		timer := time.NewTimer(ch.blockTimeout)
+		defer timer.Stop()
+		select {
+		case ch.broadcast <- msg:
+			ch.wakeWriter()
+			return
+		case <-ch.done:
+			return
+		case <-timer.C:
+			metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "timeout").Inc()
+		}
+	case Disconnect:
+		metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "disconnect").Inc()
+		ch.closeSlowConsumer()
+	default:
+		metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "drop_newest").Inc()
+	}
+	return ErrSlowConsumer
+}
+
+func (ch *Channel) closeSlowConsumer() {
+	ch.closeConn(websocket.ClosePolicyViolation, "slow consumer")
+}
+
+// closeReplaced close the old conn of a device which reconnected
+func (ch *Channel) closeReplaced() {
+	ch.closeConn(websocket.CloseNormalClosure, "replaced by new conn")
+}
+
+// closeConnected close a conn which sent a second connect frame, the user and device of a
+// conn never change, its session is not kept for resume
+func (ch *Channel) closeConnected() {
+	ch.closeConn(websocket.ClosePolicyViolation, "already connected")
+}
+
+// closeRestart close the conn of a draining server, the client should reconnect to another one
+func (ch *Channel) closeRestart() {
+	ch.closeConn(websocket.CloseServiceRestart, "server restart, reconnect")
+}
+
+// pushWait push a msg not kept for replay, wait for the writer instead of applying the slow consumer policy.
+// replayed snapshots stay in order with the chat around them, they do not know their room to be coalesced
+func (ch *Channel) pushWait(msg *proto.Msg, timeout time.Duration) error {
+	queue := ch.broadcast
+	if msgLane(msg.Operation) == laneControl {
+		queue = ch.control
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case queue <- msg:
+		ch.wakeWriter()
+		return nil
+	case <-ch.done:
+		return ErrSlowConsumer
+	case <-timer.C:
+		return errReplayTimeout
+	}
+}
+
+// closeConn close the conn with a reason, the read loop then exec the normal disConnect
+func (ch *Channel) closeConn(code int, reason string) {
+	atomic.StoreInt32(&ch.closedByServer, 1)
+	ch.closeOnce.Do(func() {
+		if ch.conn != nil {
+			ch.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, reason),
+				time.Now().Add(time.Second))
+			ch.conn.Close()
+		}
+		if ch.connTcp != nil {
+			_ = ch.connTcp.Close()
+		}
+		if ch.http != nil {
+			ch.http.close()
+		}
+	})
 }
@@ -0,0 +1,110 @@
+package connect
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gochat/pkg/metrics"
+)
+
+// fullChannel is a channel of the policy whose chat queue holds msg "1" and is full
+func fullChannel(policy SlowConsumerPolicy, blockTimeout time.Duration) *Channel {
+	ch := NewChannel(1, policy, blockTimeout)
+	ch.Push(chatMsg("1", nil))
+	return ch
+}
+
+func dropped(room string, reason string) float64 {
+	return testutil.ToFloat64(metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, reason))
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	t.Run("drop newest", func(t *testing.T) {
+		ch := fullChannel(DropNewest, 0)
+		before := dropped("101", "drop_newest")
+		if err := ch.PushRoom(101, chatMsg("2", nil)); err != ErrSlowConsumer {
+			t.Fatalf("got %v, want ErrSlowConsumer", err)
+		}
+		if msg := ch.dequeue(); msg == nil || msg.SeqId != "1" {
+			t.Errorf("queued %v, want the old msg kept", msg)
+		}
+		if n := dropped("101", "drop_newest") - before; n != 1 {
+			t.Errorf("%v drops counted for the room, want 1", n)
+		}
+	})
+	t.Run("drop oldest", func(t *testing.T) {
+		ch := fullChannel(DropOldest, 0)
+		before := dropped("102", "drop_oldest")
+		if err := ch.PushRoom(102, chatMsg("2", nil)); err != nil {
+			t.Fatal(err)
+		}
+		if msg := ch.dequeue(); msg == nil || msg.SeqId != "2" {
+			t.Errorf("queued %v, want the new msg in place of the old one", msg)
+		}
+		if n := dropped("102", "drop_oldest") - before; n != 1 {
+			t.Errorf("%v drops counted for the room, want 1", n)
+		}
+	})
+	t.Run("block", func(t *testing.T) {
+		ch := fullChannel(Block, 20*time.Millisecond)
+		before := dropped("103", "timeout")
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			ch.dequeue()
+		}()
+		if err := ch.PushRoom(103, chatMsg("2", nil)); err != nil {
+			t.Fatalf("push should wait for the writer, got %v", err)
+		}
+		start := time.Now()
+		if err := ch.PushRoom(103, chatMsg("3", nil)); err != ErrSlowConsumer {
+			t.Fatalf("got %v, want ErrSlowConsumer after the timeout", err)
+		}
+		if waited := time.Since(start); waited < 20*time.Millisecond {
+			t.Errorf("gave up after %s, before the block timeout", waited)
+		}
+		if n := dropped("103", "timeout") - before; n != 1 {
+			t.Errorf("%v timeouts counted for the room, want 1", n)
+		}
+	})
+	t.Run("disconnect", func(t *testing.T) {
+		ch := fullChannel(Disconnect, 0)
+		before := dropped("104", "disconnect")
+		if err := ch.PushRoom(104, chatMsg("2", nil)); err != ErrSlowConsumer {
+			t.Fatalf("got %v, want ErrSlowConsumer", err)
+		}
+		if atomic.LoadInt32(&ch.closedByServer) != 1 {
+			t.Error("slow consumer should be closed")
+		}
+		if n := dropped("104", "disconnect") - before; n != 1 {
+			t.Errorf("%v disconnects counted for the room, want 1", n)
+		}
+	})
+}
+
+func TestRoomPushUnlocked(t *testing.T) {
+	room := NewRoom(7)
+	slow := NewChannel(1, Block, time.Second)
+	slow.Push(chatMsg("1", nil))
+	room.Put(slow)
+	done := make(chan struct{})
+	go func() {
+		room.Push(chatMsg("2", nil), 0)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// a member joins while the push waits for the slow one
+	joined := make(chan struct{})
+	go func() {
+		room.Put(NewChannel(1, Block, time.Second))
+		close(joined)
+	}()
+	select {
+	case <-joined:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("put waited for the push to a slow member")
+	}
+	slow.dequeue()
+	<-done
+}
@@ -0,0 +1,217 @@
+package connect
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+)
+
+// dispatchClientOp handle a frame sent by client after the conn is connected,
+// both websocket and tcp conns go through here, the sender is always the user of the channel
+func (s *Server) dispatchClientOp(ch *Channel, op *proto.ClientOp) {
+	if ch.userId == 0 {
+		logrus.Warnf("client op %d before connect, ignore", op.Op)
+		return
+	}
+	if !s.allowOp(ch, op) {
+		return
+	}
+	s.handleClientOp(ch, op)
+}
+
+// handleClientOp run a client op which passed the rate limit
+func (s *Server) handleClientOp(ch *Channel, op *proto.ClientOp) {
+	var (
+		err    error
+		msgSeq string
+	)
+	switch op.Op {
+	case config.OpMsgAck:
+		// acks are never answered, the seq is the one of the acked msg
+		if err = s.ackMsg(ch, op.SeqId); err != nil {
+			logrus.Debugf("ack msg seq=%s userId=%d err:%s", op.SeqId, ch.userId, err.Error())
+		}
+		return
+	case config.OpOfflineAck:
+		// client got the offline msgs, clear them and push the next batch
+		s.pushOfflineMsg(ch, op.AckId)
+	case config.OpRoomSignal:
+		// signals are never answered
+		s.sendSignal(ch, op)
+		return
+	case config.OpRoomJoin:
+		err = s.joinRoom(ch, op.RoomId)
+	case config.OpRoomLeave:
+		err = s.leaveRoom(ch, op.RoomId)
+	case config.OpSingleSend:
+		msgSeq, err = s.sendSingle(ch, op)
+	case config.OpRoomSend:
+		err = s.sendRoom(ch, op)
+	case config.OpRoomCountSend, config.OpRoomInfoSend:
+		err = s.roomQuery(ch, op)
+	default:
+		logrus.Warnf("unknown client op %d, userId=%d", op.Op, ch.userId)
+		err = errUnknownOp
+	}
+	s.replyClientOp(ch, op, msgSeq, err)
+}
+
+var (
+	errUnknownOp = errors.New("unknown op")
+	errEmptyMsg  = errors.New("msg empty")
+	errNoRoom    = errors.New("roomId empty")
+	errNotInRoom = errors.New("not in room")
+	errNoToUser  = errors.New("toUserId empty")
+)
+
+// replyClientOp answer the client op by a OpReply frame, only if client set a seq
+func (s *Server) replyClientOp(ch *Channel, op *proto.ClientOp, msgSeq string, err error) {
+	if op.SeqId == "" {
+		return
+	}
+	body := proto.OpReply{
+		Op:     config.OpReply,
+		SeqId:  op.SeqId,
+		ReqOp:  op.Op,
+		Code:   config.SuccessReplyCode,
+		Msg:    config.SuccessReplyMsg,
+		MsgSeq: msgSeq,
+	}
+	if err != nil {
+		body.Code = config.FailReplyCode
+		body.Msg = err.Error()
+	}
+	bodyBytes, _ := json.Marshal(body)
+	msg := &proto.Msg{
+		Ver:       config.MsgVersion,
+		Operation: config.OpReply,
+		SeqId:     op.SeqId,
+		Body:      bodyBytes,
+	}
+	if err := ch.Push(msg); err != nil {
+		logrus.Warnf("reply client op %d seq=%s userId=%d err:%s", op.Op, op.SeqId, ch.userId, err.Error())
+	}
+}
+
+// sendSingle return the seq logic gave the msg, sender query its delivery status by it
+func (s *Server) sendSingle(ch *Channel, op *proto.ClientOp) (msgSeq string, err error) {
+	if op.ToUserId <= 0 {
+		return "", errNoToUser
+	}
+	if op.Msg == "" {
+		return "", errEmptyMsg
+	}
+	req := &proto.Send{
+		Msg:          op.Msg,
+		FromUserId:   ch.userId,
+		FromUserName: ch.userName,
+		ToUserId:     op.ToUserId,
+		RoomId:       op.RoomId,
+		Op:           config.OpSingleSend,
+	}
+	reply, err := s.operator.Push(req)
+	if err != nil {
+		return
+	}
+	if reply.Code != config.SuccessReplyCode {
+		return "", errors.New("logic push fail")
+	}
+	return reply.SeqId, nil
+}
+
+// sendRoom only allow sending to a room the conn joined
+func (s *Server) sendRoom(ch *Channel, op *proto.ClientOp) error {
+	if op.RoomId <= 0 {
+		return errNoRoom
+	}
+	if !ch.InRoom(op.RoomId) {
+		return errNotInRoom
+	}
+	if op.Msg == "" {
+		return errEmptyMsg
+	}
+	req := &proto.Send{
+		Msg:          op.Msg,
+		FromUserId:   ch.userId,
+		FromUserName: ch.userName,
+		RoomId:       op.RoomId,
+		Op:           config.OpRoomSend,
+	}
+	return logicReplyErr(s.operator.PushRoom(req))
+}
+
+// roomQuery ask logic the room count or info and push it to the asking channel only, with the
+// seq of the op. only a member may ask. the answer is a reply, so it goes to the control lane
+// and no room snapshot replaces it
+func (s *Server) roomQuery(ch *Channel, op *proto.ClientOp) error {
+	if op.RoomId <= 0 {
+		return errNoRoom
+	}
+	if !ch.InRoom(op.RoomId) {
+		return errNotInRoom
+	}
+	reply, err := s.operator.GetRoomStat(&proto.Send{RoomId: op.RoomId, Op: op.Op})
+	if err != nil {
+		return err
+	}
+	if reply.Code != config.SuccessReplyCode {
+		return errors.New("logic fail")
+	}
+	var body []byte
+	if op.Op == config.OpRoomInfoSend {
+		body, _ = json.Marshal(proto.RedisRoomInfo{Op: op.Op, RoomId: op.RoomId, Count: reply.Count, RoomUserInfo: reply.RoomUserInfo})
+	} else {
+		body, _ = json.Marshal(proto.RedisRoomCountMsg{Op: op.Op, RoomId: op.RoomId, Count: reply.Count})
+	}
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: op.Op, SeqId: op.SeqId, Body: body}
+	return ch.pushControl(msg, strconv.Itoa(op.RoomId))
+}
+
+func logicReplyErr(reply *proto.SuccessReply, err error) error {
+	if err != nil {
+		return err
+	}
+	if reply.Code != config.SuccessReplyCode {
+		if reply.Msg != "" {
+			return errors.New(reply.Msg)
+		}
+		return errors.New("logic fail")
+	}
+	return nil
+}
+
+// joinRoom let logic record the membership first, then subscribe the channel to the room
+func (s *Server) joinRoom(ch *Channel, roomId int) (err error) {
+	if roomId <= 0 {
+		return errNoRoom
+	}
+	// logic counts the conns of a user in room, so only join once per conn
+	if ch.InRoom(roomId) {
+		return
+	}
+	req := &proto.RoomMemberRequest{UserId: ch.userId, RoomId: roomId}
+	if err = s.operator.JoinRoom(req); err != nil {
+		logrus.Warnf("JoinRoom userId=%d roomId=%d err:%s", ch.userId, roomId, err.Error())
+		return
+	}
+	if err = s.Bucket(ch.userId).JoinRoom(roomId, ch); err != nil {
+		logrus.Warnf("bucket JoinRoom userId=%d roomId=%d err:%s", ch.userId, roomId, err.Error())
+		_ = s.operator.LeaveRoom(req)
+	}
+	return
+}
+
+func (s *Server) leaveRoom(ch *Channel, roomId int) (err error) {
+	if !s.Bucket(ch.userId).LeaveRoom(roomId, ch) {
+		return errNotInRoom
+	}
+	req := &proto.RoomMemberRequest{UserId: ch.userId, RoomId: roomId}
+	if err = s.operator.LeaveRoom(req); err != nil {
+		logrus.Warnf("LeaveRoom userId=%d roomId=%d err:%s", ch.userId, roomId, err.Error())
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package connect
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+// queryOperator record the room queries sent to logic
+type queryOperator struct {
+	Operator
+	queried []int
+}
+
+func (o *queryOperator) GetRoomStat(req *proto.Send) (*proto.RoomStatReply, error) {
+	o.queried = append(o.queried, req.RoomId)
+	return &proto.RoomStatReply{Code: config.SuccessReplyCode, Count: 3}, nil
+}
+
+func TestRoomQueryMembersOnly(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &queryOperator{}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{})
+	ch, other := NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0)
+	b.Put(1, "a", 7, ch)
+	b.Put(2, "a", 7, other)
+	s.dispatchClientOp(ch, &proto.ClientOp{Op: config.OpRoomCountSend, RoomId: 7, SeqId: "1"})
+	s.dispatchClientOp(ch, &proto.ClientOp{Op: config.OpRoomInfoSend, RoomId: 8, SeqId: "2"})
+	if len(o.queried) != 1 || o.queried[0] != 7 {
+		t.Errorf("queried rooms %v, want only room 7", o.queried)
+	}
+	// the count goes to the asking conn only, with the seq of the query
+	msg := ch.dequeue()
+	var count proto.RedisRoomCountMsg
+	if msg == nil || msg.Operation != config.OpRoomCountSend || msg.SeqId != "1" {
+		t.Fatalf("got %+v, want the room count for seq 1", msg)
+	}
+	if err := json.Unmarshal(msg.Body, &count); err != nil || count.RoomId != 7 || count.Count != 3 {
+		t.Errorf("count body %s err %v", msg.Body, err)
+	}
+	if msg := other.dequeue(); msg != nil {
+		t.Errorf("other member got %+v, want nothing", msg)
+	}
+	for _, want := range []string{config.SuccessReplyMsg, errNotInRoom.Error()} {
+		msg := ch.dequeue()
+		if msg == nil {
+			t.Fatal("query got no reply")
+		}
+		var reply proto.OpReply
+		if err := json.Unmarshal(msg.Body, &reply); err != nil || reply.Msg != want {
+			t.Errorf("reply %s err %v, want %q", msg.Body, err, want)
+		}
+	}
+}
@@ -7,23 +7,38 @@ package connect
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
 	_ "net/http/pprof"
 	"runtime"
+	"sync"
 	"time"
 
 	"gochat/config"
 	"gochat/pkg/metrics"
+	"gochat/pkg/stickpackage"
 	"gochat/pkg/tracing"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/smallnest/rpcx/server"
 )
 
 var DefaultServer *Server
 
 type Connect struct {
-	ServerId string
+	ServerId  string
+	tlsConfig *tls.Config // nil if no cert is configured
+	// listeners and rpc servers stopped by Drain
+	lock         sync.Mutex
+	draining     bool
+	rpcServers   []*server.Server
+	wsServer     *http.Server
+	httpServer   *http.Server // sse and long poll
+	tcpListeners []*net.TCPListener
+	netpoll      *netpoll // serves the tcp conns if netpoll is on
 }
 
 func New() *Connect {
@@ -31,69 +46,60 @@ func New() *Connect {
 }
 
 func (c *Connect) Run() {
-	// get Connect layer config
-	connectConfig := config.Conf.Connect
-
-	//set the maximum number of CPUs that can be executing
-	runtime.GOMAXPROCS(connectConfig.ConnectBucket.CpuNum)
-
-	// Initialize tracer
-	tracingCfg := tracing.Config{
-		Enabled:      config.Conf.Common.CommonTracing.Enabled,
-		Endpoint:     config.Conf.Common.CommonTracing.Endpoint,
-		SamplingRate: config.Conf.Common.CommonTracing.SamplingRate,
-	}
-	shutdown, err := tracing.InitTracer("connect-ws", tracingCfg)
-	if err != nil {
-		logrus.Errorf("Failed to initialize tracer: %v", err)
-	} else {
-		defer func() {
-			if err := shutdown(context.Background()); err != nil {
-				logrus.Errorf("Failed to shutdown tracer: %v", err)
-			}
-		}()
+	shutdown := c.newDefaultServer("ws", 9092)
+	defer shutdown()
+	//init Connect layer rpc server ,task layer will call this
+	if err := c.InitConnectWebsocketRpcServer(); err != nil {
+		logrus.Panicf("InitConnectWebsocketRpcServer Fatal error: %s \n", err.Error())
 	}
 
-	//init metrics server
-	metrics.StartMetricsServer(9092)
+	//start Connect layer server handler persistent connection
+	go func() {
+		if err := c.InitWebsocket(); err != nil && err != http.ErrServerClosed {
+			logrus.Panicf("Connect layer InitWebsocket() error:  %s \n", err.Error())
+		}
+	}()
+	c.waitForStop()
+}
 
-	//init logic layer rpc client, call logic layer rpc server
-	if err := c.InitLogicRpcClient(); err != nil {
-		logrus.Panicf("InitLogicRpcClient err:%s", err.Error())
-	}
-	//init Connect layer rpc server, logic client will call this
-	Buckets := make([]*Bucket, connectConfig.ConnectBucket.CpuNum)
-	for i := 0; i < connectConfig.ConnectBucket.CpuNum; i++ {
-		Buckets[i] = NewBucket(BucketOptions{
-			ChannelSize:   connectConfig.ConnectBucket.Channel,
-			RoomSize:      connectConfig.ConnectBucket.Room,
-			RoutineAmount: connectConfig.ConnectBucket.RoutineAmount,
-			RoutineSize:   connectConfig.ConnectBucket.RoutineSize,
-		})
-	}
-	operator := new(DefaultOperator)
-	DefaultServer = NewServer(Buckets, operator, ServerOptions{
-		WriteWait:       10 * time.Second,
-		PongWait:        60 * time.Second,
-		PingPeriod:      54 * time.Second,
-		MaxMessageSize:  512,
-		ReadBufferSize:  512,
-		WriteBufferSize: 512,
-		BroadcastSize:   8,
-	})
-	c.ServerId = fmt.Sprintf("%s-%s", "ws", uuid.New().String())
+func (c *Connect) RunTcp() {
+	shutdown := c.newDefaultServer("tcp", 9093)
+	defer shutdown()
+	//go func() {
+	//	http.ListenAndServe("0.0.0.0:9000", nil)
+	//}()
 	//init Connect layer rpc server ,task layer will call this
-	if err := c.InitConnectWebsocketRpcServer(); err != nil {
+	if err := c.InitConnectTcpRpcServer(); err != nil {
 		logrus.Panicf("InitConnectWebsocketRpcServer Fatal error: %s \n", err.Error())
 	}
+	//start Connect layer server handler persistent connection by tcp
+	if err := c.InitTcpServer(); err != nil {
+		logrus.Panicf("Connect layerInitTcpServer() error:%s\n ", err.Error())
+	}
+	c.waitForStop()
+}
 
-	//start Connect layer server handler persistent connection
-	if err := c.InitWebsocket(); err != nil {
-		logrus.Panicf("Connect layer InitWebsocket() error:  %s \n", err.Error())
+func (c *Connect) RunHttp() {
+	shutdown := c.newDefaultServer("http", 9095)
+	defer shutdown()
+	//init Connect layer rpc server ,task layer will call this
+	if err := c.InitConnectHttpRpcServer(); err != nil {
+		logrus.Panicf("InitConnectHttpRpcServer Fatal error: %s \n", err.Error())
 	}
+
+	//start Connect layer server handler sse and long poll sessions
+	go func() {
+		if err := c.InitHttpServer(); err != nil && err != http.ErrServerClosed {
+			logrus.Panicf("Connect layer InitHttpServer() error:  %s \n", err.Error())
+		}
+	}()
+	c.waitForStop()
 }
 
-func (c *Connect) RunTcp() {
+// newDefaultServer set up what every transport ("ws", "tcp" or "http") needs before it listens:
+// tracer, metrics server, tls, the logic rpc client and DefaultServer with the options of
+// the transport. the returned func shuts the tracer down
+func (c *Connect) newDefaultServer(transport string, metricsPort int) (shutdown func()) {
 	// get Connect layer config
 	connectConfig := config.Conf.Connect
 
@@ -106,20 +112,27 @@ func (c *Connect) RunTcp() {
 		Endpoint:     config.Conf.Common.CommonTracing.Endpoint,
 		SamplingRate: config.Conf.Common.CommonTracing.SamplingRate,
 	}
-	shutdown, err := tracing.InitTracer("connect-tcp", tracingCfg)
-	if err != nil {
+	shutdown = func() {}
+	if tracerShutdown, err := tracing.InitTracer("connect-"+transport, tracingCfg); err != nil {
 		logrus.Errorf("Failed to initialize tracer: %v", err)
 	} else {
-		defer func() {
-			if err := shutdown(context.Background()); err != nil {
+		shutdown = func() {
+			if err := tracerShutdown(context.Background()); err != nil {
 				logrus.Errorf("Failed to shutdown tracer: %v", err)
 			}
-		}()
+		}
 	}
 
 	//init metrics server
-	metrics.StartMetricsServer(9093)
+	var routes []metrics.Route
+	if debug := connectConfig.ConnectDebug; debug.Introspect {
+		routes = append(routes, metrics.Route{Pattern: "/debug/connect", Handler: introspectAuth(debug.IntrospectToken, http.HandlerFunc(c.introspectHandler))})
+	}
+	metrics.StartMetricsServer(metricsPort, routes...)
 
+	if err := c.initTLS(); err != nil {
+		logrus.Panicf("Connect layer initTLS err:%s", err.Error())
+	}
 	//init logic layer rpc client, call logic layer rpc server
 	if err := c.InitLogicRpcClient(); err != nil {
 		logrus.Panicf("InitLogicRpcClient err:%s", err.Error())
@@ -134,26 +147,47 @@ func (c *Connect) RunTcp() {
 			RoutineSize:   connectConfig.ConnectBucket.RoutineSize,
 		})
 	}
-	operator := new(DefaultOperator)
-	DefaultServer = NewServer(Buckets, operator, ServerOptions{
-		WriteWait:       10 * time.Second,
-		PongWait:        60 * time.Second,
-		PingPeriod:      54 * time.Second,
-		MaxMessageSize:  512,
-		ReadBufferSize:  512,
-		WriteBufferSize: 512,
-		BroadcastSize:   8,
-	})
-	//go func() {
-	//	http.ListenAndServe("0.0.0.0:9000", nil)
-	//}()
-	c.ServerId = fmt.Sprintf("%s-%s", "tcp", uuid.New().String())
-	//init Connect layer rpc server ,task layer will call this
-	if err := c.InitConnectTcpRpcServer(); err != nil {
-		logrus.Panicf("InitConnectWebsocketRpcServer Fatal error: %s \n", err.Error())
+	maxMessageSize := int64(connectConfig.ConnectChannel.MaxMessageSize)
+	if maxMessageSize <= 0 {
+		maxMessageSize = stickpackage.DefaultMaxFrame
 	}
-	//start Connect layer server handler persistent connection by tcp
-	if err := c.InitTcpServer(); err != nil {
-		logrus.Panicf("Connect layerInitTcpServer() error:%s\n ", err.Error())
+	options := ServerOptions{
+		WriteWait:          10 * time.Second,
+		PongWait:           60 * time.Second,
+		PingPeriod:         54 * time.Second,
+		MaxMessageSize:     maxMessageSize,
+		ReadBufferSize:     512,
+		WriteBufferSize:    512,
+		BroadcastSize:      8,
+		SlowConsumerPolicy: ParseSlowConsumerPolicy(connectConfig.ConnectChannel.SlowConsumerPolicy),
+		BlockTimeout:       time.Duration(connectConfig.ConnectChannel.BlockTimeout) * time.Millisecond,
+		AckWindow:          connectConfig.ConnectChannel.AckWindow,
+		AckTimeout:         time.Duration(connectConfig.ConnectChannel.AckTimeout) * time.Millisecond,
+		AckMaxRetries:      connectConfig.ConnectChannel.AckMaxRetries,
+		ResumeGrace:        time.Duration(connectConfig.ConnectChannel.ResumeGrace) * time.Millisecond,
+		ResumeBuffer:       connectConfig.ConnectChannel.ResumeBuffer,
+		RateLimit:          ParseRateLimit(connectConfig.ConnectRateLimit),
+		SignalInterval:     time.Duration(connectConfig.ConnectChannel.SignalInterval) * time.Millisecond,
+		Admission:          ParseAdmission(connectConfig.ConnectAdmission),
+		BatchWindow:        time.Duration(connectConfig.ConnectChannel.BatchWindow) * time.Millisecond,
+		BatchBytes:         connectConfig.ConnectChannel.BatchBytes,
 	}
+	switch transport {
+	case "ws":
+		options.Compression = connectConfig.ConnectWebsocket.Compression
+		options.CompressionLevel = connectConfig.ConnectWebsocket.CompressionLevel
+		options.CompressionThreshold = connectConfig.ConnectWebsocket.CompressionThreshold
+		options.RequireUpgradeAuth = connectConfig.ConnectWebsocket.RequireUpgradeAuth
+	case "tcp":
+		options.HeartbeatInterval = time.Duration(connectConfig.ConnectTcp.HeartbeatInterval) * time.Millisecond
+		options.HeartbeatMisses = connectConfig.ConnectTcp.HeartbeatMisses
+	case "http":
+		options.PollTimeout = time.Duration(connectConfig.ConnectHttp.PollTimeout) * time.Millisecond
+		options.PollIdle = time.Duration(connectConfig.ConnectHttp.PollIdle) * time.Millisecond
+		options.SseKeepAlive = time.Duration(connectConfig.ConnectHttp.SseKeepAlive) * time.Millisecond
+	}
+	operator := new(DefaultOperator)
+	DefaultServer = NewServer(Buckets, operator, options)
+	c.ServerId = fmt.Sprintf("%s-%s", transport, uuid.New().String())
+	return
 }
@@ -0,0 +1,154 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gochat/config"
+	"gochat/pkg/tlsreload"
+	"gochat/proto"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smallnest/rpcx/server"
+)
+
+// waitForStop block until a stop signal, then drain, SIGHUP only reload the tls cert
+func (c *Connect) waitForStop() {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	for sig := range quit {
+		if sig == syscall.SIGHUP {
+			tlsreload.ReloadAll()
+			continue
+		}
+		logrus.Infof("connect get signal %s, start drain", sig)
+		break
+	}
+	signal.Stop(quit)
+	c.Drain()
+}
+
+func (c *Connect) addRpcServer(s *server.Server) {
+	c.lock.Lock()
+	c.rpcServers = append(c.rpcServers, s)
+	c.lock.Unlock()
+}
+
+func (c *Connect) addTcpListener(listener *net.TCPListener) {
+	c.lock.Lock()
+	c.tcpListeners = append(c.tcpListeners, listener)
+	c.lock.Unlock()
+}
+
+// Drain stop the connect server within the drain timeout: leave etcd so task routes no more
+// msgs here, stop accepting conns, then ask the clients to reconnect elsewhere and close them
+// in batches, so the DisConnect calls to logic are spread over the timeout
+func (c *Connect) Drain() {
+	drainConfig := config.Conf.Connect.ConnectDrain
+	deadline := time.Now().Add(time.Duration(drainConfig.Timeout) * time.Millisecond)
+	c.lock.Lock()
+	c.draining = true
+	rpcServers, wsServer, httpServer, tcpListeners := c.rpcServers, c.wsServer, c.httpServer, c.tcpListeners
+	c.lock.Unlock()
+
+	for _, s := range rpcServers {
+		if err := s.UnregisterAll(); err != nil {
+			logrus.Warnf("drain unregister rpc server err:%s", err.Error())
+		}
+	}
+	if wsServer != nil {
+		// hijacked websocket conns are not touched by Shutdown
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if err := wsServer.Shutdown(ctx); err != nil {
+			logrus.Warnf("drain shutdown websocket server err:%s", err.Error())
+		}
+		cancel()
+	}
+	for _, listener := range tcpListeners {
+		_ = listener.Close()
+	}
+	DefaultServer.drain(c.ServerId, drainConfig.Batch, deadline)
+	if httpServer != nil {
+		// sse streams and polls are requests, shut down after drain so polls still get the
+		// reconnect hint, new sessions are refused meanwhile
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if err := httpServer.Shutdown(ctx); err != nil {
+			logrus.Warnf("drain shutdown http server err:%s", err.Error())
+		}
+		cancel()
+	}
+	logrus.Infof("connect drain done")
+}
+
+func (c *Connect) isDraining() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.draining
+}
+
+// drain close all channels batch by batch, the batches take the first half of the time left,
+// the second half is for the DisConnect calls of the last batches
+func (s *Server) drain(serverId string, batch int, deadline time.Time) {
+	s.dropAllSessions(serverId)
+	var chs []*Channel
+	for _, b := range s.Buckets {
+		chs = append(chs, b.AllChannels()...)
+	}
+	if batch <= 0 {
+		batch = len(chs)
+	}
+	if len(chs) > 0 {
+		batches := (len(chs) + batch - 1) / batch
+		interval := time.Until(deadline) / 2 / time.Duration(batches)
+		// clients reconnect spread over the whole timeout, not all at once to the other nodes
+		maxDelay := int(time.Until(deadline)/time.Millisecond) + 1
+		logrus.Infof("drain %d channels in %d batches", len(chs), batches)
+		for i := 0; i < len(chs); i += batch {
+			end := i + batch
+			if end > len(chs) {
+				end = len(chs)
+			}
+			for _, ch := range chs[i:end] {
+				s.closeReconnect(ch, rand.Intn(maxDelay))
+			}
+			time.Sleep(interval)
+		}
+	}
+	for s.channelCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// closeReconnect push a reconnect hint, the writer close the conn once it is sent
+func (s *Server) closeReconnect(ch *Channel, delay int) {
+	body, _ := json.Marshal(proto.ReconnectHint{Op: config.OpReconnect, Delay: delay})
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpReconnect, Body: body}
+	if err := ch.pushWait(msg, s.Options.WriteWait); err != nil {
+		ch.closeRestart()
+	}
+}
+
+// dropAllSessions disconnect the detached sessions, they can not be resumed on this server any more
+func (s *Server) dropAllSessions(serverId string) {
+	s.sessLock.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*Channel)
+	s.sessLock.Unlock()
+	for _, ch := range sessions {
+		ch.sessTimer.Stop()
+		s.disconnect(ch, serverId)
+	}
+}
+
+func (s *Server) channelCount() (n int) {
+	for _, b := range s.Buckets {
+		n += b.ChannelCount()
+	}
+	return
+}
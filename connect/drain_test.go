@@ -0,0 +1,49 @@
+package connect
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestDrainPushReconnectHint(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	s := NewServer([]*Bucket{b}, nil, ServerOptions{WriteWait: 100 * time.Millisecond})
+	var chs []*Channel
+	for i := 1; i <= 5; i++ {
+		ch := NewChannel(4, DropNewest, 0)
+		if _, err := b.Put(i, fmt.Sprintf("device%d", i), 0, ch); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		chs = append(chs, ch)
+	}
+	if n := s.channelCount(); n != 5 {
+		t.Fatalf("channelCount = %d, want 5", n)
+	}
+
+	// no writer closes the conns here, so drain waits until the deadline
+	timeout := 200 * time.Millisecond
+	start := time.Now()
+	s.drain("test", 2, start.Add(timeout))
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("drain returned after %s with channels left, want it to wait %s", elapsed, timeout)
+	}
+	for i, ch := range chs {
+		select {
+		case msg := <-ch.control:
+			var hint proto.ReconnectHint
+			if msg.Operation != config.OpReconnect || json.Unmarshal(msg.Body, &hint) != nil {
+				t.Fatalf("channel %d got op %d, want a reconnect hint", i, msg.Operation)
+			}
+			if hint.Delay < 0 || hint.Delay > int(timeout/time.Millisecond) {
+				t.Errorf("hint delay %d out of the drain timeout", hint.Delay)
+			}
+		default:
+			t.Errorf("channel %d got no reconnect hint", i)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package connect
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/pkg/metrics"
+	"gochat/proto"
+)
+
+// tcp heartbeat: the server sends OpPing every HeartbeatInterval and the client answers OpPong
+// with the same seq, the pong measure the rtt of the conn. once a client sent a ping or pong,
+// any inbound frame refresh the read deadline, so it is closed by its read loop if it sends
+// nothing for HeartbeatMisses intervals. legacy clients that never answer are not timed out
+
+// heartbeatTimeout is the read deadline of a tcp conn, 0 if there is none
+func (s *Server) heartbeatTimeout(ch *Channel) time.Duration {
+	if s.Options.HeartbeatInterval <= 0 || s.Options.HeartbeatMisses <= 0 || atomic.LoadInt32(&ch.heartbeats) == 0 {
+		return 0
+	}
+	return s.Options.HeartbeatInterval * time.Duration(s.Options.HeartbeatMisses)
+}
+
+// heartbeatMsg build a OpPing or OpPong msg
+func heartbeatMsg(op int, seq string) *proto.Msg {
+	body, _ := json.Marshal(proto.Heartbeat{Op: op, SeqId: seq})
+	return &proto.Msg{Ver: config.MsgVersion, Operation: op, SeqId: seq, Body: body}
+}
+
+// nextPing build the next server ping of the channel and remember when it was sent
+func (ch *Channel) nextPing(now time.Time) *proto.Msg {
+	seq := atomic.AddUint64(&ch.pingSeq, 1)
+	atomic.StoreInt64(&ch.pingSentAt, now.UnixNano())
+	return heartbeatMsg(config.OpPing, strconv.FormatUint(seq, 10))
+}
+
+// pong take the rtt from a pong of the last ping, a late pong of an older ping is ignored
+func (ch *Channel) pong(seq string, now time.Time) (rtt time.Duration, ok bool) {
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n != atomic.LoadUint64(&ch.pingSeq) {
+		return 0, false
+	}
+	sentAt := atomic.SwapInt64(&ch.pingSentAt, 0)
+	if sentAt == 0 {
+		return 0, false
+	}
+	rtt = now.Sub(time.Unix(0, sentAt))
+	atomic.StoreInt64(&ch.rtt, int64(rtt))
+	return rtt, true
+}
+
+// RTT is the last measured round trip of the conn, 0 if none was measured yet
+func (ch *Channel) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&ch.rtt))
+}
+
+// tcpHeartbeat handle a OpPing or OpPong frame of the client
+func (s *Server) tcpHeartbeat(ch *Channel, op int, seq string) {
+	atomic.StoreInt32(&ch.heartbeats, 1)
+	if op == config.OpPing {
+		if err := ch.Push(heartbeatMsg(config.OpPong, seq)); err != nil {
+			logrus.Debugf("push pong userId=%d err:%s", ch.userId, err.Error())
+		}
+		return
+	}
+	if rtt, ok := ch.pong(seq, time.Now()); ok {
+		metrics.ConnectionRTT.WithLabelValues("tcp").Observe(rtt.Seconds())
+	}
+}
+
+// isTimeout is true if the read loop stopped on its deadline
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
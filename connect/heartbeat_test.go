@@ -0,0 +1,86 @@
+package connect
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/pkg/stickpackage"
+	"gochat/proto"
+)
+
+func TestPingPongRTT(t *testing.T) {
+	ch := NewChannel(4, DropNewest, 0)
+	now := time.Now()
+	first := ch.nextPing(now)
+	second := ch.nextPing(now)
+	if first.Operation != config.OpPing || first.SeqId == second.SeqId {
+		t.Fatalf("pings %+v %+v", first, second)
+	}
+	if _, ok := ch.pong(first.SeqId, now.Add(time.Millisecond)); ok {
+		t.Error("pong of an older ping should be ignored")
+	}
+	rtt, ok := ch.pong(second.SeqId, now.Add(30*time.Millisecond))
+	if !ok || rtt != 30*time.Millisecond || ch.RTT() != rtt {
+		t.Errorf("rtt %s ok=%v, want 30ms", rtt, ok)
+	}
+	if _, ok := ch.pong(second.SeqId, now.Add(time.Second)); ok {
+		t.Error("a second pong of the same ping should be ignored")
+	}
+}
+
+func TestTcpHeartbeatAnswerPing(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{})
+	ch := NewChannel(4, DropNewest, 0)
+	s.tcpHeartbeat(ch, config.OpPing, "9")
+	select {
+	case msg := <-ch.control:
+		if msg.Operation != config.OpPong || msg.SeqId != "9" {
+			t.Errorf("got op %d seq %s, want pong 9", msg.Operation, msg.SeqId)
+		}
+	default:
+		t.Error("client ping got no pong")
+	}
+}
+
+func TestTcpMissedHeartbeatsClose(t *testing.T) {
+	if config.Conf == nil {
+		config.Conf = new(config.Config)
+	}
+	s := NewServer(nil, nil, ServerOptions{HeartbeatInterval: 10 * time.Millisecond, HeartbeatMisses: 2})
+	server, client := net.Pipe()
+	defer client.Close()
+	ch := NewChannel(4, DropNewest, 0)
+	ch.connTcp = server
+	go new(Connect).readDataFromTcp(s, ch)
+	// a pong opts the conn in, then it goes silent
+	body, _ := json.Marshal(proto.Heartbeat{Op: config.OpPong, SeqId: "1"})
+	if err := stickpackage.WriteFrame(client, &stickpackage.Frame{Version: stickpackage.Version2, Op: config.OpPong, Body: body}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch.done:
+	case <-time.After(time.Second):
+		t.Fatal("silent conn was not closed")
+	}
+}
+
+func TestTcpLegacyNoHeartbeatTimeout(t *testing.T) {
+	if config.Conf == nil {
+		config.Conf = new(config.Config)
+	}
+	s := NewServer(nil, nil, ServerOptions{HeartbeatInterval: 10 * time.Millisecond, HeartbeatMisses: 2})
+	server, client := net.Pipe()
+	defer client.Close()
+	ch := NewChannel(4, DropNewest, 0)
+	ch.connTcp = server
+	go new(Connect).readDataFromTcp(s, ch)
+	// a client that never sent a heartbeat is not timed out
+	select {
+	case <-ch.done:
+		t.Fatal("legacy conn closed by the heartbeat timeout")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,96 @@
+package connect
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gochat/proto"
+)
+
+// introspect is a read only view of what the server holds, to debug users who are online but
+// get nothing: are they in a bucket, in which rooms, and is their queue stuck
+func (s *Server) introspect(req *proto.IntrospectRequest) (reply *proto.IntrospectReply) {
+	reply = new(proto.IntrospectReply)
+	online := make(map[int]int)
+	for i, b := range s.Buckets {
+		stats := b.Stats()
+		stats.Index = i
+		reply.Buckets = append(reply.Buckets, stats)
+		if req.Rooms {
+			b.RoomsOnline(online)
+		}
+	}
+	for roomId, n := range online {
+		reply.Rooms = append(reply.Rooms, proto.RoomStats{RoomId: roomId, Online: n})
+	}
+	sort.Slice(reply.Rooms, func(i, j int) bool { return reply.Rooms[i].RoomId < reply.Rooms[j].RoomId })
+	if req.UserId > 0 {
+		now := time.Now()
+		for _, ch := range s.Bucket(req.UserId).Channels(req.UserId) {
+			reply.Conns = append(reply.Conns, s.connInfo(ch, now))
+		}
+	}
+	return
+}
+
+func (s *Server) connInfo(ch *Channel, now time.Time) proto.ConnInfo {
+	info := proto.ConnInfo{
+		DeviceId:    ch.deviceId,
+		Transport:   ch.transport(),
+		ConnectedAt: ch.createdAt,
+		Age:         now.Sub(ch.createdAt).Truncate(time.Second).String(),
+		QueueDepth:  len(ch.broadcast),
+		QueueCap:    cap(ch.broadcast),
+		Priority:    ch.priorityQueued(),
+		Unacked:     ch.acks.len(),
+		Rooms:       ch.RoomIds(),
+		Detached:    ch.replay.isDetached(),
+	}
+	if rtt := ch.RTT(); rtt > 0 {
+		info.RTT = rtt.String()
+	}
+	sort.Ints(info.Rooms)
+	return info
+}
+
+// introspectAuth let only the requests with the bearer token through, all if token is empty
+func introspectAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// introspectHandler serve the introspection as json on the metrics server,
+// GET /debug/connect?userId=1&rooms=1
+func (c *Connect) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	if DefaultServer == nil {
+		http.Error(w, "server not started", http.StatusServiceUnavailable)
+		return
+	}
+	req := &proto.IntrospectRequest{Rooms: r.URL.Query().Get("rooms") != ""}
+	if userId := r.URL.Query().Get("userId"); userId != "" {
+		var err error
+		if req.UserId, err = strconv.Atoi(userId); err != nil {
+			http.Error(w, "bad userId", http.StatusBadRequest)
+			return
+		}
+	}
+	reply := DefaultServer.introspect(req)
+	reply.ServerId = c.ServerId
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(reply)
+}
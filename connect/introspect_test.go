@@ -0,0 +1,81 @@
+package connect
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gochat/proto"
+)
+
+func TestIntrospect(t *testing.T) {
+	b1 := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 2, RoutineSize: 1})
+	b2 := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 2, RoutineSize: 1})
+	s := NewServer([]*Bucket{b1, b2}, nil, ServerOptions{})
+	// users 1 and 2 in room 7, user 1 on two devices
+	for _, c := range []struct {
+		userId   int
+		deviceId string
+	}{{1, "a"}, {1, "b"}, {2, "a"}} {
+		ch := NewChannel(4, DropNewest, 0)
+		ch.deviceId = c.deviceId
+		s.Bucket(c.userId).Put(c.userId, c.deviceId, 7, ch)
+	}
+	s.Bucket(1).Channels(1)[0].Push(&proto.Msg{Body: []byte("queued")})
+
+	reply := s.introspect(&proto.IntrospectRequest{UserId: 1, Rooms: true})
+	if len(reply.Buckets) != 2 || len(reply.Buckets[0].RoutineQueues) != 2 {
+		t.Fatalf("bucket stats %+v", reply.Buckets)
+	}
+	channels := reply.Buckets[0].Channels + reply.Buckets[1].Channels
+	users := reply.Buckets[0].Users + reply.Buckets[1].Users
+	if channels != 3 || users != 2 {
+		t.Errorf("%d channels of %d users, want 3 of 2", channels, users)
+	}
+	if len(reply.Rooms) != 1 || reply.Rooms[0].RoomId != 7 || reply.Rooms[0].Online != 3 {
+		t.Errorf("rooms %+v, want room 7 with 3 conns", reply.Rooms)
+	}
+	if len(reply.Conns) != 2 {
+		t.Fatalf("conns of user 1 %+v", reply.Conns)
+	}
+	depth := reply.Conns[0].QueueDepth + reply.Conns[1].QueueDepth
+	if depth != 1 || reply.Conns[0].QueueCap != 4 || reply.Conns[0].Rooms[0] != 7 {
+		t.Errorf("conn info %+v", reply.Conns)
+	}
+	if reply := s.introspect(&proto.IntrospectRequest{UserId: 3}); len(reply.Conns) != 0 || len(reply.Rooms) != 0 {
+		t.Error("unknown user should have no conns, rooms are only listed on request")
+	}
+}
+
+func TestIntrospectHandler(t *testing.T) {
+	old := DefaultServer
+	defer func() { DefaultServer = old }()
+	DefaultServer = NewServer([]*Bucket{NewBucket(BucketOptions{RoutineAmount: 1, RoutineSize: 1})}, nil, ServerOptions{})
+	c := &Connect{ServerId: "ws-test"}
+
+	w := httptest.NewRecorder()
+	c.introspectHandler(w, httptest.NewRequest(http.MethodGet, "/debug/connect?userId=1&rooms=1", nil))
+	var reply proto.IntrospectReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply.ServerId != "ws-test" || len(reply.Buckets) != 1 {
+		t.Errorf("reply %s err %v", w.Body.String(), err)
+	}
+	w = httptest.NewRecorder()
+	c.introspectHandler(w, httptest.NewRequest(http.MethodGet, "/debug/connect?userId=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad userId got %d", w.Code)
+	}
+
+	h := introspectAuth("secret", http.HandlerFunc(c.introspectHandler))
+	for auth, want := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer secret": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodGet, "/debug/connect", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("authorization %q got %d, want %d", auth, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package connect
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+)
+
+// kick remove the conns of a user on this server from a room, return how many were in it.
+// a conn in other rooms too only leaves the room, one with no other room is closed after it
+// got the notice, and a detached session in the room is dropped so it can not be resumed
+func (s *Server) kick(req *proto.KickRequest, serverId string) (n int) {
+	for _, ch := range s.Bucket(req.UserId).Channels(req.UserId) {
+		if !ch.InRoom(req.RoomId) {
+			continue
+		}
+		n++
+		if s.dropSession(ch, serverId) {
+			continue
+		}
+		if len(ch.RoomIds()) > 1 {
+			if err := s.leaveRoom(ch, req.RoomId); err != nil {
+				logrus.Warnf("kick userId=%d leave roomId=%d err:%s", req.UserId, req.RoomId, err.Error())
+			}
+			_ = ch.push(&req.Msg, "")
+			continue
+		}
+		// the writer closes the conn once the notice is written
+		atomic.StoreInt32(&ch.kickClose, 1)
+		if err := ch.push(&req.Msg, ""); err != nil {
+			ch.closeKicked()
+		}
+	}
+	return
+}
+
+// closeAfterWrite is true if the msg just written must be the last one of the conn
+func (ch *Channel) closeAfterWrite(msg *proto.Msg) bool {
+	switch msg.Operation {
+	case config.OpReconnect:
+		// the hint is the last msg of a draining server
+		ch.closeRestart()
+		return true
+	case config.OpKick:
+		if atomic.LoadInt32(&ch.kickClose) == 1 {
+			ch.closeKicked()
+			return true
+		}
+	case config.OpReply:
+		// the reason of a refused connect
+		if atomic.LoadInt32(&ch.refused) == 1 {
+			ch.closeRefused()
+			return true
+		}
+	}
+	return false
+}
+
+// closeRefused close a conn refused by admission control once it was told why, no resume
+func (ch *Channel) closeRefused() {
+	ch.closeConn(websocket.ClosePolicyViolation, errMaxConnsPerUser.Error())
+}
+
+// closeKicked close the conn of a user kicked from its only room, no resume
+func (ch *Channel) closeKicked() {
+	ch.closeConn(websocket.ClosePolicyViolation, "kicked from room")
+}
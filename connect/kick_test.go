@@ -0,0 +1,56 @@
+package connect
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+// kickOperator accept the room leaves of kicked conns
+type kickOperator struct {
+	Operator
+	left []int
+}
+
+func (o *kickOperator) LeaveRoom(req *proto.RoomMemberRequest) error {
+	o.left = append(o.left, req.RoomId)
+	return nil
+}
+
+func TestKick(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &kickOperator{}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{})
+	only, multi, other := NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0)
+	b.Put(1, "a", 7, only)
+	b.Put(1, "b", 7, multi)
+	b.JoinRoom(8, multi)
+	b.Put(1, "c", 9, other)
+
+	req := &proto.KickRequest{RoomId: 7, UserId: 1, Msg: proto.Msg{Operation: config.OpKick}}
+	if n := s.kick(req, "srv"); n != 2 {
+		t.Fatalf("kicked %d conns, want 2", n)
+	}
+	// the conn in room 7 only gets the notice, then is closed
+	if len(only.control) != 1 || atomic.LoadInt32(&only.kickClose) != 1 {
+		t.Error("conn with no other room should be closed after the notice")
+	}
+	if !only.closeAfterWrite(<-only.control) || atomic.LoadInt32(&only.closedByServer) != 1 {
+		t.Error("writer should close the conn after the notice")
+	}
+	// the conn in room 8 too only leaves room 7
+	if multi.InRoom(7) || !multi.InRoom(8) || atomic.LoadInt32(&multi.kickClose) != 0 {
+		t.Error("conn in other rooms should only leave the room")
+	}
+	if len(o.left) != 1 || o.left[0] != 7 {
+		t.Errorf("logic leaves %v, want [7]", o.left)
+	}
+	if msg := <-multi.control; multi.closeAfterWrite(msg) {
+		t.Error("conn in other rooms should stay open")
+	}
+	if other.dequeue() != nil || !other.InRoom(9) {
+		t.Error("conn not in the room should not be touched")
+	}
+}
@@ -0,0 +1,145 @@
+package connect
+
+import (
+	"sync"
+
+	"gochat/config"
+	"gochat/pkg/metrics"
+	"gochat/proto"
+)
+
+// every channel queues its msgs in three lanes, the writer always drains them in order:
+// control ops like kick, reconnect hints and replies, then system snapshots like room count
+// and info, then chat. a burst of chat never delays nor drops a msg of a higher lane
+
+type lane int
+
+const (
+	laneControl lane = iota // never dropped, a conn whose control lane is full is closed
+	laneSystem              // room snapshots, a newer one replaces the queued one
+	laneChat                // the slow consumer policy applies
+)
+
+func msgLane(op int) lane {
+	switch op {
+	case config.OpReply, config.OpSession, config.OpReconnect, config.OpRateLimit,
+		config.OpPing, config.OpPong, config.OpKick:
+		return laneControl
+	case config.OpRoomCountSend, config.OpRoomInfoSend:
+		return laneSystem
+	default:
+		return laneChat
+	}
+}
+
+// snapshotLane queue room snapshots, at most one per op and room. only the latest state of
+// a room matters, so a newer snapshot takes the place of the queued one
+type snapshotLane struct {
+	lock sync.Mutex
+	msgs []snapshot // oldest first
+}
+
+type snapshot struct {
+	room string
+	msg  *proto.Msg
+}
+
+func (l *snapshotLane) put(room string, msg *proto.Msg) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.msgs {
+		if l.msgs[i].room == room && l.msgs[i].msg.Operation == msg.Operation {
+			l.msgs[i].msg = msg
+			metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "coalesced").Inc()
+			return
+		}
+	}
+	l.msgs = append(l.msgs, snapshot{room: room, msg: msg})
+}
+
+func (l *snapshotLane) take() (msg *proto.Msg) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.msgs) == 0 {
+		return nil
+	}
+	msg = l.msgs[0].msg
+	l.msgs[0] = snapshot{}
+	l.msgs = l.msgs[1:]
+	return
+}
+
+func (l *snapshotLane) len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.msgs)
+}
+
+// pushControl queue a control msg, it is not dropped for a full lane: a client that let
+// cap control msgs pile up does not read at all, its conn is closed as a slow consumer
+func (ch *Channel) pushControl(msg *proto.Msg, room string) error {
+	select {
+	case ch.control <- msg:
+		ch.wakeWriter()
+		return nil
+	default:
+	}
+	metrics.ChannelDroppedMessagesTotal.WithLabelValues(room, "control_full").Inc()
+	ch.closeSlowConsumer()
+	return ErrSlowConsumer
+}
+
+// wakeWriter tell the writer a msg was queued, it never blocks: a pending wake up
+// already makes the writer drain every lane
+func (ch *Channel) wakeWriter() {
+	select {
+	case ch.wake <- struct{}{}:
+	default:
+	}
+	if ch.notify != nil {
+		ch.notify()
+	}
+}
+
+// dequeue take the next msg to write without waiting, nil if every lane is empty
+func (ch *Channel) dequeue() *proto.Msg {
+	select {
+	case msg := <-ch.control:
+		return msg
+	default:
+	}
+	if msg := ch.system.take(); msg != nil {
+		return msg
+	}
+	select {
+	case msg := <-ch.broadcast:
+		return msg
+	default:
+	}
+	return nil
+}
+
+// priorityQueued is the number of msgs of the higher lanes waiting to be written
+func (ch *Channel) priorityQueued() int {
+	return len(ch.control) + ch.system.len()
+}
+
+// writeQueued write the queued msgs in lane order, at most a batch so a busy conn still
+// gets its pings and redeliveries, the writer is woken again for the rest.
+// return false if the conn must be closed
+func (ch *Channel) writeQueued(write func(msg *proto.Msg) error) bool {
+	for i := cap(ch.control) + cap(ch.broadcast); i > 0; i-- {
+		msg := ch.dequeue()
+		if msg == nil {
+			return true
+		}
+		if err := write(msg); err != nil {
+			return false
+		}
+		if ch.closeAfterWrite(msg) {
+			return false
+		}
+	}
+	ch.wakeWriter()
+	return true
+}
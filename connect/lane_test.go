@@ -0,0 +1,72 @@
+package connect
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestLaneOrder(t *testing.T) {
+	ch := NewChannel(2, DropNewest, 0)
+	for _, seq := range []string{"c1", "c2", "c3"} {
+		ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomSend, SeqId: seq})
+	}
+	ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomCountSend, SeqId: "count1"})
+	ch.PushRoom(8, &proto.Msg{Operation: config.OpRoomCountSend, SeqId: "count8"})
+	ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomCountSend, SeqId: "count2"})
+	if err := ch.Push(&proto.Msg{Operation: config.OpKick, SeqId: "kick"}); err != nil {
+		t.Fatalf("kick dropped for a full chat lane: %s", err)
+	}
+
+	var seqs []string
+	for msg := ch.dequeue(); msg != nil; msg = ch.dequeue() {
+		seqs = append(seqs, msg.SeqId)
+	}
+	want := []string{"kick", "count2", "count8", "c1", "c2"}
+	if len(seqs) != len(want) {
+		t.Fatalf("dequeued %v, want %v", seqs, want)
+	}
+	for i := range want {
+		if seqs[i] != want[i] {
+			t.Fatalf("dequeued %v, want %v", seqs, want)
+		}
+	}
+	select {
+	case <-ch.wake:
+	default:
+		t.Error("writer not woken")
+	}
+}
+
+func TestControlLaneFull(t *testing.T) {
+	ch := NewChannel(1, DropNewest, 0)
+	ch.Push(&proto.Msg{Operation: config.OpReply})
+	if err := ch.Push(&proto.Msg{Operation: config.OpReply}); err != ErrSlowConsumer {
+		t.Fatalf("got %v, want ErrSlowConsumer", err)
+	}
+	if atomic.LoadInt32(&ch.closedByServer) != 1 {
+		t.Error("conn with a full control lane should be closed")
+	}
+}
+
+func TestWriteQueuedBatch(t *testing.T) {
+	ch := NewChannel(1, DropNewest, 0)
+	ch.Push(&proto.Msg{Operation: config.OpReply})
+	ch.Push(&proto.Msg{Operation: config.OpRoomSend})
+	ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomInfoSend})
+	<-ch.wake
+	written := 0
+	if !ch.writeQueued(func(*proto.Msg) error { written++; return nil }) || written != 2 {
+		t.Fatalf("wrote %d msgs, want a batch of 2", written)
+	}
+	select {
+	case <-ch.wake:
+	default:
+		t.Fatal("writer not woken for the rest")
+	}
+	if !ch.writeQueued(func(*proto.Msg) error { written++; return nil }) || written != 3 {
+		t.Errorf("wrote %d msgs in total, want 3", written)
+	}
+}
@@ -0,0 +1,331 @@
+//go:build linux
+
+package connect
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gochat/pkg/metrics"
+	"gochat/pkg/stickpackage"
+	"golang.org/x/sys/unix"
+)
+
+// netpoll serve tcp conns from epoll event loops instead of a reader and a writer goroutine
+// per conn. a loop reads the conns that have data into a buffer it shares between them, only
+// a partial frame is kept per conn. the frames are handled, and the queued msgs written, by
+// goroutines started when there is work and gone when it is done, so an idle conn has none.
+// pings, redelivery and missed heartbeats are checked by one sweeper per loop
+
+// sweepInterval is how often a loop checks the heartbeats of its conns
+const sweepInterval = time.Second
+
+type netpoll struct {
+	c          *Connect
+	s          *Server
+	maxFrame   int
+	pingPeriod time.Duration
+	loops      []*pollLoop
+	next       uint32
+}
+
+// pollLoop is one epoll instance and the conns registered with it
+type pollLoop struct {
+	np    *netpoll
+	epfd  int
+	lock  sync.Mutex
+	conns map[int]*pollConn // by fd
+	buf   []byte            // read buffer shared by the conns of the loop
+}
+
+// pollConn is the net.Conn of a netpoll channel, closing it unregisters it from its loop
+type pollConn struct {
+	*net.TCPConn
+	loop          *pollLoop
+	raw           syscall.RawConn
+	fd            int
+	ch            *Channel
+	in            []byte // a partial frame, only used by the loop
+	lastRead      int64  // unix nano of the last read
+	lastPing      int64  // unix nano, only used by the sweeper
+	lastRedeliver int64  // unix nano, only used by the sweeper
+	closeOnce     sync.Once
+	// frames read and not handled yet, handled in order by one goroutine at a time
+	lock     sync.Mutex
+	frames   []*stickpackage.Frame
+	handling bool
+	closing  bool // no more frames, close the channel after the last one
+	stopped  bool // a frame asked to close the conn, drop the rest
+	writing  int32
+}
+
+// newNetpoll start loops event loops, each with its sweeper
+func newNetpoll(c *Connect, s *Server, loops int, maxFrame int) (*netpoll, error) {
+	np := &netpoll{c: c, s: s, maxFrame: maxFrame, pingPeriod: s.Options.HeartbeatInterval}
+	if np.pingPeriod <= 0 {
+		np.pingPeriod = s.Options.PingPeriod
+	}
+	if loops <= 0 {
+		loops = 1
+	}
+	for i := 0; i < loops; i++ {
+		epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		l := &pollLoop{np: np, epfd: epfd, conns: make(map[int]*pollConn), buf: make([]byte, 64<<10)}
+		np.loops = append(np.loops, l)
+		go l.run()
+		go l.sweep()
+	}
+	return np, nil
+}
+
+// serve register an admitted conn with a loop, the conn is closed and released on error
+func (np *netpoll) serve(conn *net.TCPConn) error {
+	ip := addrIp(conn.RemoteAddr().String())
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		_ = conn.Close()
+		np.s.release("tcp", ip)
+		return err
+	}
+	l := np.loops[atomic.AddUint32(&np.next, 1)%uint32(len(np.loops))]
+	now := time.Now().UnixNano()
+	pc := &pollConn{TCPConn: conn, loop: l, raw: raw, lastRead: now, lastPing: now, lastRedeliver: now}
+	_ = raw.Control(func(fd uintptr) {
+		pc.fd = int(fd)
+	})
+	s := np.s
+	ch := NewChannel(s.Options.BroadcastSize, s.Options.SlowConsumerPolicy, s.Options.BlockTimeout)
+	ch.acks = newAckWindow(s.Options.AckWindow, s.Options.AckTimeout, s.Options.AckMaxRetries)
+	ch.replay = newReplayBuffer(s.Options.ResumeBuffer)
+	ch.connTcp = pc
+	ch.notify = pc.flush
+	ch.admitted(ip)
+	pc.ch = ch
+
+	l.lock.Lock()
+	l.conns[pc.fd] = pc
+	l.lock.Unlock()
+	event := &unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP, Fd: int32(pc.fd)}
+	if err = unix.EpollCtl(l.epfd, unix.EPOLL_CTL_ADD, pc.fd, event); err != nil {
+		_ = pc.Close()
+		return err
+	}
+	return nil
+}
+
+func (l *pollLoop) run() {
+	events := make([]unix.EpollEvent, 256)
+	for {
+		n, err := unix.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			logrus.Errorf("netpoll epoll wait err:%s", err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			l.lock.Lock()
+			pc := l.conns[int(events[i].Fd)]
+			l.lock.Unlock()
+			if pc != nil {
+				pc.read()
+			}
+		}
+	}
+}
+
+// remove unregister the conn, before its fd is closed and can be reused by a new conn
+func (l *pollLoop) remove(pc *pollConn) {
+	l.lock.Lock()
+	if l.conns[pc.fd] == pc {
+		delete(l.conns, pc.fd)
+	}
+	l.lock.Unlock()
+	_ = unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, pc.fd, nil)
+}
+
+// read what the conn has without blocking the loop, queue the whole frames and keep the rest
+func (pc *pollConn) read() {
+	buf := pc.loop.buf
+	var n int
+	var readErr error
+	if err := pc.raw.Read(func(fd uintptr) bool {
+		n, readErr = unix.Read(int(fd), buf)
+		return true // never wait in the runtime poller
+	}); err != nil {
+		_ = pc.Close()
+		return
+	}
+	if readErr == unix.EAGAIN || readErr == unix.EINTR {
+		return
+	}
+	if readErr != nil || n <= 0 {
+		// closed by the client, or reset
+		_ = pc.Close()
+		return
+	}
+	atomic.StoreInt64(&pc.lastRead, time.Now().UnixNano())
+	data := buf[:n]
+	if pc.in != nil {
+		data = append(pc.in, data...)
+	}
+	var frames []*stickpackage.Frame
+	for len(data) > 0 {
+		f, size, err := stickpackage.Parse(data, pc.loop.np.maxFrame)
+		if err != nil {
+			// a malformed frame can not be skipped, the stream is lost
+			logrus.Warnf("tcp read frame err:%s", err.Error())
+			pc.queue(frames)
+			_ = pc.Close()
+			return
+		}
+		if size == 0 {
+			break
+		}
+		// the buffer is reused by the next read
+		f.Body = append([]byte(nil), f.Body...)
+		frames = append(frames, f)
+		data = data[size:]
+	}
+	pc.in = nil
+	if len(data) > 0 {
+		pc.in = append(make([]byte, 0, len(data)), data...)
+	}
+	pc.queue(frames)
+}
+
+// queue frames for the handler, it is started if it is not running
+func (pc *pollConn) queue(frames []*stickpackage.Frame) {
+	pc.lock.Lock()
+	pc.frames = append(pc.frames, frames...)
+	start := !pc.handling && (len(pc.frames) > 0 || pc.closing)
+	pc.handling = pc.handling || start
+	pc.lock.Unlock()
+	if start {
+		go pc.handle()
+	}
+}
+
+// handle the queued frames in order like the read loop of a tcp conn, once the conn is
+// closed and its last frame handled, close the channel
+func (pc *pollConn) handle() {
+	np := pc.loop.np
+	for {
+		pc.lock.Lock()
+		frames := pc.frames
+		pc.frames = nil
+		if len(frames) == 0 {
+			closing := pc.closing
+			// a closing conn keeps handling set, nothing is handled after it
+			pc.handling = closing
+			pc.lock.Unlock()
+			if closing {
+				np.c.closeTcp(np.s, pc.ch)
+			}
+			return
+		}
+		pc.lock.Unlock()
+		for _, f := range frames {
+			if pc.stopped {
+				break
+			}
+			if !np.c.handleTcpFrame(np.s, pc.ch, f) {
+				pc.stopped = true
+				_ = pc.Close()
+			}
+		}
+	}
+}
+
+// Close unregister the conn and close it, once. its channel is closed by the handler after
+// the frames read before
+func (pc *pollConn) Close() (err error) {
+	pc.closeOnce.Do(func() {
+		pc.loop.remove(pc)
+		err = pc.TCPConn.Close()
+		pc.lock.Lock()
+		pc.closing = true
+		pc.lock.Unlock()
+		pc.queue(nil)
+	})
+	return
+}
+
+// flush start a writer for the msgs queued on the channel, if none is running
+func (pc *pollConn) flush() {
+	if atomic.CompareAndSwapInt32(&pc.writing, 0, 1) {
+		go pc.write()
+	}
+}
+
+func (pc *pollConn) write() {
+	s := pc.loop.np.s
+	ch := pc.ch
+	for {
+		select {
+		case <-ch.wake:
+		default:
+		}
+		_ = pc.SetWriteDeadline(time.Now().Add(s.Options.WriteWait))
+		if !s.writeTcpQueued(ch) {
+			// writing stays set, nothing is written after the close
+			_ = pc.Close()
+			return
+		}
+		atomic.StoreInt32(&pc.writing, 0)
+		// a msg queued before writing was reset did not start a writer
+		if ch.priorityQueued()+len(ch.broadcast) == 0 || !atomic.CompareAndSwapInt32(&pc.writing, 0, 1) {
+			return
+		}
+	}
+}
+
+// sweep ping the conns of the loop, redeliver their unacked msgs and close the ones which
+// missed their heartbeats
+func (l *pollLoop) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	var conns []*pollConn
+	for now := range ticker.C {
+		l.lock.Lock()
+		conns = conns[:0]
+		for _, pc := range l.conns {
+			conns = append(conns, pc)
+		}
+		l.lock.Unlock()
+		for _, pc := range conns {
+			pc.sweep(now)
+		}
+	}
+}
+
+func (pc *pollConn) sweep(now time.Time) {
+	np := pc.loop.np
+	s, ch := np.s, pc.ch
+	if timeout := s.heartbeatTimeout(ch); timeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&pc.lastRead))) > timeout {
+		logrus.Infof("tcp conn userId=%d missed %d heartbeats, close", ch.userId, s.Options.HeartbeatMisses)
+		metrics.HeartbeatTimeoutsTotal.WithLabelValues("tcp").Inc()
+		_ = pc.Close()
+		return
+	}
+	if now.Sub(time.Unix(0, pc.lastPing)) >= np.pingPeriod {
+		pc.lastPing = now.UnixNano()
+		// a ping is never kept for replay
+		if err := ch.pushControl(ch.nextPing(now), "none"); err != nil {
+			return
+		}
+	}
+	if ch.acks.len() > 0 && now.Sub(time.Unix(0, pc.lastRedeliver)) >= s.Options.AckTimeout/2 {
+		pc.lastRedeliver = now.UnixNano()
+		// saving a msg given up calls logic, not on the sweeper
+		go s.redeliver(ch)
+	}
+}
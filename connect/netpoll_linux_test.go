@@ -0,0 +1,190 @@
+package connect
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/pkg/stickpackage"
+	"gochat/proto"
+)
+
+// tcpListen serve the conns of a loopback listener with netpoll, or a goroutine per conn if np is nil
+func tcpListen(t testing.TB, c *Connect, s *Server, np *netpoll) string {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			if np != nil {
+				np.serve(conn)
+			} else {
+				c.ServeTcp(s, conn, 0)
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func connectFrame(token string) []byte {
+	body := fmt.Sprintf(`{"authToken":%q,"roomId":7}`, token)
+	data, _ := stickpackage.AppendFrame(nil, &stickpackage.Frame{Version: stickpackage.Version2, Op: config.OpBuildTcpConn, Body: []byte(body)})
+	return data
+}
+
+func TestNetpoll(t *testing.T) {
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})}, o, ServerOptions{
+		WriteWait:     time.Second,
+		PingPeriod:    time.Minute,
+		BroadcastSize: 8,
+	})
+	c := &Connect{ServerId: "tcp-test"}
+	np, err := newNetpoll(c, s, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", tcpListen(t, c, s, np))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(connectFrame("good")); err != nil {
+		t.Fatal(err)
+	}
+	ch := waitChannel(t, s)
+	if !ch.InRoom(7) {
+		t.Error("conn should be in room 7")
+	}
+
+	d := stickpackage.NewDecoder(client, 0)
+	ch.Push(&proto.Msg{Ver: 1, Operation: config.OpSingleSend, SeqId: "42", Body: []byte(`{"msg":"hi"}`)})
+	if f, err := d.Decode(); err != nil || f.Op != config.OpSingleSend || f.Seq != 42 || string(f.Body) != `{"msg":"hi"}` {
+		t.Fatalf("pushed frame %+v err %v", f, err)
+	}
+
+	// a ping written in two parts is answered once it is whole
+	ping, _ := stickpackage.AppendFrame(nil, &stickpackage.Frame{Version: stickpackage.Version2, Op: config.OpPing, Seq: 9, Body: []byte(`{}`)})
+	client.Write(ping[:10])
+	time.Sleep(20 * time.Millisecond)
+	client.Write(ping[10:])
+	if f, err := d.Decode(); err != nil || f.Op != config.OpPong || f.Seq != 9 {
+		t.Fatalf("pong frame %+v err %v", f, err)
+	}
+
+	client.Close()
+	waitDisconnect(t, o)
+	if n := s.channelCount(); n != 0 {
+		t.Errorf("%d channels left after the client closed", n)
+	}
+}
+
+// benchOperator connect the token n as user n
+type benchOperator struct {
+	Operator
+}
+
+func (benchOperator) Connect(connReq *proto.ConnectRequest) (int, string, error) {
+	userId, err := strconv.Atoi(connReq.AuthToken)
+	return userId, connReq.AuthToken, err
+}
+
+func (benchOperator) GetOfflineMsg(req *proto.OfflineMsgRequest) (*proto.OfflineMsgReply, error) {
+	return &proto.OfflineMsgReply{}, nil
+}
+
+func (benchOperator) DisConnect(req *proto.DisConnectRequest) error {
+	return nil
+}
+
+// memInUse is the heap and the goroutine stacks in use after a gc
+func memInUse() int64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapInuse + m.StackInuse)
+}
+
+// BenchmarkTcpConnMemory report the memory of idle connected tcp conns, with a goroutine per conn
+// and with netpoll. the client side of the conns is in the same process, it counts the same in both
+func BenchmarkTcpConnMemory(b *testing.B) {
+	const conns = 1000
+	if config.Conf == nil {
+		config.Conf = new(config.Config)
+	}
+	for _, mode := range []string{"goroutine", "netpoll"} {
+		b.Run(mode, func(b *testing.B) {
+			s := NewServer([]*Bucket{NewBucket(BucketOptions{ChannelSize: conns, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})}, benchOperator{}, ServerOptions{
+				WriteWait:     time.Second,
+				PingPeriod:    time.Minute,
+				BroadcastSize: 8,
+			})
+			c := &Connect{ServerId: "tcp-bench"}
+			var np *netpoll
+			if mode == "netpoll" {
+				var err error
+				if np, err = newNetpoll(c, s, 2, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+			addr := tcpListen(b, c, s, np)
+			// a first round grows the pools and buffers reused by the next ones, the memory is
+			// measured once after it, the rounds after only time connecting and closing the conns
+			closeConns(b, s, openConns(b, s, addr, conns, 0))
+			before := memInUse()
+			clients := openConns(b, s, addr, conns, conns)
+			delta := memInUse() - before
+			if delta < 0 {
+				b.Fatalf("memory in use went down by %d bytes with %d conns open", -delta, conns)
+			}
+			closeConns(b, s, clients)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				closeConns(b, s, openConns(b, s, addr, conns, (i+2)*conns))
+			}
+			b.ReportMetric(float64(delta)/conns, "B/conn")
+		})
+	}
+}
+
+// openConns connect n clients as the users from first+1, and wait until they all have a channel
+func openConns(b *testing.B, s *Server, addr string, n int, first int) []net.Conn {
+	clients := make([]net.Conn, 0, n)
+	for j := 1; j <= n; j++ {
+		client, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Write(connectFrame(strconv.Itoa(first + j)))
+		clients = append(clients, client)
+	}
+	waitChannels(b, s, n)
+	return clients
+}
+
+func closeConns(b *testing.B, s *Server, clients []net.Conn) {
+	for _, client := range clients {
+		client.Close()
+	}
+	waitChannels(b, s, 0)
+}
+
+func waitChannels(b *testing.B, s *Server, n int) {
+	for deadline := time.Now().Add(10 * time.Second); s.channelCount() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			b.Fatalf("%d channels, want %d", s.channelCount(), n)
+		}
+	}
+}
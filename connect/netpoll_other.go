@@ -0,0 +1,22 @@
+//go:build !linux
+
+package connect
+
+import (
+	"errors"
+	"net"
+)
+
+var errNetpollUnsupported = errors.New("netpoll is only supported on linux")
+
+// netpoll needs epoll, other systems keep a goroutine per conn
+type netpoll struct{}
+
+func newNetpoll(c *Connect, s *Server, loops int, maxFrame int) (*netpoll, error) {
+	return nil, errNetpollUnsupported
+}
+
+func (np *netpoll) serve(conn *net.TCPConn) error {
+	_ = conn.Close()
+	return errNetpollUnsupported
+}
@@ -0,0 +1,51 @@
+package connect
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+	"gochat/tools"
+)
+
+// pushOfflineMsg clear the user offline inbox up to ackId, then push the next batch of it to the channel.
+// msgs are only cleared after client ack, so they are pushed again if conn lost before ack
+func (s *Server) pushOfflineMsg(ch *Channel, ackId int64) {
+	if ch.userId == 0 {
+		return
+	}
+	req := &proto.OfflineMsgRequest{
+		UserId: ch.userId,
+		AckId:  ackId,
+		Limit:  config.OfflineMsgBatch,
+	}
+	reply, err := s.operator.GetOfflineMsg(req)
+	if err != nil {
+		logrus.Warnf("GetOfflineMsg userId=%d err:%s", ch.userId, err.Error())
+		return
+	}
+	if len(reply.Msgs) == 0 {
+		return
+	}
+	offlineMsg := proto.OfflineMsg{
+		Op:      config.OpOfflineMsg,
+		AckId:   reply.AckId,
+		HasMore: reply.HasMore,
+		Msgs:    make([]json.RawMessage, 0, len(reply.Msgs)),
+	}
+	for _, msg := range reply.Msgs {
+		offlineMsg.Msgs = append(offlineMsg.Msgs, msg)
+	}
+	body, err := json.Marshal(offlineMsg)
+	if err != nil {
+		logrus.Errorf("pushOfflineMsg json.Marshal err:%s", err.Error())
+		return
+	}
+	ch.Push(&proto.Msg{
+		Ver:       config.MsgVersion,
+		Operation: config.OpOfflineMsg,
+		SeqId:     tools.GetSnowflakeId(),
+		Body:      body,
+	})
+}
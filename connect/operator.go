@@ -8,17 +8,34 @@ package connect
 import "gochat/proto"
 
 type Operator interface {
-	Connect(conn *proto.ConnectRequest) (int, error)
+	Connect(conn *proto.ConnectRequest) (int, string, error)
 	DisConnect(disConn *proto.DisConnectRequest) (err error)
+	SaveOfflineMsg(req *proto.SaveOfflineMsgRequest) (err error)
+	GetOfflineMsg(req *proto.OfflineMsgRequest) (reply *proto.OfflineMsgReply, err error)
+	JoinRoom(req *proto.RoomMemberRequest) (err error)
+	LeaveRoom(req *proto.RoomMemberRequest) (err error)
+	Push(req *proto.Send) (reply *proto.PushReply, err error)
+	PushRoom(req *proto.Send) (reply *proto.SuccessReply, err error)
+	GetRoomStat(req *proto.Send) (reply *proto.RoomStatReply, err error)
+	AckMsg(req *proto.MsgAckRequest) (err error)
+	PushRoomSignal(req *proto.Send) (reply *proto.SuccessReply, err error)
+	CheckAuth(authToken string) (userId int, userName string, err error)
 }
 
 type DefaultOperator struct {
 }
 
 // rpc call logic layer
-func (o *DefaultOperator) Connect(conn *proto.ConnectRequest) (uid int, err error) {
+func (o *DefaultOperator) Connect(conn *proto.ConnectRequest) (uid int, userName string, err error) {
 	rpcConnect := new(RpcConnect)
-	uid, err = rpcConnect.Connect(conn)
+	uid, userName, err = rpcConnect.Connect(conn)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) CheckAuth(authToken string) (userId int, userName string, err error) {
+	rpcConnect := new(RpcConnect)
+	userId, userName, err = rpcConnect.CheckAuth(authToken)
 	return
 }
 
@@ -28,3 +45,66 @@ func (o *DefaultOperator) DisConnect(disConn *proto.DisConnectRequest) (err erro
 	err = rpcConnect.DisConnect(disConn)
 	return
 }
+
+// rpc call logic layer
+func (o *DefaultOperator) SaveOfflineMsg(req *proto.SaveOfflineMsgRequest) (err error) {
+	rpcConnect := new(RpcConnect)
+	err = rpcConnect.SaveOfflineMsg(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) GetOfflineMsg(req *proto.OfflineMsgRequest) (reply *proto.OfflineMsgReply, err error) {
+	rpcConnect := new(RpcConnect)
+	reply, err = rpcConnect.GetOfflineMsg(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) JoinRoom(req *proto.RoomMemberRequest) (err error) {
+	rpcConnect := new(RpcConnect)
+	err = rpcConnect.JoinRoom(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) LeaveRoom(req *proto.RoomMemberRequest) (err error) {
+	rpcConnect := new(RpcConnect)
+	err = rpcConnect.LeaveRoom(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) Push(req *proto.Send) (reply *proto.PushReply, err error) {
+	rpcConnect := new(RpcConnect)
+	reply, err = rpcConnect.Push(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) PushRoom(req *proto.Send) (reply *proto.SuccessReply, err error) {
+	rpcConnect := new(RpcConnect)
+	reply, err = rpcConnect.PushRoom(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) GetRoomStat(req *proto.Send) (reply *proto.RoomStatReply, err error) {
+	rpcConnect := new(RpcConnect)
+	reply, err = rpcConnect.GetRoomStat(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) PushRoomSignal(req *proto.Send) (reply *proto.SuccessReply, err error) {
+	rpcConnect := new(RpcConnect)
+	reply, err = rpcConnect.PushRoomSignal(req)
+	return
+}
+
+// rpc call logic layer
+func (o *DefaultOperator) AckMsg(req *proto.MsgAckRequest) (err error) {
+	rpcConnect := new(RpcConnect)
+	err = rpcConnect.AckMsg(req)
+	return
+}
@@ -0,0 +1,355 @@
+package connect
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/pkg/metrics"
+	"gochat/proto"
+)
+
+// actions taken on a conn over its rate limit, from the first violation to the last
+const (
+	RateLimitWarn     = "warn"     // drop the frame and warn the client
+	RateLimitThrottle = "throttle" // delay the frame until the limit allows it
+	RateLimitClose    = "close"    // close the conn with a policy violation code
+)
+
+// RateRule allow Rate frames per second with bursts up to Burst frames
+type RateRule struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitOptions limit the client ops of every conn and of every user, the op 0 rule is
+// the default for ops without their own rule. ops without any rule are not limited
+type RateLimitOptions struct {
+	Conn            map[int]RateRule
+	User            map[int]RateRule
+	ThrottleAfter   int           // violations before the conn is throttled
+	CloseAfter      int           // violations before the conn is closed, 0 never close
+	ViolationWindow time.Duration // the count starts over after a quiet window
+}
+
+// ParseRateLimit read the op rules from config, keys are op numbers or "default"
+func ParseRateLimit(conf config.ConnectRateLimit) RateLimitOptions {
+	return RateLimitOptions{
+		Conn:            parseRateRules(conf.Conn),
+		User:            parseRateRules(conf.User),
+		ThrottleAfter:   conf.ThrottleAfter,
+		CloseAfter:      conf.CloseAfter,
+		ViolationWindow: time.Duration(conf.ViolationWindow) * time.Millisecond,
+	}
+}
+
+func parseRateRules(conf map[string]config.ConnectRateRule) map[int]RateRule {
+	rules := make(map[int]RateRule, len(conf))
+	for key, rule := range conf {
+		op := 0
+		if key != "default" {
+			var err error
+			if op, err = strconv.Atoi(key); err != nil || op <= 0 {
+				logrus.Errorf("rate limit rule %q is not an op, ignore", key)
+				continue
+			}
+		}
+		if rule.Rate <= 0 || rule.Burst <= 0 {
+			logrus.Errorf("rate limit rule %q needs rate and burst, ignore", key)
+			continue
+		}
+		rules[op] = RateRule{Rate: rule.Rate, Burst: rule.Burst}
+	}
+	return rules
+}
+
+func (o *RateLimitOptions) enabled() bool {
+	return len(o.Conn) > 0 || len(o.User) > 0
+}
+
+// tokenBucket refill Rate tokens per second up to Burst, each frame take one
+type tokenBucket struct {
+	rule   RateRule
+	tokens float64
+	last   time.Time
+}
+
+// wait refill the bucket up to now, return how long until the next token, 0 if there is one.
+// a nil bucket is not limited
+func (tb *tokenBucket) wait(now time.Time) time.Duration {
+	if tb == nil {
+		return 0
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rule.Rate
+	if burst := float64(tb.rule.Burst); tb.tokens > burst {
+		tb.tokens = burst
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tb.tokens) / tb.rule.Rate * float64(time.Second))
+}
+
+// take a token, or return how long until the next one
+func (tb *tokenBucket) take(now time.Time) (wait time.Duration) {
+	if wait = tb.wait(now); wait == 0 {
+		tb.spend()
+	}
+	return
+}
+
+func (tb *tokenBucket) spend() {
+	if tb != nil {
+		tb.tokens--
+	}
+}
+
+// opLimiter keep a token bucket per op, built when the op is first seen
+type opLimiter struct {
+	lock    sync.Mutex
+	rules   map[int]RateRule
+	buckets map[int]*tokenBucket
+}
+
+func newOpLimiter(rules map[int]RateRule) *opLimiter {
+	return &opLimiter{rules: rules, buckets: make(map[int]*tokenBucket)}
+}
+
+// bucket return the token bucket of the op, nil if the op is not limited. l must be locked
+func (l *opLimiter) bucket(op int, now time.Time) *tokenBucket {
+	if l == nil {
+		return nil
+	}
+	tb, ok := l.buckets[op]
+	if !ok {
+		rule, ok := l.rules[op]
+		if !ok {
+			if rule, ok = l.rules[0]; !ok {
+				return nil
+			}
+		}
+		tb = &tokenBucket{rule: rule, tokens: float64(rule.Burst), last: now}
+		l.buckets[op] = tb
+	}
+	return tb
+}
+
+// take a token of the op, or return how long until the next one
+func (l *opLimiter) take(op int, now time.Time) (wait time.Duration) {
+	_, wait = takeBoth(l, nil, op, now)
+	return
+}
+
+// takeBoth take a token of the op from the conn and the user limiter only if both have one,
+// else take none and return the longer wait, scope tells which limit it comes from.
+// a nil limiter is not limited. the user limiter is shared by the conns of the user, it is
+// always locked first
+func takeBoth(conn *opLimiter, user *opLimiter, op int, now time.Time) (scope string, wait time.Duration) {
+	for _, l := range []*opLimiter{user, conn} {
+		if l != nil {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+		}
+	}
+	connTb, userTb := conn.bucket(op, now), user.bucket(op, now)
+	scope, wait = "conn", connTb.wait(now)
+	if userWait := userTb.wait(now); userWait > wait {
+		scope, wait = "user", userWait
+	}
+	if wait == 0 {
+		connTb.spend()
+		userTb.spend()
+	}
+	return
+}
+
+// violation count a violation of the conn and return the action for it,
+// only called by the read loop of the conn, so no lock
+func (ch *Channel) violation(now time.Time, o *RateLimitOptions) string {
+	if o.ViolationWindow > 0 && now.Sub(ch.lastViolation) > o.ViolationWindow {
+		ch.violations = 0
+	}
+	ch.violations++
+	ch.lastViolation = now
+	switch {
+	case o.CloseAfter > 0 && ch.violations > o.CloseAfter:
+		return RateLimitClose
+	case ch.violations > o.ThrottleAfter:
+		return RateLimitThrottle
+	default:
+		return RateLimitWarn
+	}
+}
+
+// takeOp take a token of the op from the conn and the user limiter, or none and return the
+// longer wait of the two, scope tells which limit it comes from
+func (s *Server) takeOp(ch *Channel, op int, now time.Time) (scope string, wait time.Duration) {
+	o := &s.Options.RateLimit
+	ch.limiterOnce.Do(func() { ch.limiter = newOpLimiter(o.Conn) })
+	var user *opLimiter
+	// a conn not connected yet has no user
+	if len(o.User) > 0 && ch.userId != 0 {
+		user = s.Bucket(ch.userId).UserLimiter(ch.userId, o.User)
+	}
+	return takeBoth(ch.limiter, user, op, now)
+}
+
+// violate count a violation of the conn, return the action for it
+func (s *Server) violate(ch *Channel, op int, scope string, now time.Time) string {
+	action := ch.violation(now, &s.Options.RateLimit)
+	metrics.RateLimitViolationsTotal.WithLabelValues(scope, strconv.Itoa(op), action).Inc()
+	logrus.Debugf("rate limit %s userId=%d op=%d action=%s", scope, ch.userId, op, action)
+	return action
+}
+
+// limitedOp tell if the op counts against the rate limit. acks and heartbeats cost nothing
+// and must get through a throttled conn, or its msgs are resent and the conn times out
+func limitedOp(op int) bool {
+	switch op {
+	case config.OpMsgAck, config.OpPing, config.OpPong:
+		return false
+	}
+	return true
+}
+
+// allowOp check the conn and user limits of a client op, return false if the op is not handled
+// now: dropped, deferred until the limits allow it, or the conn closed
+func (s *Server) allowOp(ch *Channel, op *proto.ClientOp) bool {
+	o := &s.Options.RateLimit
+	if !o.enabled() || !limitedOp(op.Op) {
+		return true
+	}
+	// ops after a deferred one wait behind it, they keep their order
+	if ch.deferred.add(op) {
+		return false
+	}
+	now := time.Now()
+	scope, wait := s.takeOp(ch, op.Op, now)
+	if wait == 0 {
+		return true
+	}
+	switch action := s.violate(ch, op.Op, scope, now); action {
+	case RateLimitClose:
+		ch.closeConn(websocket.ClosePolicyViolation, "rate limit")
+	case RateLimitThrottle:
+		// the read loop goes on, acks and heartbeats are still read while the op waits
+		s.pushRateLimit(ch, op, action, wait)
+		s.deferOp(ch, op, wait)
+	default:
+		s.pushRateLimit(ch, op, action, wait)
+	}
+	return false
+}
+
+// allowConnect check the conn limit of a connect or resume frame, each one costs a Connect
+// call to logic. the conn has no user yet, so there is no user limit. a throttled connect is
+// dropped, the client retries after the wait it is told
+func (s *Server) allowConnect(ch *Channel, seq string) bool {
+	if !s.Options.RateLimit.enabled() {
+		return true
+	}
+	op := &proto.ClientOp{Op: config.OpBuildTcpConn, SeqId: seq}
+	now := time.Now()
+	scope, wait := s.takeOp(ch, op.Op, now)
+	if wait == 0 {
+		return true
+	}
+	action := s.violate(ch, op.Op, scope, now)
+	if action == RateLimitClose {
+		ch.closeConn(websocket.ClosePolicyViolation, "rate limit")
+		return false
+	}
+	s.pushRateLimit(ch, op, action, wait)
+	return false
+}
+
+// maxDeferredOps is the most ops a throttled conn may have waiting, the ops after are dropped
+const maxDeferredOps = 64
+
+// deferredOps hold the ops of a throttled conn until its limits allow them. the ops run in
+// order on a timer, the read loop only queues them
+type deferredOps struct {
+	lock    sync.Mutex
+	ops     []*proto.ClientOp // the head is running or waits for its tokens
+	stopped bool              // the conn is gone, the ops left are dropped
+}
+
+// add queue the op behind the waiting ones, return false if there are none
+func (d *deferredOps) add(op *proto.ClientOp) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.ops) == 0 {
+		return false
+	}
+	if len(d.ops) < maxDeferredOps {
+		d.ops = append(d.ops, op)
+	}
+	return true
+}
+
+// stop drop the waiting ops, the timer running them finds nothing to do
+func (d *deferredOps) stop() {
+	d.lock.Lock()
+	d.stopped = true
+	d.ops = nil
+	d.lock.Unlock()
+}
+
+// deferOp run the op once the limits allow it, after wait
+func (s *Server) deferOp(ch *Channel, op *proto.ClientOp, wait time.Duration) {
+	d := &ch.deferred
+	d.lock.Lock()
+	if d.stopped {
+		d.lock.Unlock()
+		return
+	}
+	d.ops = append(d.ops, op)
+	d.lock.Unlock()
+	time.AfterFunc(wait, func() { s.runDeferred(ch) })
+}
+
+// runDeferred handle the deferred ops of the conn while its limits allow them, then wait for
+// the next token
+func (s *Server) runDeferred(ch *Channel) {
+	d := &ch.deferred
+	for {
+		d.lock.Lock()
+		if len(d.ops) == 0 {
+			d.lock.Unlock()
+			return
+		}
+		op := d.ops[0]
+		if _, wait := s.takeOp(ch, op.Op, time.Now()); wait > 0 {
+			d.lock.Unlock()
+			time.AfterFunc(wait, func() { s.runDeferred(ch) })
+			return
+		}
+		d.lock.Unlock()
+		s.handleClientOp(ch, op)
+		d.lock.Lock()
+		if len(d.ops) > 0 {
+			d.ops = d.ops[1:]
+		}
+		d.lock.Unlock()
+	}
+}
+
+// pushRateLimit tell the client it is over its limit, the frame carries the seq of the op
+func (s *Server) pushRateLimit(ch *Channel, op *proto.ClientOp, action string, wait time.Duration) {
+	body, _ := json.Marshal(proto.RateLimitInfo{
+		Op:         config.OpRateLimit,
+		SeqId:      op.SeqId,
+		ReqOp:      op.Op,
+		Action:     action,
+		RetryAfter: int(wait / time.Millisecond),
+	})
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpRateLimit, SeqId: op.SeqId, Body: body}
+	if err := ch.push(msg, ""); err != nil {
+		logrus.Debugf("push rate limit userId=%d err:%s", ch.userId, err.Error())
+	}
+}
@@ -0,0 +1,199 @@
+package connect
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	l := newOpLimiter(map[int]RateRule{0: {Rate: 10, Burst: 2}, 3: {Rate: 1, Burst: 1}})
+	// default rule: burst of 2, then one token every 100ms
+	for i := 0; i < 2; i++ {
+		if wait := l.take(2, now); wait != 0 {
+			t.Fatalf("frame %d in burst should pass, wait %s", i, wait)
+		}
+	}
+	if wait := l.take(2, now); wait <= 0 || wait > 100*time.Millisecond {
+		t.Errorf("frame over burst wait %s, want (0, 100ms]", wait)
+	}
+	if wait := l.take(2, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("frame after refill should pass, wait %s", wait)
+	}
+	// op 3 has its own bucket
+	if wait := l.take(3, now); wait != 0 {
+		t.Errorf("op with own rule should pass, wait %s", wait)
+	}
+	if wait := l.take(3, now); wait == 0 {
+		t.Error("op with own rule should be limited by it")
+	}
+}
+
+func TestTakeBothAllOrNone(t *testing.T) {
+	now := time.Now()
+	conn := newOpLimiter(map[int]RateRule{0: {Rate: 0.001, Burst: 1}})
+	user := newOpLimiter(map[int]RateRule{0: {Rate: 0.001, Burst: 1}})
+	user.take(2, now)
+	if scope, wait := takeBoth(conn, user, 2, now); scope != "user" || wait == 0 {
+		t.Fatalf("op over the user limit: scope %s wait %s", scope, wait)
+	}
+	// the conn token was not spent by the refused op
+	if wait := conn.take(2, now); wait != 0 {
+		t.Errorf("conn token spent by a refused op, wait %s", wait)
+	}
+}
+
+func TestOpLimiterNoRule(t *testing.T) {
+	l := newOpLimiter(map[int]RateRule{3: {Rate: 1, Burst: 1}})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if wait := l.take(2, now); wait != 0 {
+			t.Fatal("op without rule and no default should not be limited")
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	o := ParseRateLimit(config.ConnectRateLimit{
+		Conn: map[string]config.ConnectRateRule{
+			"default": {Rate: 5, Burst: 10},
+			"3":       {Rate: 1, Burst: 2},
+			"room":    {Rate: 1, Burst: 2}, // not an op
+			"4":       {Rate: 0, Burst: 2}, // no rate
+		},
+	})
+	if len(o.Conn) != 2 || o.Conn[0].Burst != 10 || o.Conn[3].Rate != 1 {
+		t.Errorf("parsed rules %+v", o.Conn)
+	}
+	if !o.enabled() {
+		t.Error("limit with rules should be enabled")
+	}
+	if o := ParseRateLimit(config.ConnectRateLimit{}); o.enabled() {
+		t.Error("limit without rules should be disabled")
+	}
+}
+
+func TestViolationEscalate(t *testing.T) {
+	o := &RateLimitOptions{ThrottleAfter: 2, CloseAfter: 3, ViolationWindow: time.Second}
+	ch := NewChannel(4, DropNewest, 0)
+	now := time.Now()
+	want := []string{RateLimitWarn, RateLimitWarn, RateLimitThrottle, RateLimitClose}
+	for i, action := range want {
+		if got := ch.violation(now, o); got != action {
+			t.Errorf("violation %d: got %s, want %s", i+1, got, action)
+		}
+	}
+	// a quiet window starts over
+	if got := ch.violation(now.Add(2*time.Second), o); got != RateLimitWarn {
+		t.Errorf("violation after quiet window: got %s, want warn", got)
+	}
+}
+
+func TestAllowOpWarn(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	s := NewServer([]*Bucket{b}, nil, ServerOptions{RateLimit: RateLimitOptions{
+		User:          map[int]RateRule{0: {Rate: 0.001, Burst: 1}},
+		ThrottleAfter: 5,
+	}})
+	// two devices of one user share the user limit
+	ch1, ch2 := NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0)
+	b.Put(1, "a", 0, ch1)
+	b.Put(1, "b", 0, ch2)
+	op := &proto.ClientOp{Op: config.OpRoomSend, SeqId: "7"}
+	if !s.allowOp(ch1, op) {
+		t.Fatal("first op should pass")
+	}
+	if s.allowOp(ch2, op) {
+		t.Fatal("op over the user limit should be dropped")
+	}
+	select {
+	case msg := <-ch2.control:
+		if msg.Operation != config.OpRateLimit || msg.SeqId != "7" {
+			t.Errorf("got op %d seq %s, want a rate limit warning for seq 7", msg.Operation, msg.SeqId)
+		}
+	default:
+		t.Error("dropped op got no warning")
+	}
+}
+
+func TestAllowConnect(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	s := NewServer([]*Bucket{b}, nil, ServerOptions{RateLimit: RateLimitOptions{
+		Conn:          map[int]RateRule{config.OpBuildTcpConn: {Rate: 0.001, Burst: 1}},
+		User:          map[int]RateRule{0: {Rate: 0.001, Burst: 1}},
+		ThrottleAfter: 1,
+		CloseAfter:    1,
+	}})
+	// conns not connected yet do not share the limit of a user 0
+	for i := 0; i < 2; i++ {
+		if !s.allowConnect(NewChannel(4, DropNewest, 0), "") {
+			t.Fatalf("first connect of conn %d should pass", i)
+		}
+	}
+	ch := NewChannel(4, DropNewest, 0)
+	s.allowConnect(ch, "")
+	if s.allowConnect(ch, "3") {
+		t.Fatal("connect over the conn limit should be dropped")
+	}
+	select {
+	case msg := <-ch.control:
+		if msg.Operation != config.OpRateLimit || msg.SeqId != "3" {
+			t.Errorf("got op %d seq %s, want a rate limit warning for seq 3", msg.Operation, msg.SeqId)
+		}
+	default:
+		t.Error("dropped connect got no warning")
+	}
+	if s.allowConnect(ch, "") || atomic.LoadInt32(&ch.closedByServer) != 1 {
+		t.Error("conn over its violations should be closed")
+	}
+}
+
+// countOperator answer the room count queries
+type countOperator struct {
+	Operator
+}
+
+func (countOperator) GetRoomStat(req *proto.Send) (*proto.RoomStatReply, error) {
+	return &proto.RoomStatReply{Code: config.SuccessReplyCode}, nil
+}
+
+func TestAllowOpThrottle(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	s := NewServer([]*Bucket{b}, countOperator{}, ServerOptions{RateLimit: RateLimitOptions{
+		Conn: map[int]RateRule{0: {Rate: 20, Burst: 1}},
+	}})
+	ch := NewChannel(16, DropNewest, 0)
+	b.Put(1, "a", 7, ch)
+	start := time.Now()
+	for _, seq := range []string{"1", "2", "3"} {
+		s.dispatchClientOp(ch, &proto.ClientOp{Op: config.OpRoomCountSend, RoomId: 7, SeqId: seq})
+	}
+	// acks are never limited, nor held behind the throttled ops
+	if !s.allowOp(ch, &proto.ClientOp{Op: config.OpMsgAck, SeqId: "9"}) {
+		t.Error("ack should pass a throttled conn")
+	}
+	if time.Since(start) > 40*time.Millisecond {
+		t.Errorf("throttled ops held the read loop for %s", time.Since(start))
+	}
+	// the deferred ops are answered later, one every 50ms
+	var replies []string
+	for deadline := time.Now().Add(time.Second); len(replies) < 3 && time.Now().Before(deadline); {
+		msg := ch.dequeue()
+		if msg == nil {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		var reply proto.OpReply
+		if json.Unmarshal(msg.Body, &reply) == nil && reply.Op == config.OpReply {
+			replies = append(replies, reply.SeqId)
+		}
+	}
+	if len(replies) != 3 || replies[0] != "1" || replies[1] != "2" || replies[2] != "3" {
+		t.Errorf("replies %v, want [1 2 3] in order", replies)
+	}
+}
@@ -0,0 +1,329 @@
+package connect
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+)
+
+var errReplayTimeout = errors.New("replay push timeout")
+
+// replayBuffer keep the last msgs pushed to a channel, so a client resuming its session
+// get what it missed. while the session is detached (conn dropped, in grace window),
+// msgs are only kept here. a nil replayBuffer means resume is disabled
+type replayBuffer struct {
+	lock     sync.Mutex
+	size     int
+	msgs     []*proto.Msg // oldest first
+	detached bool
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	if size <= 0 {
+		return nil
+	}
+	return &replayBuffer{size: size, msgs: make([]*proto.Msg, 0, size)}
+}
+
+// replayable is true for the chat msgs kept for replay, single and room msgs whose seq is
+// given by the server. a resuming client gives the seq of the last one it got as cursor
+func replayable(msg *proto.Msg) bool {
+	return msg.Operation == config.OpSingleSend || msg.Operation == config.OpRoomSend
+}
+
+// record keep the msg, return true if the session is detached and the msg must not be sent now
+func (r *replayBuffer) record(msg *proto.Msg) (detached bool) {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	if len(r.msgs) >= r.size {
+		copy(r.msgs, r.msgs[1:])
+		r.msgs = r.msgs[:len(r.msgs)-1]
+	}
+	r.msgs = append(r.msgs, msg)
+	detached = r.detached
+	r.lock.Unlock()
+	return
+}
+
+func (r *replayBuffer) isDetached() bool {
+	if r == nil {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.detached
+}
+
+func (r *replayBuffer) detach() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.detached = true
+	r.lock.Unlock()
+}
+
+func (r *replayBuffer) attach() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.detached = false
+	r.lock.Unlock()
+}
+
+// adopt take the msgs of the old session before the ones already kept, the buffer stays
+// detached until replay is done
+func (r *replayBuffer) adopt(old *replayBuffer) {
+	if r == nil || old == nil {
+		return
+	}
+	old.lock.Lock()
+	msgs := append([]*proto.Msg(nil), old.msgs...)
+	old.lock.Unlock()
+	r.lock.Lock()
+	msgs = append(msgs, r.msgs...)
+	if len(msgs) > r.size {
+		msgs = msgs[len(msgs)-r.size:]
+	}
+	r.msgs = msgs
+	r.detached = true
+	r.lock.Unlock()
+}
+
+// holds tell if the msgs after the seq cursor can be replayed: the cursor is kept, or empty
+// as the client got no msg yet
+func (r *replayBuffer) holds(cursor string) bool {
+	if r == nil || cursor == "" {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := len(r.msgs) - 1; i >= 0; i-- {
+		if r.msgs[i].SeqId == cursor {
+			return true
+		}
+	}
+	return false
+}
+
+// reset drop the kept msgs and attach the buffer again, msgs pushed later are sent at once
+func (r *replayBuffer) reset() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	r.msgs = r.msgs[:0]
+	r.detached = false
+	r.lock.Unlock()
+}
+
+// next return the msgs after the one with seq cursor, all msgs if cursor is empty. a replay
+// cursor dropped from the buffer meanwhile is older than all kept msgs, they are all returned.
+// if there is nothing after cursor the buffer is attached again and done is true, so msgs
+// pushed later are sent at once
+func (r *replayBuffer) next(cursor string) (msgs []*proto.Msg, done bool) {
+	if r == nil {
+		return nil, true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	start := 0
+	if cursor != "" {
+		for i := len(r.msgs) - 1; i >= 0; i-- {
+			if r.msgs[i].SeqId == cursor {
+				start = i + 1
+				break
+			}
+		}
+	}
+	if start >= len(r.msgs) {
+		r.detached = false
+		return nil, true
+	}
+	return append([]*proto.Msg(nil), r.msgs[start:]...), false
+}
+
+// detach keep the session of a dropped conn for the grace window instead of disconnecting it,
+// the channel stays in bucket and rooms, so logic sees no leave and room members no churn
+func (s *Server) detach(ch *Channel, serverId string) bool {
+	if ch.resumeToken == "" || s.Options.ResumeGrace <= 0 || atomic.LoadInt32(&ch.closedByServer) == 1 {
+		return false
+	}
+	ch.replay.detach()
+	token := ch.resumeToken
+	s.sessLock.Lock()
+	s.sessions[token] = ch
+	ch.sessTimer = time.AfterFunc(s.Options.ResumeGrace, func() {
+		if s.takeSession(token) == ch {
+			logrus.Debugf("session of userId=%d not resumed in time", ch.userId)
+			s.disconnect(ch, serverId)
+		}
+	})
+	s.sessLock.Unlock()
+	return true
+}
+
+// session return the detached session of the token, nil if unknown or already expired
+func (s *Server) session(token string) *Channel {
+	s.sessLock.Lock()
+	defer s.sessLock.Unlock()
+	return s.sessions[token]
+}
+
+// takeSession remove a detached session, nil if the token is unknown or already expired
+func (s *Server) takeSession(token string) (ch *Channel) {
+	s.sessLock.Lock()
+	if ch = s.sessions[token]; ch != nil {
+		delete(s.sessions, token)
+		ch.sessTimer.Stop()
+	}
+	s.sessLock.Unlock()
+	return
+}
+
+// dropSession disconnect a detached session at once, e.g. its device connected again without resume,
+// return false if the channel is not a detached session
+func (s *Server) dropSession(ch *Channel, serverId string) bool {
+	if ch.resumeToken != "" && s.takeSession(ch.resumeToken) == ch {
+		s.disconnect(ch, serverId)
+		return true
+	}
+	return false
+}
+
+// resume let the new channel take over the detached session of the token, then replay
+// the msgs after lastSeq, return false if there is no such session to resume
+func (s *Server) resume(ch *Channel, connReq *proto.ConnectRequest) bool {
+	if !s.takeOver(ch, connReq) {
+		return false
+	}
+	s.resumed(ch, connReq.LastSeq)
+	return true
+}
+
+// resumed tell the client its session is back and replay the msgs after lastSeq. if lastSeq
+// is not kept any more the client missed msgs the buffer can not give, it is told to resync
+// instead, its unacked single msgs are still redelivered
+func (s *Server) resumed(ch *Channel, lastSeq string) {
+	if !ch.replay.holds(lastSeq) {
+		logrus.Debugf("resume userId=%d lastSeq=%s not kept, resync", ch.userId, lastSeq)
+		ch.replay.reset()
+		s.pushSession(ch, true, true)
+		return
+	}
+	s.pushSession(ch, true, false)
+	s.replay(ch, lastSeq)
+}
+
+// takeOver move the detached session of the token to the new channel, its msgs stay held
+// back until the caller replays them. return false if there is no such session to resume
+func (s *Server) takeOver(ch *Channel, connReq *proto.ConnectRequest) bool {
+	old := s.session(connReq.ResumeToken)
+	if old == nil {
+		return false
+	}
+	// still check the auth token, without room so logic changes no membership
+	userId, userName, err := s.operator.Connect(&proto.ConnectRequest{
+		AuthToken: connReq.AuthToken,
+		ServerId:  connReq.ServerId,
+		DeviceId:  old.deviceId,
+	})
+	if err != nil || userId != old.userId {
+		// the session is left to its owner until it expires, only this conn is refused
+		logrus.Warnf("resume session of userId=%d auth fail, userId=%d", old.userId, userId)
+		return false
+	}
+	if s.takeSession(connReq.ResumeToken) != old {
+		// expired or resumed by another conn meanwhile
+		return false
+	}
+	// msgs pushed to the new channel once it is in the bucket wait for the replay
+	ch.replay.detach()
+	if !s.Bucket(userId).TakeOver(old, ch, s.admission.opts.MaxConnsPerUser) {
+		// other devices took the slots meanwhile, the session ends
+		ch.replay.attach()
+		s.refuseUser(ch, userId)
+		s.disconnect(old, connReq.ServerId)
+		return false
+	}
+	ch.userId = userId
+	ch.userName = userName
+	ch.deviceId = old.deviceId
+	ch.resumeToken = old.resumeToken
+	ch.replay.adopt(old.replay)
+	now := time.Now()
+	for _, msg := range old.acks.drain() {
+		ch.acks.track(msg, now)
+	}
+	return true
+}
+
+// startSession give a new session its resume token
+func (s *Server) startSession(ch *Channel) {
+	if s.Options.ResumeGrace <= 0 || ch.replay == nil {
+		return
+	}
+	ch.resumeToken = uuid.New().String()
+	s.pushSession(ch, false, false)
+}
+
+func (s *Server) pushSession(ch *Channel, resumed bool, resync bool) {
+	body, _ := json.Marshal(proto.SessionInfo{
+		Op:          config.OpSession,
+		ResumeToken: ch.resumeToken,
+		Resumed:     resumed,
+		Resync:      resync,
+	})
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpSession, Body: body}
+	if err := ch.pushWait(msg, s.Options.WriteWait); err != nil {
+		logrus.Warnf("push session info userId=%d err:%s", ch.userId, err.Error())
+	}
+}
+
+// replay send the missed msgs in order, msgs pushed meanwhile are kept in the buffer
+// and sent by the next round, so nothing overtakes the replay
+func (s *Server) replay(ch *Channel, lastSeq string) {
+	cursor := lastSeq
+	for {
+		msgs, done := ch.replay.next(cursor)
+		if done {
+			return
+		}
+		for _, msg := range msgs {
+			if err := ch.pushWait(msg, s.Options.WriteWait); err != nil {
+				logrus.Warnf("replay seq=%s userId=%d err:%s", msg.SeqId, ch.userId, err.Error())
+				ch.replay.attach() // give up, send new msgs at once
+				return
+			}
+		}
+		cursor = msgs[len(msgs)-1].SeqId
+	}
+}
+
+// disconnect remove the channel from bucket and rooms, and tell logic the device is gone
+func (s *Server) disconnect(ch *Channel, serverId string) {
+	disConnectRequest := new(proto.DisConnectRequest)
+	disConnectRequest.RoomIds = ch.RoomIds()
+	disConnectRequest.UserId = ch.userId
+	disConnectRequest.ServerId = serverId
+	logrus.Debugf("exec disConnect userId=%d roomIds=%v", ch.userId, disConnectRequest.RoomIds)
+	// if the device reconnected to this server, the new conn is still online
+	if s.Bucket(ch.userId).DeleteChannel(ch) {
+		disConnectRequest.DeviceId = ch.deviceId
+	}
+	ch.deferred.stop()
+	s.flushUnacked(ch)
+	if err := s.operator.DisConnect(disConnectRequest); err != nil {
+		logrus.Warnf("DisConnect err :%s", err.Error())
+	}
+}
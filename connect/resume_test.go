@@ -0,0 +1,160 @@
+package connect
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestReplayBufferDisabled(t *testing.T) {
+	r := newReplayBuffer(0)
+	if r != nil {
+		t.Fatal("buffer of size 0 should be disabled")
+	}
+	// nil buffer never holds a msg back
+	if r.record(seqMsg("1")) {
+		t.Error("disabled buffer should not be detached")
+	}
+	if msgs, done := r.next(""); !done || len(msgs) != 0 {
+		t.Error("disabled buffer should have nothing to replay")
+	}
+}
+
+func TestReplayBufferKeepLast(t *testing.T) {
+	r := newReplayBuffer(3)
+	for _, seq := range []string{"1", "2", "3", "4"} {
+		if r.record(seqMsg(seq)) {
+			t.Fatalf("attached buffer should not hold back msg %s", seq)
+		}
+	}
+	msgs, done := r.next("")
+	if done {
+		t.Fatal("buffer should have msgs")
+	}
+	if got, want := seqs(msgs), []string{"2", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestReplayBufferDetach(t *testing.T) {
+	r := newReplayBuffer(8)
+	r.record(seqMsg("1"))
+	r.record(seqMsg("2"))
+	r.detach()
+	if !r.record(seqMsg("3")) {
+		t.Error("detached buffer should hold back new msgs")
+	}
+
+	// the new session take over the buffer, then replay after the last seq the client got
+	resumed := newReplayBuffer(8)
+	resumed.adopt(r)
+	if !resumed.record(seqMsg("4")) {
+		t.Error("buffer should stay detached until the replay is done")
+	}
+	msgs, done := resumed.next("1")
+	if done {
+		t.Fatal("msgs after seq 1 should be replayed")
+	}
+	if got, want := seqs(msgs), []string{"2", "3", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay %v, want %v", got, want)
+	}
+	resumed.record(seqMsg("5"))
+	msgs, done = resumed.next("4")
+	if done || !reflect.DeepEqual(seqs(msgs), []string{"5"}) {
+		t.Errorf("second round got %v, want [5]", seqs(msgs))
+	}
+	if _, done = resumed.next("5"); !done {
+		t.Error("replay should be done after the last msg")
+	}
+	if resumed.record(seqMsg("6")) {
+		t.Error("buffer should be attached after the replay")
+	}
+}
+
+func TestReplayBufferUnknownCursor(t *testing.T) {
+	r := newReplayBuffer(2)
+	r.detach()
+	r.record(seqMsg("2"))
+	r.record(seqMsg("3"))
+	// the replay cursor seq 1 was dropped meanwhile, all that is left is newer
+	msgs, _ := r.next("1")
+	if got, want := seqs(msgs), []string{"2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay %v, want %v", got, want)
+	}
+}
+
+func TestResumeResync(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{WriteWait: time.Second})
+	ch := NewChannel(8, DropNewest, 0)
+	ch.replay = newReplayBuffer(2)
+	ch.replay.detach()
+	for _, seq := range []string{"1", "2", "3"} {
+		ch.replay.record(seqMsg(seq))
+	}
+	// seq 1 is no longer kept, replaying 2 and 3 could skip msgs between, the client resyncs
+	s.resumed(ch, "1")
+	var info proto.SessionInfo
+	if msg := ch.dequeue(); msg == nil || json.Unmarshal(msg.Body, &info) != nil || !info.Resumed || !info.Resync {
+		t.Fatalf("session info %+v, want resumed with resync", info)
+	}
+	if msg := ch.dequeue(); msg != nil {
+		t.Errorf("replayed seq %s after a resync", msg.SeqId)
+	}
+	if ch.replay.record(seqMsg("4")) {
+		t.Error("buffer should be attached after a resync")
+	}
+}
+
+func TestTakeOverAuthFail(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{ResumeGrace: time.Minute})
+	old := NewChannel(8, DropNewest, 0)
+	old.replay = newReplayBuffer(8)
+	old.resumeToken = "token"
+	b.Put(1, "a", 0, old)
+	if !s.detach(old, "test") {
+		t.Fatal("session should be detached")
+	}
+	if s.takeOver(NewChannel(8, DropNewest, 0), &proto.ConnectRequest{AuthToken: "bad", ResumeToken: "token"}) {
+		t.Fatal("resume with a bad auth token should fail")
+	}
+	select {
+	case <-o.disconnected:
+		t.Fatal("a failed resume disconnected the session")
+	default:
+	}
+	// the session is still there for its owner
+	ch := NewChannel(8, DropNewest, 0)
+	if !s.takeOver(ch, &proto.ConnectRequest{AuthToken: "good", ResumeToken: "token"}) || ch.userId != 1 {
+		t.Fatal("owner should resume the session")
+	}
+	if s.session("token") != nil {
+		t.Error("resumed session still detached")
+	}
+}
+
+func TestReplayOnlyChat(t *testing.T) {
+	ch := NewChannel(8, DropNewest, 0)
+	ch.replay = newReplayBuffer(8)
+	ch.Push(&proto.Msg{Operation: config.OpSingleSend, SeqId: "1"})
+	ch.Push(&proto.Msg{Operation: config.OpReply, SeqId: "1"})
+	ch.Push(&proto.Msg{Operation: config.OpPong, SeqId: "7"})
+	ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomSend, SeqId: "2"})
+	ch.replay.detach()
+	ch.Push(&proto.Msg{Operation: config.OpKick})
+	ch.Push(&proto.Msg{Operation: config.OpRateLimit, SeqId: "9"})
+	ch.PushRoom(7, &proto.Msg{Operation: config.OpRoomSend, SeqId: "3"})
+	if n := len(ch.control); n != 2 {
+		t.Errorf("%d control msgs queued, want the 2 sent before the detach", n)
+	}
+	// a client seq matching a reply does not move the cursor
+	msgs, _ := ch.replay.next("7")
+	if got, want := seqs(msgs), []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay %v, want %v", got, want)
+	}
+}
@@ -18,58 +18,56 @@ type Room struct {
 	Id          int
 	OnlineCount int // room online user count
 	rLock       sync.RWMutex
-	drop        bool // make room is live
-	next        *Channel
+	drop        bool                  // make room is live
+	channels    map[*Channel]struct{} // a channel can be in many rooms, so rooms keep their own member set
 }
 
 func NewRoom(roomId int) *Room {
 	room := new(Room)
 	room.Id = roomId
 	room.drop = false
-	room.next = nil
+	room.channels = make(map[*Channel]struct{})
 	room.OnlineCount = 0
 	return room
 }
 
 func (r *Room) Put(ch *Channel) (err error) {
-	//doubly linked list
 	r.rLock.Lock()
 	defer r.rLock.Unlock()
 	if !r.drop {
-		if r.next != nil {
-			r.next.Prev = ch
+		if _, ok := r.channels[ch]; !ok {
+			r.channels[ch] = struct{}{}
+			r.OnlineCount++
 		}
-		ch.Next = r.next
-		ch.Prev = nil
-		r.next = ch
-		r.OnlineCount++
 	} else {
 		err = errors.New("room drop")
 	}
 	return
 }
 
-func (r *Room) Push(msg *proto.Msg) {
+// Push send the msg to every channel in room, except the channels of exceptUserId if not 0.
+// the members are copied first, a push may wait for a slow member and must not hold the lock
+func (r *Room) Push(msg *proto.Msg, exceptUserId int) {
 	r.rLock.RLock()
-	for ch := r.next; ch != nil; ch = ch.Next {
-		ch.Push(msg)
+	chs := make([]*Channel, 0, len(r.channels))
+	for ch := range r.channels {
+		if exceptUserId != 0 && ch.userId == exceptUserId {
+			continue
+		}
+		chs = append(chs, ch)
 	}
 	r.rLock.RUnlock()
+	for _, ch := range chs {
+		ch.PushRoom(r.Id, msg)
+	}
 }
 
 func (r *Room) DeleteChannel(ch *Channel) bool {
 	r.rLock.Lock()
-	if ch.Next != nil {
-		//if not footer
-		ch.Next.Prev = ch.Prev
-	}
-	if ch.Prev != nil {
-		// if not header
-		ch.Prev.Next = ch.Next
-	} else {
-		r.next = ch.Next
+	if _, ok := r.channels[ch]; ok {
+		delete(r.channels, ch)
+		r.OnlineCount--
 	}
-	r.OnlineCount--
 	r.drop = false
 	if r.OnlineCount <= 0 {
 		r.drop = true
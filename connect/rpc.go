@@ -66,6 +66,9 @@ func (c *Connect) InitLogicRpcClient() (err error) {
 			SerializeType:       protocol.MsgPack,
 			CompressType:        protocol.None,
 		}
+		if opt.TLSConfig, e = logicClientTLS(); e != nil {
+			logrus.Fatalf("init connect rpc client tls fail:%s", e.Error())
+		}
 		logicRpcClient = client.NewXClient(config.Conf.Common.CommonEtcd.ServerPathLogic, client.Failtry, client.RandomSelect, d, opt)
 	})
 	if logicRpcClient == nil {
@@ -74,7 +77,7 @@ func (c *Connect) InitLogicRpcClient() (err error) {
 	return
 }
 
-func (rpc *RpcConnect) Connect(connReq *proto.ConnectRequest) (uid int, err error) {
+func (rpc *RpcConnect) Connect(connReq *proto.ConnectRequest) (uid int, userName string, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -85,6 +88,24 @@ func (rpc *RpcConnect) Connect(connReq *proto.ConnectRequest) (uid int, err erro
 		return
 	}
 	uid = reply.UserId
+	userName = reply.UserName
+	return
+}
+
+// CheckAuth only check the token, the session is not bound to this server
+func (rpc *RpcConnect) CheckAuth(authToken string) (userId int, userName string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply := &proto.CheckAuthResponse{}
+	err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "CheckAuth", &proto.CheckAuthRequest{AuthToken: authToken}, reply)
+	if err != nil {
+		logrus.Errorf("CheckAuth RPC call failed: %v", err)
+		return
+	}
+	if reply.Code == config.SuccessReplyCode {
+		userId, userName = reply.UserId, reply.UserName
+	}
 	return
 }
 
@@ -99,6 +120,105 @@ func (rpc *RpcConnect) DisConnect(disConnReq *proto.DisConnectRequest) (err erro
 	return
 }
 
+func (rpc *RpcConnect) SaveOfflineMsg(req *proto.SaveOfflineMsgRequest) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply := &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "SaveOfflineMsg", req, reply); err != nil {
+		logrus.Errorf("SaveOfflineMsg RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) GetOfflineMsg(req *proto.OfflineMsgRequest) (reply *proto.OfflineMsgReply, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply = &proto.OfflineMsgReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "GetOfflineMsg", req, reply); err != nil {
+		logrus.Errorf("GetOfflineMsg RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) JoinRoom(req *proto.RoomMemberRequest) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply := &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "JoinRoom", req, reply); err != nil {
+		logrus.Errorf("JoinRoom RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) LeaveRoom(req *proto.RoomMemberRequest) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply := &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "LeaveRoom", req, reply); err != nil {
+		logrus.Errorf("LeaveRoom RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) Push(req *proto.Send) (reply *proto.PushReply, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply = &proto.PushReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "Push", req, reply); err != nil {
+		logrus.Errorf("Push RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) AckMsg(req *proto.MsgAckRequest) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply := &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "AckMsg", req, reply); err != nil {
+		logrus.Errorf("AckMsg RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) PushRoom(req *proto.Send) (reply *proto.SuccessReply, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply = &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "PushRoom", req, reply); err != nil {
+		logrus.Errorf("PushRoom RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) PushRoomSignal(req *proto.Send) (reply *proto.SuccessReply, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply = &proto.SuccessReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "PushRoomSignal", req, reply); err != nil {
+		logrus.Errorf("PushRoomSignal RPC call failed: %v", err)
+	}
+	return
+}
+
+func (rpc *RpcConnect) GetRoomStat(req *proto.Send) (reply *proto.RoomStatReply, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	reply = &proto.RoomStatReply{}
+	if err = middleware.InstrumentedCall(ctx, logicRpcClient, "connect", "logic", "GetRoomStat", req, reply); err != nil {
+		logrus.Errorf("GetRoomStat RPC call failed: %v", err)
+	}
+	return
+}
+
 func (c *Connect) InitConnectWebsocketRpcServer() (err error) {
 	var network, addr string
 	connectRpcAddress := strings.Split(config.Conf.Connect.ConnectRpcAddressWebSockts.Address, ",")
@@ -125,21 +245,30 @@ func (c *Connect) InitConnectTcpRpcServer() (err error) {
 	return
 }
 
+func (c *Connect) InitConnectHttpRpcServer() (err error) {
+	var network, addr string
+	connectRpcAddress := strings.Split(config.Conf.Connect.ConnectRpcAddressHttp.Address, ",")
+	for _, bind := range connectRpcAddress {
+		if network, addr, err = tools.ParseNetwork(bind); err != nil {
+			logrus.Panicf("InitConnectHttpRpcServer ParseNetwork error : %s", err)
+		}
+		logrus.Infof("Connect start run at-->%s:%s", network, addr)
+		go c.createConnectHttpRpcServer(network, addr)
+	}
+	return
+}
+
 type RpcConnectPush struct {
+	serverId string
 }
 
 func (rpc *RpcConnectPush) PushSingleMsg(ctx context.Context, pushMsgReq *proto.PushMsgRequest, successReply *proto.SuccessReply) (err error) {
-	var (
-		bucket  *Bucket
-		channel *Channel
-	)
 	if pushMsgReq == nil {
 		logrus.Errorf("rpc PushSingleMsg() args:(%v)", pushMsgReq)
 		return
 	}
-	bucket = DefaultServer.Bucket(pushMsgReq.UserId)
-	if channel = bucket.Channel(pushMsgReq.UserId); channel != nil {
-		err = channel.Push(&pushMsgReq.Msg)
+	if err = DefaultServer.pushUser(pushMsgReq.UserId, &pushMsgReq.Msg); err != nil {
+		logrus.Warnf("PushSingleMsg userId=%d err:%s", pushMsgReq.UserId, err.Error())
 		return
 	}
 	successReply.Code = config.SuccessReplyCode
@@ -150,6 +279,8 @@ func (rpc *RpcConnectPush) PushSingleMsg(ctx context.Context, pushMsgReq *proto.
 func (rpc *RpcConnectPush) PushRoomMsg(ctx context.Context, pushRoomMsgReq *proto.PushRoomMsgRequest, successReply *proto.SuccessReply) (err error) {
 	successReply.Code = config.SuccessReplyCode
 	successReply.Msg = config.SuccessReplyMsg
+	// every conn in the room gets the same msg, encode it once
+	shareFrames(&pushRoomMsgReq.Msg)
 	for _, bucket := range DefaultServer.Buckets {
 		bucket.BroadcastRoom(pushRoomMsgReq)
 	}
@@ -159,6 +290,7 @@ func (rpc *RpcConnectPush) PushRoomMsg(ctx context.Context, pushRoomMsgReq *prot
 func (rpc *RpcConnectPush) PushRoomCount(ctx context.Context, pushRoomMsgReq *proto.PushRoomMsgRequest, successReply *proto.SuccessReply) (err error) {
 	successReply.Code = config.SuccessReplyCode
 	successReply.Msg = config.SuccessReplyMsg
+	shareFrames(&pushRoomMsgReq.Msg)
 	for _, bucket := range DefaultServer.Buckets {
 		bucket.BroadcastRoom(pushRoomMsgReq)
 	}
@@ -168,18 +300,37 @@ func (rpc *RpcConnectPush) PushRoomCount(ctx context.Context, pushRoomMsgReq *pr
 func (rpc *RpcConnectPush) PushRoomInfo(ctx context.Context, pushRoomMsgReq *proto.PushRoomMsgRequest, successReply *proto.SuccessReply) (err error) {
 	successReply.Code = config.SuccessReplyCode
 	successReply.Msg = config.SuccessReplyMsg
+	shareFrames(&pushRoomMsgReq.Msg)
 	for _, bucket := range DefaultServer.Buckets {
 		bucket.BroadcastRoom(pushRoomMsgReq)
 	}
 	return
 }
 
+// KickUser remove the user from the room on this server, a conn left with no room is closed
+func (rpc *RpcConnectPush) KickUser(ctx context.Context, kickReq *proto.KickRequest, successReply *proto.SuccessReply) (err error) {
+	successReply.Code = config.SuccessReplyCode
+	successReply.Msg = config.SuccessReplyMsg
+	if n := DefaultServer.kick(kickReq, rpc.serverId); n > 0 {
+		logrus.Infof("kick userId=%d from roomId=%d, %d conns", kickReq.UserId, kickReq.RoomId, n)
+	}
+	return
+}
+
+// Introspect is a read only view of the buckets, rooms and conns of a user on this server
+func (rpc *RpcConnectPush) Introspect(ctx context.Context, req *proto.IntrospectRequest, reply *proto.IntrospectReply) (err error) {
+	*reply = *DefaultServer.introspect(req)
+	reply.ServerId = rpc.serverId
+	return
+}
+
 func (c *Connect) createConnectWebsocktsRpcServer(network string, addr string) {
-	s := server.NewServer()
+	s := server.NewServer(c.rpcServerOptions()...)
+	c.addRpcServer(s)
 	addRegistryPlugin(s, network, addr)
 	//config.Conf.Connect.ConnectTcp.ServerId
 	//s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, new(RpcConnectPush), fmt.Sprintf("%s", config.Conf.Connect.ConnectWebsocket.ServerId))
-	s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, new(RpcConnectPush), fmt.Sprintf("serverId=%s&serverType=ws", c.ServerId))
+	s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, &RpcConnectPush{serverId: c.ServerId}, fmt.Sprintf("serverId=%s&serverType=ws", c.ServerId))
 	s.RegisterOnShutdown(func(s *server.Server) {
 		s.UnregisterAll()
 	})
@@ -187,10 +338,22 @@ func (c *Connect) createConnectWebsocktsRpcServer(network string, addr string) {
 }
 
 func (c *Connect) createConnectTcpRpcServer(network string, addr string) {
-	s := server.NewServer()
+	s := server.NewServer(c.rpcServerOptions()...)
+	c.addRpcServer(s)
 	addRegistryPlugin(s, network, addr)
 	//s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, new(RpcConnectPush), fmt.Sprintf("%s", config.Conf.Connect.ConnectTcp.ServerId))
-	s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, new(RpcConnectPush), fmt.Sprintf("serverId=%s&serverType=tcp", c.ServerId))
+	s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, &RpcConnectPush{serverId: c.ServerId}, fmt.Sprintf("serverId=%s&serverType=tcp", c.ServerId))
+	s.RegisterOnShutdown(func(s *server.Server) {
+		s.UnregisterAll()
+	})
+	s.Serve(network, addr)
+}
+
+func (c *Connect) createConnectHttpRpcServer(network string, addr string) {
+	s := server.NewServer(c.rpcServerOptions()...)
+	c.addRpcServer(s)
+	addRegistryPlugin(s, network, addr)
+	s.RegisterName(config.Conf.Common.CommonEtcd.ServerPathConnect, &RpcConnectPush{serverId: c.ServerId}, fmt.Sprintf("serverId=%s&serverType=http", c.ServerId))
 	s.RegisterOnShutdown(func(s *server.Server) {
 		s.UnregisterAll()
 	})
@@ -6,11 +6,11 @@
 package connect
 
 import (
-	"encoding/json"
 	"fmt"
-	"sync/atomic"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"gochat/proto"
@@ -22,6 +22,9 @@ type Server struct {
 	Options   ServerOptions
 	bucketIdx uint32
 	operator  Operator
+	sessLock  sync.Mutex
+	sessions  map[string]*Channel // detached sessions waiting for resume, by resume token
+	admission *admission
 }
 
 type ServerOptions struct {
@@ -32,6 +35,37 @@ type ServerOptions struct {
 	ReadBufferSize  int
 	WriteBufferSize int
 	BroadcastSize   int
+	// what Channel.Push does when the chat lane is full
+	SlowConsumerPolicy SlowConsumerPolicy
+	BlockTimeout       time.Duration
+	// unacked single msgs kept per channel for redelivery, 0 disable it
+	AckWindow     int
+	AckTimeout    time.Duration
+	AckMaxRetries int
+	// a dropped session can be resumed within ResumeGrace, the last ResumeBuffer msgs are replayed
+	ResumeGrace  time.Duration
+	ResumeBuffer int
+	RateLimit    RateLimitOptions
+	// the same room signal of a user is relayed once per SignalInterval
+	SignalInterval time.Duration
+	Admission      AdmissionOptions
+	// ws and tcp writers coalesce the msgs queued within BatchWindow, up to BatchBytes, into one write, 0 disable it
+	BatchWindow time.Duration
+	BatchBytes  int
+	// permessage-deflate if the client offers it, for frames of at least CompressionThreshold bytes
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+	// reject websocket upgrades without a valid auth token
+	RequireUpgradeAuth bool
+	// tcp only, ping every HeartbeatInterval, close a conn that sent a heartbeat once after
+	// HeartbeatMisses pings without an inbound frame
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+	// http only, a long poll waits up to PollTimeout, a session with no poll for PollIdle is closed
+	PollTimeout  time.Duration
+	PollIdle     time.Duration
+	SseKeepAlive time.Duration
 }
 
 func NewServer(b []*Bucket, o Operator, options ServerOptions) *Server {
@@ -40,6 +74,8 @@ func NewServer(b []*Bucket, o Operator, options ServerOptions) *Server {
 	s.Options = options
 	s.bucketIdx = uint32(len(b))
 	s.operator = o
+	s.sessions = make(map[string]*Channel)
+	s.admission = newAdmission(options.Admission)
 	return s
 }
 
@@ -53,30 +89,37 @@ func (s *Server) Bucket(userId int) *Bucket {
 func (s *Server) writePump(ch *Channel, c *Connect) {
 	//PingPeriod default eq 54s
 	ticker := time.NewTicker(s.Options.PingPeriod)
+	redeliverC, stopRedeliver := ch.acks.redeliverTicker()
 	defer func() {
 		ticker.Stop()
+		stopRedeliver()
 		ch.conn.Close()
 	}()
+	// legacy conns only get bodies, they can not unpack a batch
+	batch := s.Options.BatchWindow > 0 && wsFormat(ch.conn) != ""
 
 	for {
 		select {
-		case message, ok := <-ch.broadcast:
-			//write data dead time , like http timeout , default 10s
-			ch.conn.SetWriteDeadline(time.Now().Add(s.Options.WriteWait))
-			if !ok {
-				logrus.Warn("SetWriteDeadline not ok")
-				ch.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			w, err := ch.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				logrus.Warnf(" ch.conn.NextWriter err :%s  ", err.Error())
-				return
+		case <-ch.wake:
+			// control msgs first, then system snapshots, then chat
+			var ok bool
+			if batch {
+				ok = ch.writeBatched(s.Options.BatchWindow, s.Options.BatchBytes, func(messages []*proto.Msg) error {
+					ch.conn.SetWriteDeadline(time.Now().Add(s.Options.WriteWait))
+					return s.writeWsBatch(ch, messages)
+				})
+			} else {
+				ok = ch.writeQueued(func(message *proto.Msg) error {
+					//write data dead time , like http timeout , default 10s
+					ch.conn.SetWriteDeadline(time.Now().Add(s.Options.WriteWait))
+					return s.writeWsMsg(ch, message)
+				})
 			}
-			w.Write(message.Body)
-			if err := w.Close(); err != nil {
+			if !ok {
 				return
 			}
+		case <-redeliverC:
+			s.redeliver(ch)
 		case <-ticker.C:
 			//heartbeat，if ping error will exit and close current websocket conn
 			ch.conn.SetWriteDeadline(time.Now().Add(s.Options.WriteWait))
@@ -89,22 +132,63 @@ func (s *Server) writePump(ch *Channel, c *Connect) {
 	}
 }
 
+// writeWsMsg write a msg in the format of the conn, a msg shared by many conns is encoded once,
+// frames under the compression threshold are sent uncompressed. return error if the conn is broken
+func (s *Server) writeWsMsg(ch *Channel, msg *proto.Msg) error {
+	subprotocol := wsFormat(ch.conn)
+	if msg.Frames != nil {
+		frame, err := preparedWsFrame(subprotocol, msg)
+		if err != nil {
+			logrus.Warnf("preparedWsFrame op=%d err:%s", msg.Operation, err.Error())
+			return nil
+		}
+		ch.conn.EnableWriteCompression(frame.size >= s.Options.CompressionThreshold)
+		return ch.conn.WritePreparedMessage(frame.prepared)
+	}
+	messageType, data, err := encodeWsFrame(subprotocol, msg)
+	if err != nil {
+		logrus.Warnf("encodeWsFrame op=%d err:%s", msg.Operation, err.Error())
+		return nil
+	}
+	return s.writeWsData(ch, messageType, data)
+}
+
+// writeWsData write an encoded frame, compressed if it is at least the compression threshold
+func (s *Server) writeWsData(ch *Channel, messageType int, data []byte) error {
+	ch.conn.EnableWriteCompression(len(data) >= s.Options.CompressionThreshold)
+	w, err := ch.conn.NextWriter(messageType)
+	if err != nil {
+		logrus.Warnf(" ch.conn.NextWriter err :%s  ", err.Error())
+		return err
+	}
+	w.Write(data)
+	return w.Close()
+}
+
+// deviceIdOrNew give a conn without a client chosen deviceId its own device
+func deviceIdOrNew(deviceId string) string {
+	if deviceId == "" {
+		return uuid.New().String()
+	}
+	return deviceId
+}
+
 func (s *Server) readPump(ch *Channel, c *Connect) {
+	// a client closing with a normal close frame ends its session, other drops may resume
+	cleanClose := false
 	defer func() {
-		atomic.AddInt64(&activeConnections, -1)
-		close(ch.done)
-		if ch.Room == nil || ch.userId == 0 {
-			logrus.Debugf("readPump closing: roomId or userId is 0")
+		s.releaseConn(ch)
+		if ch.userId == 0 {
+			close(ch.done)
+			logrus.Debugf("readPump closing: userId is 0")
 			ch.conn.Close()
 			return
 		}
-		logrus.Debugf("readPump exec disConnect userId=%d roomId=%d", ch.userId, ch.Room.Id)
-		disConnectRequest := new(proto.DisConnectRequest)
-		disConnectRequest.RoomId = ch.Room.Id
-		disConnectRequest.UserId = ch.userId
-		s.Bucket(ch.userId).DeleteChannel(ch)
-		if err := s.operator.DisConnect(disConnectRequest); err != nil {
-			logrus.Warnf("DisConnect err :%s", err.Error())
+		// detach before closing done, so no msg pushed meanwhile is lost
+		detached := !cleanClose && s.detach(ch, c.ServerId)
+		close(ch.done)
+		if !detached {
+			s.disconnect(ch, c.ServerId)
 		}
 		ch.conn.Close()
 	}()
@@ -122,21 +206,41 @@ func (s *Server) readPump(ch *Channel, c *Connect) {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logrus.Errorf("readPump ReadMessage err:%s", err.Error())
 			}
+			cleanClose = websocket.IsCloseError(err, websocket.CloseNormalClosure)
 			return
 		}
 		if message == nil {
 			return
 		}
-		var connReq *proto.ConnectRequest
-		if err := json.Unmarshal([]byte(message), &connReq); err != nil {
-			logrus.Errorf("message struct %+v", connReq)
+		clientOp, connReq, err := decodeWsFrame(wsFormat(ch.conn), message)
+		if err != nil {
+			logrus.Errorf("decodeWsFrame err:%s", err.Error())
+		}
+		if clientOp != nil {
+			s.dispatchClientOp(ch, clientOp)
+			continue
+		}
+		if ch.userId != 0 {
+			logrus.Warnf("connect frame on the conn of userId=%d, close", ch.userId)
+			ch.closeConnected()
+			return
+		}
+		if !s.allowConnect(ch, "") {
+			continue
+		}
+		if connReq != nil && connReq.AuthToken == "" {
+			connReq.AuthToken = ch.authToken
 		}
 		if connReq == nil || connReq.AuthToken == "" {
 			logrus.Errorf("s.operator.Connect no authToken")
 			return
 		}
 		connReq.ServerId = c.ServerId //config.Conf.Connect.ConnectWebsocket.ServerId
-		userId, err := s.operator.Connect(connReq)
+		if connReq.ResumeToken != "" && s.resume(ch, connReq) {
+			continue
+		}
+		connReq.DeviceId = deviceIdOrNew(connReq.DeviceId)
+		userId, userName, err := s.operator.Connect(connReq)
 		if err != nil {
 			logrus.Errorf("s.operator.Connect error %s", err.Error())
 			// Send proper close frame before closing connection
@@ -153,12 +257,25 @@ func (s *Server) readPump(ch *Channel, c *Connect) {
 			return
 		}
 		logrus.Debugf("websocket rpc call return userId:%d,RoomId:%d", userId, connReq.RoomId)
-		b := s.Bucket(userId)
+		ch.userName = userName
 		//insert into a bucket
-		err = b.Put(userId, connReq.RoomId, ch)
+		old, err := s.admitUser(ch, userId, connReq)
+		if old != nil {
+			old.closeReplaced()
+			s.dropSession(old, c.ServerId)
+		}
+		if err == errMaxConnsPerUser {
+			ch.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+				time.Now().Add(time.Second))
+			return
+		}
 		if err != nil {
 			logrus.Errorf("conn close err: %s", err.Error())
 			ch.conn.Close()
+			continue
 		}
+		s.startSession(ch)
+		s.pushOfflineMsg(ch, 0)
 	}
 }
@@ -0,0 +1,538 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/pkg/origin"
+	"gochat/proto"
+)
+
+// sse and long poll transports, for clients behind proxies which break websocket upgrades.
+// a session is a Channel like a ws or tcp conn, so room and single pushes reach it through the
+// bucket. frames both ways are gochat.v1.json frames, the client sends its ops with the sid
+// it got when the session opened:
+//
+//	GET  /sse?token=&roomId=&deviceId=   text/event-stream, an open event then one msg per event
+//	POST /poll/connect                   body ConnectRequest, reply HttpSession
+//	GET  /poll?sid=                      wait up to PollTimeout for msgs, reply PollReply
+//	POST /send?sid=                      one client op, answered on the stream or by a poll
+//	POST /close?sid=                     end the session, it can not be resumed
+//
+// a session is connected to logic before the client gets its sid. the session goroutine is
+// then the read loop of a ws conn: it detaches or disconnects the channel at the end. the sse
+// request or the polls are its writer
+
+const (
+	transportSse  = "sse"
+	transportPoll = "poll"
+)
+
+// httpConn is the sse or long poll side of a Channel
+type httpConn struct {
+	transport string
+	sid       string
+	closed    chan struct{} // closed when the session ends, by the client or the server
+	closeOnce sync.Once
+	sendLock  sync.Mutex // client ops of a session are handled one at a time, like a read loop
+	clean     int32      // the client closed the session, no resume
+	polling   int32      // a long poll is waiting, only one at a time
+	lastPoll  int64      // unix nano of the end of the last long poll
+}
+
+func (h *httpConn) close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// idle is true if no long poll is waiting and the last one ended more than timeout ago
+func (h *httpConn) idle(now time.Time, timeout time.Duration) bool {
+	return atomic.LoadInt32(&h.polling) == 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&h.lastPoll))) > timeout
+}
+
+// httpTransport serve the sse and long poll sessions of the server
+type httpTransport struct {
+	s                *Server
+	c                *Connect
+	checkOrigin      func(r *http.Request) bool
+	allowCredentials bool
+	lock             sync.Mutex
+	sessions         map[string]*Channel // by sid
+}
+
+func newHttpTransport(s *Server, c *Connect, allowlist *origin.Allowlist, allowCredentials bool) *httpTransport {
+	return &httpTransport{
+		s:                s,
+		c:                c,
+		checkOrigin:      checkOrigin(allowlist),
+		allowCredentials: allowCredentials,
+		sessions:         make(map[string]*Channel),
+	}
+}
+
+func (c *Connect) InitHttpServer() error {
+	cors := config.Conf.Common.CommonCors
+	t := newHttpTransport(DefaultServer, c, origin.New(cors.AllowedOrigins), cors.AllowCredentials)
+	srv := &http.Server{
+		Addr:              config.Conf.Connect.ConnectHttp.Bind,
+		Handler:           t.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    4096,
+		// no WriteTimeout, streams and polls are long, every sse write has its own deadline
+	}
+	c.lock.Lock()
+	c.httpServer = srv
+	c.lock.Unlock()
+
+	if c.tlsConfig != nil {
+		srv.TLSConfig = c.tlsConfig
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+func (t *httpTransport) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sse", t.cors(http.MethodGet, t.serveSse))
+	mux.HandleFunc("/poll/connect", t.cors(http.MethodPost, t.pollConnect))
+	mux.HandleFunc("/poll", t.cors(http.MethodGet, t.poll))
+	mux.HandleFunc("/send", t.cors(http.MethodPost, t.send))
+	mux.HandleFunc("/close", t.cors(http.MethodPost, t.closeSession))
+	return mux
+}
+
+// cors check the Origin like a websocket upgrade, answer preflights and reject other methods
+func (t *httpTransport) cors(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !t.checkOrigin(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		h := w.Header()
+		if requestOrigin := r.Header.Get("Origin"); requestOrigin != "" {
+			h.Set("Access-Control-Allow-Origin", requestOrigin)
+			h.Add("Vary", "Origin")
+			if t.allowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if r.Method == http.MethodOptions {
+			h.Set("Access-Control-Allow-Methods", method)
+			h.Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != method {
+			h.Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize check the auth token before any session resource is used, on false the request
+// is already answered with 401. unlike a ws upgrade the token is required, the session has
+// no connect frame to send it later
+func (t *httpTransport) authorize(w http.ResponseWriter, r *http.Request, authToken string) bool {
+	if authToken == "" {
+		http.Error(w, "auth token required", http.StatusUnauthorized)
+		return false
+	}
+	userId, _, err := t.s.operator.CheckAuth(authToken)
+	if err != nil || userId == 0 {
+		logrus.Infof("http session auth fail from %s", r.RemoteAddr)
+		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// newChannel create the channel of a new admitted session and register its sid
+func (t *httpTransport) newChannel(transport, ip string) *Channel {
+	s := t.s
+	ch := NewChannel(s.Options.BroadcastSize, s.Options.SlowConsumerPolicy, s.Options.BlockTimeout)
+	ch.acks = newAckWindow(s.Options.AckWindow, s.Options.AckTimeout, s.Options.AckMaxRetries)
+	ch.replay = newReplayBuffer(s.Options.ResumeBuffer)
+	ch.http = &httpConn{
+		transport: transport,
+		sid:       uuid.New().String(),
+		closed:    make(chan struct{}),
+		lastPoll:  time.Now().UnixNano(),
+	}
+	ch.admitted(ip)
+	t.lock.Lock()
+	t.sessions[ch.http.sid] = ch
+	t.lock.Unlock()
+	return ch
+}
+
+// session find the channel of the sid, on nil the request is already answered with 410
+func (t *httpTransport) session(w http.ResponseWriter, r *http.Request) *Channel {
+	t.lock.Lock()
+	ch := t.sessions[r.URL.Query().Get("sid")]
+	t.lock.Unlock()
+	if ch == nil {
+		http.Error(w, "unknown or closed session", http.StatusGone)
+	}
+	return ch
+}
+
+// serve is the session goroutine of an opened session, it pushes the session info with the
+// replay or the offline msgs, resends unacked msgs and closes a long poll session nobody polls any more
+func (t *httpTransport) serve(ch *Channel, connReq *proto.ConnectRequest, resumed bool) {
+	defer t.teardown(ch)
+	if resumed {
+		t.s.resumed(ch, connReq.LastSeq)
+	} else {
+		t.s.startSession(ch)
+		t.s.pushOfflineMsg(ch, 0)
+	}
+	redeliverC, stopRedeliver := ch.acks.redeliverTicker()
+	defer stopRedeliver()
+	var idleC <-chan time.Time
+	if ch.http.transport == transportPoll && t.s.Options.PollIdle > 0 {
+		idle := time.NewTicker(t.s.Options.PollIdle / 2)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+	for {
+		select {
+		case <-ch.http.closed:
+			return
+		case <-redeliverC:
+			t.s.redeliver(ch)
+		case now := <-idleC:
+			if ch.http.idle(now, t.s.Options.PollIdle) {
+				logrus.Debugf("long poll session of userId=%d idle, close", ch.userId)
+				return
+			}
+		}
+	}
+}
+
+// open take over the session of the resume token or connect the channel to logic, before
+// the client gets a sid. the msgs of the session are pushed by serve, the writer of a sse
+// stream or of the polls is not running yet. on false the request is already answered and
+// the session torn down
+func (t *httpTransport) open(w http.ResponseWriter, ch *Channel, connReq *proto.ConnectRequest) (resumed bool, ok bool) {
+	s := t.s
+	connReq.ServerId = t.c.ServerId
+	if connReq.ResumeToken != "" && s.takeOver(ch, connReq) {
+		return true, true
+	}
+	defer func() {
+		if !ok {
+			t.teardown(ch)
+		}
+	}()
+	connReq.DeviceId = deviceIdOrNew(connReq.DeviceId)
+	userId, userName, err := s.operator.Connect(connReq)
+	if err != nil {
+		logrus.Errorf("%s s.operator.Connect error %s", ch.http.transport, err.Error())
+		http.Error(w, "connect fail", http.StatusServiceUnavailable)
+		return
+	}
+	if userId == 0 {
+		logrus.Errorf("%s Invalid AuthToken ,userId empty", ch.http.transport)
+		http.Error(w, "invalid auth token", http.StatusUnauthorized)
+		return
+	}
+	ch.userName = userName
+	old, err := s.admitUser(ch, userId, connReq)
+	if old != nil {
+		old.closeReplaced()
+		s.dropSession(old, t.c.ServerId)
+	}
+	if err == errMaxConnsPerUser {
+		refuse(w, RejectMaxPerUser)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("%s conn put room err: %s", ch.http.transport, err.Error())
+		http.Error(w, "join room fail", http.StatusServiceUnavailable)
+		return
+	}
+	return false, true
+}
+
+// teardown end the session, sse and long poll have no close handshake,
+// so only POST /close keeps a session from being detached for resume
+func (t *httpTransport) teardown(ch *Channel) {
+	ch.http.close()
+	t.lock.Lock()
+	delete(t.sessions, ch.http.sid)
+	t.lock.Unlock()
+	t.s.releaseConn(ch)
+	if ch.userId == 0 {
+		close(ch.done)
+		return
+	}
+	detached := atomic.LoadInt32(&ch.http.clean) == 0 && t.s.detach(ch, t.c.ServerId)
+	close(ch.done)
+	if !detached {
+		t.s.disconnect(ch, t.c.ServerId)
+	}
+}
+
+// sseConnectRequest read the connect request of a sse stream from its query, the token
+// may also be in the gochat_token cookie. an EventSource reconnecting by itself sends
+// Last-Event-ID, it is used as lastSeq when the stream resumes a session
+func sseConnectRequest(r *http.Request) (*proto.ConnectRequest, error) {
+	q := r.URL.Query()
+	connReq := &proto.ConnectRequest{
+		AuthToken:   upgradeAuthToken(r),
+		DeviceId:    q.Get("deviceId"),
+		ResumeToken: q.Get("resumeToken"),
+		LastSeq:     q.Get("lastSeq"),
+	}
+	if connReq.LastSeq == "" {
+		connReq.LastSeq = r.Header.Get("Last-Event-ID")
+	}
+	if roomId := q.Get("roomId"); roomId != "" {
+		var err error
+		if connReq.RoomId, err = strconv.Atoi(roomId); err != nil {
+			return nil, err
+		}
+	}
+	return connReq, nil
+}
+
+func (t *httpTransport) serveSse(w http.ResponseWriter, r *http.Request) {
+	if t.c.isDraining() {
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	connReq, err := sseConnectRequest(r)
+	if err != nil {
+		http.Error(w, "bad roomId", http.StatusBadRequest)
+		return
+	}
+	ip := t.s.Options.Admission.requestIp(r)
+	if reason := t.s.admitConn(transportSse, ip); reason != "" {
+		refuse(w, reason)
+		return
+	}
+	if !t.authorize(w, r, connReq.AuthToken) {
+		t.s.release(transportSse, ip)
+		return
+	}
+	ch := t.newChannel(transportSse, ip)
+	resumed, ok := t.open(w, ch, connReq)
+	if !ok {
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx must not buffer the stream
+	w.WriteHeader(http.StatusOK)
+	go t.serve(ch, connReq, resumed)
+	// the client gone or a failed write end the session, the session goroutine detaches it
+	defer ch.http.close()
+
+	rc := http.NewResponseController(w)
+	open, _ := json.Marshal(proto.HttpSession{Sid: ch.http.sid})
+	if err := t.writeSse(w, rc, "open", "", open); err != nil {
+		return
+	}
+	keepAlive := t.s.Options.SseKeepAlive
+	if keepAlive <= 0 {
+		keepAlive = t.s.Options.PingPeriod
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch.wake:
+			if !ch.writeQueued(func(message *proto.Msg) error {
+				data, err := httpFrame(message)
+				if err != nil {
+					logrus.Warnf("sse encode op=%d err:%s", message.Operation, err.Error())
+					return nil
+				}
+				return t.writeSse(w, rc, "", message.SeqId, data)
+			}) {
+				return
+			}
+		case <-ticker.C:
+			// a comment line, keeps proxies from closing an idle stream
+			if err := t.writeSse(w, rc, "", "", nil); err != nil {
+				return
+			}
+		case <-ch.http.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSse write one event and flush it, a nil data is a keep alive comment.
+// data is a json frame, it never has a new line
+func (t *httpTransport) writeSse(w io.Writer, rc *http.ResponseController, event, id string, data []byte) error {
+	_ = rc.SetWriteDeadline(time.Now().Add(t.s.Options.WriteWait))
+	var buf bytes.Buffer
+	if data == nil {
+		buf.WriteString(": ping\n\n")
+	} else {
+		if event != "" {
+			buf.WriteString("event: " + event + "\n")
+		}
+		if id != "" {
+			buf.WriteString("id: " + id + "\n")
+		}
+		buf.WriteString("data: ")
+		buf.Write(data)
+		buf.WriteString("\n\n")
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// httpFrame encode a msg as a gochat.v1.json frame
+func httpFrame(msg *proto.Msg) ([]byte, error) {
+	_, data, err := encodeWsFrame(envelope.SubprotocolJSON, msg)
+	return data, err
+}
+
+func (t *httpTransport) pollConnect(w http.ResponseWriter, r *http.Request) {
+	if t.c.isDraining() {
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	connReq := new(proto.ConnectRequest)
+	if err := json.NewDecoder(io.LimitReader(r.Body, t.s.Options.MaxMessageSize)).Decode(connReq); err != nil {
+		http.Error(w, "bad connect request", http.StatusBadRequest)
+		return
+	}
+	if connReq.AuthToken == "" {
+		connReq.AuthToken = upgradeAuthToken(r)
+	}
+	ip := t.s.Options.Admission.requestIp(r)
+	if reason := t.s.admitConn(transportPoll, ip); reason != "" {
+		refuse(w, reason)
+		return
+	}
+	if !t.authorize(w, r, connReq.AuthToken) {
+		t.s.release(transportPoll, ip)
+		return
+	}
+	ch := t.newChannel(transportPoll, ip)
+	resumed, ok := t.open(w, ch, connReq)
+	if !ok {
+		return
+	}
+	go t.serve(ch, connReq, resumed)
+	writeJson(w, proto.HttpSession{Sid: ch.http.sid})
+}
+
+// poll wait for the first msg up to PollTimeout, then take the msgs queued in lane order without waiting
+func (t *httpTransport) poll(w http.ResponseWriter, r *http.Request) {
+	ch := t.session(w, r)
+	if ch == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&ch.http.polling, 0, 1) {
+		http.Error(w, "poll in progress", http.StatusConflict)
+		return
+	}
+	defer func() {
+		atomic.StoreInt64(&ch.http.lastPoll, time.Now().UnixNano())
+		atomic.StoreInt32(&ch.http.polling, 0)
+	}()
+	timer := time.NewTimer(t.s.Options.PollTimeout)
+	defer timer.Stop()
+	var msgs []*proto.Msg
+	for len(msgs) == 0 {
+		select {
+		case <-ch.wake:
+		case <-timer.C:
+			writeJson(w, proto.PollReply{Msgs: []json.RawMessage{}})
+			return
+		case <-ch.http.closed:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		// in lane order, at most a queue of msgs per poll
+		for len(msgs) < cap(ch.control)+cap(ch.broadcast) {
+			message := ch.dequeue()
+			if message == nil {
+				break
+			}
+			msgs = append(msgs, message)
+		}
+	}
+	if ch.priorityQueued()+len(ch.broadcast) > 0 {
+		// left for the next poll
+		ch.wakeWriter()
+	}
+	reply := proto.PollReply{Msgs: make([]json.RawMessage, 0, len(msgs))}
+	for _, message := range msgs {
+		data, err := httpFrame(message)
+		if err != nil {
+			logrus.Warnf("poll encode op=%d err:%s", message.Operation, err.Error())
+			continue
+		}
+		reply.Msgs = append(reply.Msgs, data)
+	}
+	writeJson(w, reply)
+	for _, message := range msgs {
+		if ch.closeAfterWrite(message) {
+			return
+		}
+	}
+}
+
+func (t *httpTransport) send(w http.ResponseWriter, r *http.Request) {
+	ch := t.session(w, r)
+	if ch == nil {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, t.s.Options.MaxMessageSize+1))
+	if err != nil {
+		http.Error(w, "read body fail", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > t.s.Options.MaxMessageSize {
+		http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	clientOp, _, err := decodeWsFrame(envelope.SubprotocolJSON, body)
+	if err != nil || clientOp == nil {
+		http.Error(w, "bad frame", http.StatusBadRequest)
+		return
+	}
+	ch.http.sendLock.Lock()
+	t.s.dispatchClientOp(ch, clientOp)
+	ch.http.sendLock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (t *httpTransport) closeSession(w http.ResponseWriter, r *http.Request) {
+	ch := t.session(w, r)
+	if ch == nil {
+		return
+	}
+	atomic.StoreInt32(&ch.http.clean, 1)
+	ch.http.close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
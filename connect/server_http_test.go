@@ -0,0 +1,216 @@
+package connect
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/pkg/origin"
+	"gochat/proto"
+)
+
+// httpOperator connect the token "good" as user 1 and report disconnects
+type httpOperator struct {
+	Operator
+	disconnected chan int
+}
+
+func (o *httpOperator) CheckAuth(authToken string) (int, string, error) {
+	if authToken == "good" {
+		return 1, "one", nil
+	}
+	return 0, "", nil
+}
+
+func (o *httpOperator) Connect(connReq *proto.ConnectRequest) (int, string, error) {
+	return o.CheckAuth(connReq.AuthToken)
+}
+
+func (o *httpOperator) GetOfflineMsg(req *proto.OfflineMsgRequest) (*proto.OfflineMsgReply, error) {
+	return &proto.OfflineMsgReply{}, nil
+}
+
+func (o *httpOperator) DisConnect(req *proto.DisConnectRequest) error {
+	o.disconnected <- req.UserId
+	return nil
+}
+
+func newHttpTestServer(t *testing.T, admission AdmissionOptions) (*Server, *httpOperator, *httptest.Server) {
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})}, o, ServerOptions{
+		WriteWait:      time.Second,
+		MaxMessageSize: 512,
+		BroadcastSize:  8,
+		PollTimeout:    time.Second,
+		SseKeepAlive:   time.Minute,
+		Admission:      admission,
+	})
+	tr := newHttpTransport(s, &Connect{ServerId: "http-test"}, origin.New([]string{"https://chat.example.com"}), false)
+	ts := httptest.NewServer(tr.handler())
+	t.Cleanup(ts.Close)
+	return s, o, ts
+}
+
+// waitChannel wait for the session of user 1 to be connected
+func waitChannel(t *testing.T, s *Server) *Channel {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if chs := s.Bucket(1).Channels(1); len(chs) > 0 {
+			return chs[0]
+		}
+	}
+	t.Fatal("session not connected")
+	return nil
+}
+
+func waitDisconnect(t *testing.T, o *httpOperator) {
+	t.Helper()
+	select {
+	case <-o.disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("session not disconnected")
+	}
+}
+
+func post(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestLongPoll(t *testing.T) {
+	s, o, ts := newHttpTestServer(t, AdmissionOptions{})
+	if resp := post(t, ts.URL+"/poll/connect", `{"authToken":"bad","roomId":7}`); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad token got %d, want 401", resp.StatusCode)
+	}
+	resp := post(t, ts.URL+"/poll/connect", `{"authToken":"good","roomId":7}`)
+	var sess proto.HttpSession
+	if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil || sess.Sid == "" {
+		t.Fatalf("connect reply err %v", err)
+	}
+	resp.Body.Close()
+
+	// an unknown op is answered by a OpReply, the reply and the push come with the next poll
+	if resp := post(t, ts.URL+"/send?sid="+sess.Sid, `{"ver":1,"op":99,"seq":"s1"}`); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("send got %d", resp.StatusCode)
+	}
+	ch := waitChannel(t, s)
+	if !ch.InRoom(7) || ch.http.transport != transportPoll {
+		t.Error("poll session should be in room 7")
+	}
+	ch.Push(&proto.Msg{Ver: 1, Operation: config.OpSingleSend, SeqId: "m1", Body: []byte(`{"msg":"hi"}`)})
+
+	resp, err := http.Get(ts.URL + "/poll?sid=" + sess.Sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply proto.PollReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var ops []int
+	for _, data := range reply.Msgs {
+		frame, err := envelope.DecodeJSON(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, frame.Op)
+	}
+	if len(ops) != 2 || ops[0] != config.OpReply || ops[1] != config.OpSingleSend {
+		t.Errorf("polled ops %v, want reply then single msg", ops)
+	}
+
+	if resp := post(t, ts.URL+"/close?sid="+sess.Sid, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("close got %d", resp.StatusCode)
+	}
+	waitDisconnect(t, o)
+	resp, _ = http.Get(ts.URL + "/poll?sid=" + sess.Sid)
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("poll of closed session got %d, want 410", resp.StatusCode)
+	}
+}
+
+func TestSse(t *testing.T) {
+	s, o, ts := newHttpTestServer(t, AdmissionOptions{})
+	resp, err := http.Get(ts.URL + "/sse?token=good&roomId=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() (lines []string) {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line = strings.TrimSuffix(line, "\n"); line == "" {
+				return
+			}
+			lines = append(lines, line)
+		}
+	}
+	if open := readEvent(); len(open) != 2 || open[0] != "event: open" || !strings.Contains(open[1], `"sid"`) {
+		t.Errorf("open event %q", open)
+	}
+	ch := waitChannel(t, s)
+	ch.Push(&proto.Msg{Ver: 1, Operation: config.OpSingleSend, SeqId: "m1", Body: []byte(`{"msg":"hi"}`)})
+	if msg := readEvent(); len(msg) != 2 || msg[0] != "id: m1" || msg[1] != `data: {"ver":1,"op":2,"seq":"m1","body":{"msg":"hi"}}` {
+		t.Errorf("msg event %q", msg)
+	}
+	// the client going away ends the session
+	resp.Body.Close()
+	waitDisconnect(t, o)
+}
+
+func TestHttpOpenRefused(t *testing.T) {
+	_, o, ts := newHttpTestServer(t, AdmissionOptions{MaxConnsPerUser: 1})
+	resp := post(t, ts.URL+"/poll/connect", `{"authToken":"good","roomId":7,"deviceId":"a"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first session got %d", resp.StatusCode)
+	}
+	// the session of another device is over the per user cap, the client gets no sid or stream
+	resp = post(t, ts.URL+"/poll/connect", `{"authToken":"good","roomId":7,"deviceId":"b"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("poll session over the cap got %d, want 429", resp.StatusCode)
+	}
+	waitDisconnect(t, o)
+	if resp, err := http.Get(ts.URL + "/sse?token=good&roomId=7&deviceId=c"); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("sse over the cap got %v err %v, want 429", resp.StatusCode, err)
+	} else if ct := resp.Header.Get("Content-Type"); ct == "text/event-stream" {
+		t.Error("refused sse should not open a stream")
+	}
+}
+
+func TestHttpCors(t *testing.T) {
+	_, _, ts := newHttpTestServer(t, AdmissionOptions{})
+	req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/send", nil)
+	req.Header.Set("Origin", "https://chat.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://chat.example.com" {
+		t.Errorf("preflight got %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/sse?token=good", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	if resp, err = http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other origin got %v err %v, want 403", resp.StatusCode, err)
+	}
+}
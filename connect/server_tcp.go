@@ -5,17 +5,17 @@
 package connect
 
 import (
-	"bufio"
-	"bytes"
-	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"encoding/json"
+	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"gochat/api/rpc"
 	"gochat/config"
+	"gochat/pkg/metrics"
 	"gochat/pkg/stickpackage"
 	"gochat/proto"
 
@@ -24,10 +24,6 @@ import (
 
 const maxInt = 1<<31 - 1
 
-func init() {
-	rpc.InitLogicRpcClient()
-}
-
 func (c *Connect) InitTcpServer() error {
 	aTcpAddr := strings.Split(config.Conf.Connect.ConnectTcp.Bind, ",")
 	cpuNum := config.Conf.Connect.ConnectBucket.CpuNum
@@ -36,6 +32,9 @@ func (c *Connect) InitTcpServer() error {
 		listener *net.TCPListener
 		err      error
 	)
+	if config.Conf.Connect.ConnectTcp.Netpoll {
+		c.initNetpoll(cpuNum)
+	}
 	for _, ipPort := range aTcpAddr {
 		if addr, err = net.ResolveTCPAddr("tcp", ipPort); err != nil {
 			logrus.Errorf("server_tcp ResolveTCPAddr error:%s", err.Error())
@@ -45,6 +44,7 @@ func (c *Connect) InitTcpServer() error {
 			logrus.Errorf("net.ListenTCP(tcp, %s),error(%v)", ipPort, err)
 			return err
 		}
+		c.addTcpListener(listener)
 		logrus.Infof("start tcp listen at:%s", ipPort)
 		// cpu core num
 		for i := 0; i < cpuNum; i++ {
@@ -54,6 +54,21 @@ func (c *Connect) InitTcpServer() error {
 	return nil
 }
 
+// initNetpoll serve the tcp conns from event loops, a goroutine per conn is kept if they can not be used
+func (c *Connect) initNetpoll(loops int) {
+	if c.tlsConfig != nil {
+		logrus.Warnf("netpoll does not serve tls conns, keep a goroutine per conn")
+		return
+	}
+	np, err := newNetpoll(c, DefaultServer, loops, config.Conf.Connect.ConnectTcp.MaxFrameSize)
+	if err != nil {
+		logrus.Errorf("netpoll start err:%s, keep a goroutine per conn", err.Error())
+		return
+	}
+	c.netpoll = np
+	logrus.Infof("tcp conns served by %d netpoll loops", loops)
+}
+
 func (c *Connect) acceptTcp(listener *net.TCPListener) {
 	var (
 		conn *net.TCPConn
@@ -63,6 +78,9 @@ func (c *Connect) acceptTcp(listener *net.TCPListener) {
 	connectTcpConfig := config.Conf.Connect.ConnectTcp
 	for {
 		if conn, err = listener.AcceptTCP(); err != nil {
+			if c.isDraining() {
+				return
+			}
 			logrus.Errorf("listener.Accept(\"%s\") error(%v)", listener.Addr().String(), err)
 			return
 		}
@@ -81,7 +99,22 @@ func (c *Connect) acceptTcp(listener *net.TCPListener) {
 			logrus.Errorf("conn.SetWriteBuffer() error:%s", err.Error())
 			return
 		}
-		go c.ServeTcp(DefaultServer, conn, r)
+		if reason := DefaultServer.admitConn("tcp", addrIp(conn.RemoteAddr().String())); reason != "" {
+			_ = conn.Close()
+			continue
+		}
+		if c.netpoll != nil {
+			if err = c.netpoll.serve(conn); err != nil {
+				logrus.Errorf("netpoll serve conn err:%s", err.Error())
+			}
+			continue
+		}
+		var netConn net.Conn = conn
+		if c.tlsConfig != nil {
+			// the handshake runs on the first read of the conn
+			netConn = tls.Server(conn, c.tlsConfig)
+		}
+		go c.ServeTcp(DefaultServer, netConn, r)
 		if r++; r == maxInt {
 			logrus.Infof("conn.acceptTcp num is:%d", r)
 			r = 0
@@ -89,158 +122,197 @@ func (c *Connect) acceptTcp(listener *net.TCPListener) {
 	}
 }
 
-func (c *Connect) ServeTcp(server *Server, conn *net.TCPConn, r int) {
+func (c *Connect) ServeTcp(server *Server, conn net.Conn, r int) {
 	var ch *Channel
-	ch = NewChannel(server.Options.BroadcastSize)
+	ch = NewChannel(server.Options.BroadcastSize, server.Options.SlowConsumerPolicy, server.Options.BlockTimeout)
+	ch.acks = newAckWindow(server.Options.AckWindow, server.Options.AckTimeout, server.Options.AckMaxRetries)
+	ch.replay = newReplayBuffer(server.Options.ResumeBuffer)
 	ch.connTcp = conn
+	ch.admitted(addrIp(conn.RemoteAddr().String()))
 	go c.writeDataToTcp(server, ch)
 	go c.readDataFromTcp(server, ch)
 }
 
 func (c *Connect) readDataFromTcp(s *Server, ch *Channel) {
-	defer func() {
-		close(ch.done)
-		logrus.Infof("start exec disConnect ...")
-		if ch.Room == nil || ch.userId == 0 {
-			logrus.Infof("roomId and userId eq 0")
-			_ = ch.connTcp.Close()
-			return
-		}
-		logrus.Infof("exec disConnect ...")
-		disConnectRequest := new(proto.DisConnectRequest)
-		disConnectRequest.RoomId = ch.Room.Id
-		disConnectRequest.UserId = ch.userId
-		s.Bucket(ch.userId).DeleteChannel(ch)
-		if err := s.operator.DisConnect(disConnectRequest); err != nil {
-			logrus.Warnf("DisConnect rpc err :%s", err.Error())
-		}
-		if err := ch.connTcp.Close(); err != nil {
-			logrus.Warnf("DisConnect close tcp conn err :%s", err.Error())
-		}
-		return
-	}()
-	// scanner
-	scannerPackage := bufio.NewScanner(ch.connTcp)
-	scannerPackage.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if !atEOF && data[0] == 'v' {
-			if len(data) > stickpackage.TcpHeaderLength {
-				packSumLength := int16(0)
-				_ = binary.Read(bytes.NewReader(data[stickpackage.LengthStartIndex:stickpackage.LengthStopIndex]), binary.BigEndian, &packSumLength)
-				if int(packSumLength) <= len(data) {
-					return int(packSumLength), data[:packSumLength], nil
-				}
-			}
-		}
-		return
-	})
-	scanTimes := 0
+	defer c.closeTcp(s, ch)
+	decoder := stickpackage.NewDecoder(ch.connTcp, config.Conf.Connect.ConnectTcp.MaxFrameSize)
 	for {
-		scanTimes++
-		if scanTimes > 3 {
-			logrus.Infof("scannedPack times is:%d", scanTimes)
-			break
-		}
-		for scannerPackage.Scan() {
-			scannedPack := new(stickpackage.StickPackage)
-			err := scannedPack.Unpack(bytes.NewReader(scannerPackage.Bytes()))
-			if err != nil {
-				logrus.Errorf("scan tcp package err:%s", err.Error())
-				break
-			}
-			//get a full package
-			var connReq proto.ConnectRequest
-			logrus.Infof("get a tcp message :%s", scannedPack)
-			var rawTcpMsg proto.SendTcp
-			if err := json.Unmarshal([]byte(scannedPack.Msg), &rawTcpMsg); err != nil {
-				logrus.Errorf("tcp message struct %+v", rawTcpMsg)
-				break
-			}
-			logrus.Infof("json unmarshal,raw tcp msg is:%+v", rawTcpMsg)
-			if rawTcpMsg.AuthToken == "" {
-				logrus.Errorf("tcp s.operator.Connect no authToken")
-				return
-			}
-			if rawTcpMsg.RoomId <= 0 {
-				logrus.Errorf("tcp roomId not allow lgt 0")
+		if readTimeout := s.heartbeatTimeout(ch); readTimeout > 0 {
+			// any frame counts as a heartbeat
+			_ = ch.connTcp.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		frame, err := decoder.Decode()
+		if err != nil {
+			if isTimeout(err) {
+				logrus.Infof("tcp conn userId=%d missed %d heartbeats, close", ch.userId, s.Options.HeartbeatMisses)
+				metrics.HeartbeatTimeoutsTotal.WithLabelValues("tcp").Inc()
 				return
 			}
-			switch rawTcpMsg.Op {
-			case config.OpBuildTcpConn:
-				connReq.AuthToken = rawTcpMsg.AuthToken
-				connReq.RoomId = rawTcpMsg.RoomId
-				//fix
-				//connReq.ServerId = config.Conf.Connect.ConnectTcp.ServerId
-				connReq.ServerId = c.ServerId
-				userId, err := s.operator.Connect(&connReq)
-				logrus.Infof("tcp s.operator.Connect userId is :%d", userId)
-				if err != nil {
-					logrus.Errorf("tcp s.operator.Connect error %s", err.Error())
-					return
-				}
-				if userId == 0 {
-					logrus.Error("tcp Invalid AuthToken ,userId empty")
-					return
-				}
-				b := s.Bucket(userId)
-				//insert into a bucket
-				err = b.Put(userId, connReq.RoomId, ch)
-				if err != nil {
-					logrus.Errorf("tcp conn put room err: %s", err.Error())
-					_ = ch.connTcp.Close()
-					return
-				}
-			case config.OpRoomSend:
-				//send tcp msg to room
-				req := &proto.Send{
-					Msg:          rawTcpMsg.Msg,
-					FromUserId:   rawTcpMsg.FromUserId,
-					FromUserName: rawTcpMsg.FromUserName,
-					RoomId:       rawTcpMsg.RoomId,
-					Op:           config.OpRoomSend,
-				}
-				code, msg := rpc.RpcLogicObj.PushRoom(context.Background(), req)
-				logrus.Infof("tcp conn push msg to room,err code is:%d,err msg is:%s", code, msg)
+			if err != io.EOF && atomic.LoadInt32(&ch.closedByServer) == 0 {
+				// a malformed frame can not be skipped, the stream is lost
+				logrus.Warnf("tcp read frame err:%s", err.Error())
 			}
+			return
 		}
-		if err := scannerPackage.Err(); err != nil {
-			logrus.Errorf("tcp get a err package:%s", err.Error())
+		if !c.handleTcpFrame(s, ch, frame) {
 			return
 		}
 	}
 }
 
+// closeTcp end a conn once its frames are read: release it, then detach its session or
+// disconnect it from logic
+func (c *Connect) closeTcp(s *Server, ch *Channel) {
+	s.releaseConn(ch)
+	logrus.Infof("start exec disConnect ...")
+	if ch.userId == 0 {
+		close(ch.done)
+		logrus.Infof("userId eq 0")
+		_ = ch.connTcp.Close()
+		return
+	}
+	logrus.Infof("exec disConnect ...")
+	// tcp has no close handshake, every drop of a conn with a session may resume
+	detached := s.detach(ch, c.ServerId)
+	close(ch.done)
+	if !detached {
+		s.disconnect(ch, c.ServerId)
+	}
+	if err := ch.connTcp.Close(); err != nil {
+		logrus.Warnf("DisConnect close tcp conn err :%s", err.Error())
+	}
+}
+
+// handleTcpFrame handle a frame of the client, false if the conn must be closed
+func (c *Connect) handleTcpFrame(s *Server, ch *Channel, frame *stickpackage.Frame) bool {
+	// the first frame picks the version of the conn, the server answers in it
+	if !atomic.CompareAndSwapInt32(&ch.tcpVersion, 0, int32(frame.Version)) &&
+		atomic.LoadInt32(&ch.tcpVersion) != int32(frame.Version) {
+		logrus.Warnf("tcp frame version changed to v%d", frame.Version)
+		return false
+	}
+	//get a full package
+	var connReq proto.ConnectRequest
+	logrus.Infof("get a tcp message v%d op:%d seq:%d msg:%s", frame.Version, frame.Op, frame.Seq, frame.Body)
+	var rawTcpMsg proto.SendTcp
+	if err := json.Unmarshal(frame.Body, &rawTcpMsg); err != nil {
+		logrus.Errorf("tcp message struct %+v", rawTcpMsg)
+		return false
+	}
+	// op and seq of a v2 header win over the body
+	if frame.Op != 0 {
+		rawTcpMsg.Op = int(frame.Op)
+	}
+	if frame.Seq != 0 {
+		rawTcpMsg.SeqId = strconv.FormatUint(frame.Seq, 10)
+	}
+	logrus.Infof("json unmarshal,raw tcp msg is:%+v", rawTcpMsg)
+	switch rawTcpMsg.Op {
+	case config.OpBuildTcpConn:
+		if atomic.LoadInt32(&ch.refused) == 1 {
+			return false
+		}
+		if ch.userId != 0 {
+			logrus.Warnf("tcp connect frame on the conn of userId=%d, close", ch.userId)
+			ch.closeConnected()
+			return false
+		}
+		if !s.allowConnect(ch, rawTcpMsg.SeqId) {
+			// closed by the limiter if it is over its violations
+			return atomic.LoadInt32(&ch.closedByServer) == 0
+		}
+		if rawTcpMsg.AuthToken == "" {
+			logrus.Errorf("tcp s.operator.Connect no authToken")
+			return false
+		}
+		if rawTcpMsg.ResumeToken != "" && s.resume(ch, &proto.ConnectRequest{
+			AuthToken:   rawTcpMsg.AuthToken,
+			ServerId:    c.ServerId,
+			ResumeToken: rawTcpMsg.ResumeToken,
+			LastSeq:     rawTcpMsg.LastSeq,
+		}) {
+			return true
+		}
+		if rawTcpMsg.RoomId <= 0 {
+			logrus.Errorf("tcp roomId not allow lgt 0")
+			return false
+		}
+		connReq.AuthToken = rawTcpMsg.AuthToken
+		connReq.RoomId = rawTcpMsg.RoomId
+		//fix
+		//connReq.ServerId = config.Conf.Connect.ConnectTcp.ServerId
+		connReq.ServerId = c.ServerId
+		connReq.DeviceId = deviceIdOrNew(rawTcpMsg.DeviceId)
+		userId, userName, err := s.operator.Connect(&connReq)
+		logrus.Infof("tcp s.operator.Connect userId is :%d", userId)
+		if err != nil {
+			logrus.Errorf("tcp s.operator.Connect error %s", err.Error())
+			return false
+		}
+		if userId == 0 {
+			logrus.Error("tcp Invalid AuthToken ,userId empty")
+			return false
+		}
+		ch.userName = userName
+		//insert into a bucket
+		old, err := s.admitUser(ch, userId, &connReq)
+		if old != nil {
+			old.closeReplaced()
+			s.dropSession(old, c.ServerId)
+		}
+		if err == errMaxConnsPerUser {
+			// the writer closes the conn once the client got the reason
+			s.refuseTcp(ch, rawTcpMsg.SeqId, err)
+			return true
+		}
+		if err != nil {
+			logrus.Errorf("tcp conn put room err: %s", err.Error())
+			_ = ch.connTcp.Close()
+			return false
+		}
+		s.startSession(ch)
+		s.pushOfflineMsg(ch, 0)
+	case config.OpPing, config.OpPong:
+		s.tcpHeartbeat(ch, rawTcpMsg.Op, rawTcpMsg.SeqId)
+	default:
+		// same ops as websocket, the sender is the user of the conn, not the fromUserId in msg
+		s.dispatchClientOp(ch, &proto.ClientOp{
+			Op:       rawTcpMsg.Op,
+			SeqId:    rawTcpMsg.SeqId,
+			AckId:    rawTcpMsg.AckId,
+			RoomId:   rawTcpMsg.RoomId,
+			ToUserId: rawTcpMsg.ToUserId,
+			Msg:      rawTcpMsg.Msg,
+		})
+	}
+	return true
+}
+
 func (c *Connect) writeDataToTcp(s *Server, ch *Channel) {
-	//ping time default 54s
-	ticker := time.NewTicker(DefaultServer.Options.PingPeriod)
+	pingPeriod := s.Options.HeartbeatInterval
+	if pingPeriod <= 0 {
+		pingPeriod = s.Options.PingPeriod
+	}
+	ticker := time.NewTicker(pingPeriod)
+	redeliverC, stopRedeliver := ch.acks.redeliverTicker()
 	defer func() {
 		ticker.Stop()
+		stopRedeliver()
 		_ = ch.connTcp.Close()
 		return
 	}()
-	pack := stickpackage.StickPackage{
-		Version: stickpackage.VersionContent,
-	}
 	for {
 		select {
-		case message, ok := <-ch.broadcast:
-			if !ok {
-				_ = ch.connTcp.Close()
-				return
-			}
-			pack.Msg = message.Body
-			pack.Length = pack.GetPackageLength()
-			//send msg
-			logrus.Infof("send tcp msg to conn:%s", pack.String())
-			if err := pack.Pack(ch.connTcp); err != nil {
-				logrus.Errorf("connTcp.write message err:%s", err.Error())
+		case <-ch.wake:
+			if !s.writeTcpQueued(ch) {
 				return
 			}
+		case <-redeliverC:
+			s.redeliver(ch)
 		case <-ticker.C:
 			logrus.Infof("connTcp.ping message,send")
 			//send a ping msg ,if error , return
-			pack.Msg = []byte("ping msg")
-			pack.Length = pack.GetPackageLength()
-			if err := pack.Pack(ch.connTcp); err != nil {
+			if err := stickpackage.WriteFrame(ch.connTcp, tcpFrame(ch, ch.nextPing(time.Now()))); err != nil {
 				//send ping msg to tcp conn
 				return
 			}
@@ -249,3 +321,42 @@ func (c *Connect) writeDataToTcp(s *Server, ch *Channel) {
 		}
 	}
 }
+
+// writeTcpQueued write the msgs queued on a tcp conn, return false if the conn must be closed
+func (s *Server) writeTcpQueued(ch *Channel) bool {
+	// control msgs first, then system snapshots, then chat
+	if s.Options.BatchWindow > 0 {
+		return ch.writeBatched(s.Options.BatchWindow, s.Options.BatchBytes, func(messages []*proto.Msg) error {
+			err := writeTcpBatch(ch, messages)
+			if err != nil {
+				logrus.Errorf("connTcp.write batch err:%s", err.Error())
+			}
+			return err
+		})
+	}
+	return ch.writeQueued(func(message *proto.Msg) error {
+		//send msg
+		logrus.Infof("send tcp msg to conn op:%d msg:%s", message.Operation, message.Body)
+		err := stickpackage.WriteFrame(ch.connTcp, tcpFrame(ch, message))
+		if err == stickpackage.ErrFrameTooLarge {
+			logrus.Warnf("drop tcp msg op:%d of %d bytes, too large for v1", message.Operation, len(message.Body))
+			return nil
+		}
+		if err != nil {
+			logrus.Errorf("connTcp.write message err:%s", err.Error())
+		}
+		return err
+	})
+}
+
+// tcpFrame put a msg in a frame of the version of the conn, v1 until the client sent a frame
+func tcpFrame(ch *Channel, msg *proto.Msg) *stickpackage.Frame {
+	f := &stickpackage.Frame{Version: stickpackage.Version1, Body: msg.Body}
+	if atomic.LoadInt32(&ch.tcpVersion) == stickpackage.Version2 {
+		f.Version = stickpackage.Version2
+		f.Op = uint16(msg.Operation)
+		// server seqs are snowflake ids, a seq that is not a number stays in the body only
+		f.Seq, _ = strconv.ParseUint(msg.SeqId, 10, 64)
+	}
+	return f
+}
@@ -0,0 +1,70 @@
+package connect
+
+import (
+	"encoding/json"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/pkg/stickpackage"
+	"gochat/proto"
+)
+
+func TestTcpSecondConnect(t *testing.T) {
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	s := NewServer([]*Bucket{NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})}, o, ServerOptions{
+		WriteWait:     time.Second,
+		BroadcastSize: 8,
+	})
+	server, client := net.Pipe()
+	defer client.Close()
+	ch := NewChannel(8, DropNewest, 0)
+	ch.connTcp = server
+	c := &Connect{ServerId: "tcp-test"}
+	connect := func(body string) bool {
+		return c.handleTcpFrame(s, ch, &stickpackage.Frame{Version: stickpackage.Version2, Op: config.OpBuildTcpConn, Body: []byte(body)})
+	}
+	if !connect(`{"authToken":"good","roomId":7,"deviceId":"phone"}`) || ch.userId != 1 {
+		t.Fatalf("first connect failed, userId=%d", ch.userId)
+	}
+	if connect(`{"authToken":"good","roomId":8,"deviceId":"tablet"}`) {
+		t.Fatal("a second connect frame should end the conn")
+	}
+	if atomic.LoadInt32(&ch.closedByServer) != 1 {
+		t.Error("conn should be closed by the server")
+	}
+	if ch.deviceId != "phone" || ch.InRoom(8) {
+		t.Errorf("second connect changed the conn to device %s, rooms %v", ch.deviceId, ch.RoomIds())
+	}
+}
+
+func TestTcpRefusedReason(t *testing.T) {
+	o := &httpOperator{disconnected: make(chan int, 1)}
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	s := NewServer([]*Bucket{b}, o, ServerOptions{
+		WriteWait:     time.Second,
+		BroadcastSize: 8,
+		Admission:     AdmissionOptions{MaxConnsPerUser: 1},
+	})
+	b.Put(1, "phone", 7, NewChannel(4, DropNewest, 0))
+	server, client := net.Pipe()
+	defer client.Close()
+	ch := NewChannel(8, DropNewest, 0)
+	ch.connTcp = server
+	c := &Connect{ServerId: "tcp-test"}
+	if !c.handleTcpFrame(s, ch, &stickpackage.Frame{Version: stickpackage.Version2, Op: config.OpBuildTcpConn, Seq: 5,
+		Body: []byte(`{"authToken":"good","roomId":7,"deviceId":"tablet"}`)}) {
+		t.Fatal("refused conn should stay open until it got the reason")
+	}
+	msg := ch.dequeue()
+	var reply proto.OpReply
+	if msg == nil || json.Unmarshal(msg.Body, &reply) != nil || reply.ReqOp != config.OpBuildTcpConn ||
+		reply.SeqId != "5" || reply.Code != config.FailReplyCode || reply.Msg != errMaxConnsPerUser.Error() {
+		t.Fatalf("refusal reply %+v, want the reason for seq 5", reply)
+	}
+	if !ch.closeAfterWrite(msg) || atomic.LoadInt32(&ch.closedByServer) != 1 {
+		t.Error("conn should be closed once the reason is written")
+	}
+}
@@ -0,0 +1,79 @@
+package connect
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+)
+
+// room signals are ephemeral, like typing or viewing. they are relayed to the other members of
+// the room but never stored, acked, replied or replayed on resume. a user sending the same
+// signal to a room again within SignalInterval is coalesced into the first one
+
+const maxSignalLength = 32
+
+var errBadSignal = errors.New("signal empty or too long")
+
+type lastSignal struct {
+	signal string
+	sentAt time.Time
+}
+
+// signalCoalescer keep the last signal a user sent to each room, shared by the user's conns
+type signalCoalescer struct {
+	lock sync.Mutex
+	last map[int]lastSignal // by roomId
+}
+
+func newSignalCoalescer() *signalCoalescer {
+	return &signalCoalescer{last: make(map[int]lastSignal)}
+}
+
+// allow is false if the same signal was sent to the room within interval,
+// a different signal, like typing then stopped, always goes through
+func (c *signalCoalescer) allow(roomId int, signal string, now time.Time, interval time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	last, ok := c.last[roomId]
+	if ok && last.signal == signal && now.Sub(last.sentAt) < interval {
+		return false
+	}
+	c.last[roomId] = lastSignal{signal: signal, sentAt: now}
+	return true
+}
+
+// sendSignal relay a signal of the conn to its room through logic, errors are only logged
+// since a signal is never replied
+func (s *Server) sendSignal(ch *Channel, op *proto.ClientOp) {
+	var err error
+	switch {
+	case op.RoomId <= 0:
+		err = errNoRoom
+	case !ch.InRoom(op.RoomId):
+		err = errNotInRoom
+	case op.Signal == "" || len(op.Signal) > maxSignalLength:
+		err = errBadSignal
+	}
+	if err != nil {
+		logrus.Debugf("room signal userId=%d roomId=%d err:%s", ch.userId, op.RoomId, err.Error())
+		return
+	}
+	signals := s.Bucket(ch.userId).UserSignals(ch.userId)
+	if !signals.allow(op.RoomId, op.Signal, time.Now(), s.Options.SignalInterval) {
+		return
+	}
+	req := &proto.Send{
+		Msg:          op.Signal,
+		FromUserId:   ch.userId,
+		FromUserName: ch.userName,
+		RoomId:       op.RoomId,
+		Op:           config.OpRoomSignal,
+	}
+	if err = logicReplyErr(s.operator.PushRoomSignal(req)); err != nil {
+		logrus.Debugf("room signal userId=%d roomId=%d err:%s", ch.userId, op.RoomId, err.Error())
+	}
+}
@@ -0,0 +1,87 @@
+package connect
+
+import (
+	"testing"
+	"time"
+
+	"gochat/config"
+	"gochat/proto"
+)
+
+func TestSignalCoalesce(t *testing.T) {
+	c := newSignalCoalescer()
+	now := time.Now()
+	if !c.allow(1, "typing", now, time.Second) {
+		t.Fatal("first signal should pass")
+	}
+	if c.allow(1, "typing", now.Add(500*time.Millisecond), time.Second) {
+		t.Error("same signal within interval should be coalesced")
+	}
+	if !c.allow(2, "typing", now, time.Second) {
+		t.Error("other room should pass")
+	}
+	if !c.allow(1, "stopped", now.Add(600*time.Millisecond), time.Second) {
+		t.Error("a different signal should pass")
+	}
+	if !c.allow(1, "typing", now.Add(700*time.Millisecond), time.Second) {
+		t.Error("typing after stopped should pass")
+	}
+	if !c.allow(1, "typing", now.Add(2*time.Second), time.Second) {
+		t.Error("same signal after interval should pass")
+	}
+}
+
+// signalOperator record the signals relayed to logic
+type signalOperator struct {
+	Operator
+	sent []*proto.Send
+}
+
+func (o *signalOperator) PushRoomSignal(req *proto.Send) (*proto.SuccessReply, error) {
+	o.sent = append(o.sent, req)
+	return &proto.SuccessReply{Code: config.SuccessReplyCode}, nil
+}
+
+func TestSendSignal(t *testing.T) {
+	b := NewBucket(BucketOptions{ChannelSize: 8, RoomSize: 8, RoutineAmount: 1, RoutineSize: 1})
+	o := &signalOperator{}
+	s := NewServer([]*Bucket{b}, o, ServerOptions{SignalInterval: time.Minute})
+	ch := NewChannel(4, DropNewest, 0)
+	b.Put(1, "a", 7, ch)
+	for _, op := range []*proto.ClientOp{
+		{Op: config.OpRoomSignal, RoomId: 7, Signal: "typing", SeqId: "1"},
+		{Op: config.OpRoomSignal, RoomId: 7, Signal: "typing"},
+		{Op: config.OpRoomSignal, RoomId: 8, Signal: "typing"}, // not in room
+		{Op: config.OpRoomSignal, RoomId: 7},                   // no signal
+		{Op: config.OpRoomSignal, RoomId: 7, Signal: "stopped"},
+	} {
+		s.dispatchClientOp(ch, op)
+	}
+	if len(o.sent) != 2 || o.sent[0].Msg != "typing" || o.sent[1].Msg != "stopped" || o.sent[0].FromUserId != 1 {
+		t.Errorf("relayed %+v, want typing then stopped", o.sent)
+	}
+	if msg := ch.dequeue(); msg != nil {
+		t.Errorf("signal got a reply op %d", msg.Operation)
+	}
+}
+
+func TestRoomSignalPush(t *testing.T) {
+	room := NewRoom(7)
+	sender, other, detached := NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0), NewChannel(4, DropNewest, 0)
+	sender.userId, other.userId, detached.userId = 1, 2, 3
+	detached.replay = newReplayBuffer(8)
+	detached.replay.detach()
+	for _, ch := range []*Channel{sender, other, detached} {
+		room.Put(ch)
+	}
+	room.Push(&proto.Msg{Operation: config.OpRoomSignal, Body: []byte(`{"signal":"typing"}`)}, 1)
+	if len(sender.broadcast) != 0 {
+		t.Error("sender should not get its own signal")
+	}
+	if len(other.broadcast) != 1 {
+		t.Error("other member should get the signal")
+	}
+	if msgs, _ := detached.replay.next(""); len(detached.broadcast) != 0 || len(msgs) != 0 {
+		t.Error("a detached session should not keep the signal for replay")
+	}
+}
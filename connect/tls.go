@@ -0,0 +1,47 @@
+package connect
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"gochat/config"
+	"gochat/pkg/tlsreload"
+
+	"github.com/sirupsen/logrus"
+	"github.com/smallnest/rpcx/server"
+)
+
+// initTLS load the connect-base cert pair, without one the listeners stay plain
+func (c *Connect) initTLS() error {
+	base := config.Conf.Connect.ConnectBase
+	if base.CertPath == "" && base.KeyPath == "" {
+		if base.RpcTls {
+			return errors.New("rpcTls needs certPath and keyPath")
+		}
+		return nil
+	}
+	r, err := tlsreload.Load(base.CertPath, base.KeyPath)
+	if err != nil {
+		return err
+	}
+	c.tlsConfig = r.ServerConfig()
+	logrus.Infof("connect tls on, cert:%s", base.CertPath)
+	return nil
+}
+
+// rpcServerOptions serve the connect rpc over tls if rpcTls is on
+func (c *Connect) rpcServerOptions() []server.OptionFn {
+	if !config.Conf.Connect.ConnectBase.RpcTls || c.tlsConfig == nil {
+		return nil
+	}
+	return []server.OptionFn{server.WithTLSConfig(c.tlsConfig)}
+}
+
+// logicClientTLS is the tls config to dial the logic rpc, nil if logic serves plain rpc
+func logicClientTLS() (*tls.Config, error) {
+	base := config.Conf.Logic.LogicBase
+	if !base.RpcTls {
+		return nil, nil
+	}
+	return tlsreload.ClientConfig(base.RpcCaPath, base.RpcServerName)
+}
@@ -7,19 +7,18 @@ package connect
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/pkg/origin"
 )
 
-const maxConnections = 10000
-
-var activeConnections int64
-
 // bufferPool implements websocket.BufferPool using sync.Pool
 // to reuse buffers across connections.
 type bufferPool struct {
@@ -43,7 +42,47 @@ func initUpgrader(server *Server) {
 		ReadBufferSize:  server.Options.ReadBufferSize,
 		WriteBufferSize: server.Options.WriteBufferSize,
 		WriteBufferPool: writeBufferPool,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+		Subprotocols:    envelope.Subprotocols,
+		// permessage-deflate, only used if the client offers it
+		EnableCompression: server.Options.Compression,
+		CheckOrigin:       checkOrigin(origin.New(config.Conf.Common.CommonCors.AllowedOrigins)),
+	}
+}
+
+// upgrader is the upgrader of the request. a browser fails the handshake if none of the
+// subprotocols it offered is echoed, so one that offers its token but no format gets the
+// token subprotocol back, and the conn speaks the legacy format
+func upgrader(r *http.Request) *websocket.Upgrader {
+	if subprotocol := tokenSubprotocol(r); subprotocol != "" {
+		u := sharedUpgrader
+		u.Subprotocols = append(append([]string(nil), envelope.Subprotocols...), subprotocol)
+		return &u
+	}
+	return &sharedUpgrader
+}
+
+// wsFormat is the frame format of the conn, empty for a legacy conn, which may have got its
+// token subprotocol echoed
+func wsFormat(conn *websocket.Conn) string {
+	if subprotocol := conn.Subprotocol(); !strings.HasPrefix(subprotocol, authTokenSubprotocolPrefix) {
+		return subprotocol
+	}
+	return ""
+}
+
+// checkOrigin allow upgrades from the allowed origins, from the same host, and from
+// non browser clients which send no Origin
+func checkOrigin(allowlist *origin.Allowlist) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		requestOrigin := r.Header.Get("Origin")
+		if requestOrigin == "" || allowlist.Allowed(requestOrigin) {
+			return true
+		}
+		if u, err := url.Parse(requestOrigin); err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		logrus.Warnf("websocket upgrade deny origin %s from %s", requestOrigin, r.RemoteAddr)
+		return false
 	}
 }
 
@@ -61,24 +100,48 @@ func (c *Connect) InitWebsocket() error {
 		ReadHeaderTimeout: 10 * time.Second,
 		MaxHeaderBytes:    4096,
 	}
+	c.lock.Lock()
+	c.wsServer = srv
+	c.lock.Unlock()
 
+	if c.tlsConfig != nil {
+		// wss, the cert comes from tlsConfig so it follows reloads
+		srv.TLSConfig = c.tlsConfig
+		return srv.ListenAndServeTLS("", "")
+	}
 	err := srv.ListenAndServe()
 	return err
 }
 
 func (c *Connect) serveWs(server *Server, w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt64(&activeConnections) >= maxConnections {
-		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+	ip := server.Options.Admission.requestIp(r)
+	if reason := server.admitConn("ws", ip); reason != "" {
+		refuse(w, reason)
 		return
 	}
-	conn, err := sharedUpgrader.Upgrade(w, r, nil)
+	authToken, ok := server.authUpgrade(w, r)
+	if !ok {
+		server.release("ws", ip)
+		return
+	}
+	conn, err := upgrader(r).Upgrade(w, r, nil)
 	if err != nil {
 		logrus.Errorf("serverWs err:%s", err.Error())
+		server.release("ws", ip)
 		return
 	}
-	atomic.AddInt64(&activeConnections, 1)
-	ch := NewChannel(server.Options.BroadcastSize)
+	if server.Options.Compression {
+		// no-op if the client did not negotiate compression
+		if err := conn.SetCompressionLevel(server.Options.CompressionLevel); err != nil {
+			logrus.Warnf("SetCompressionLevel err:%s", err.Error())
+		}
+	}
+	ch := NewChannel(server.Options.BroadcastSize, server.Options.SlowConsumerPolicy, server.Options.BlockTimeout)
+	ch.admitted(ip)
+	ch.acks = newAckWindow(server.Options.AckWindow, server.Options.AckTimeout, server.Options.AckMaxRetries)
+	ch.replay = newReplayBuffer(server.Options.ResumeBuffer)
 	ch.conn = conn
+	ch.authToken = authToken
 	go server.writePump(ch, c)
 	go server.readPump(ch, c)
 }
@@ -0,0 +1,97 @@
+package connect
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/proto"
+)
+
+// encodeWsFrame turn a msg into a websocket frame of the format negotiated by the conn
+func encodeWsFrame(subprotocol string, msg *proto.Msg) (messageType int, data []byte, err error) {
+	frame := &envelope.Frame{Ver: msg.Ver, Op: msg.Operation, Seq: msg.SeqId, Body: msg.Body}
+	switch subprotocol {
+	case envelope.SubprotocolBinary:
+		data, err = envelope.EncodeBinary(frame)
+		return websocket.BinaryMessage, data, err
+	case envelope.SubprotocolJSON:
+		data, err = envelope.EncodeJSON(frame)
+		return websocket.TextMessage, data, err
+	default:
+		// legacy clients only get the body
+		return websocket.TextMessage, msg.Body, nil
+	}
+}
+
+// sharedFrame is a websocket frame encoded once and written to many conns
+type sharedFrame struct {
+	prepared *websocket.PreparedMessage
+	size     int    // bytes before compression
+	data     []byte // the frame before compression, for batches
+}
+
+// shareFrames make the writers of all conns share the encoded frames of the msg, call it
+// before the msg is pushed to the conns
+func shareFrames(msg *proto.Msg) {
+	msg.Frames = new(sync.Map)
+}
+
+// preparedWsFrame return the frame of the msg for the subprotocol, encoded by the first
+// writer which needs it, later writers of the same subprotocol reuse it. the prepared
+// message also keeps the compressed frame once a conn with compression wrote it
+func preparedWsFrame(subprotocol string, msg *proto.Msg) (*sharedFrame, error) {
+	if frame, ok := msg.Frames.Load(subprotocol); ok {
+		return frame.(*sharedFrame), nil
+	}
+	messageType, data, err := encodeWsFrame(subprotocol, msg)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(messageType, data)
+	if err != nil {
+		return nil, err
+	}
+	frame, _ := msg.Frames.LoadOrStore(subprotocol, &sharedFrame{prepared: prepared, size: len(data), data: data})
+	return frame.(*sharedFrame), nil
+}
+
+// decodeWsFrame parse a client frame, it's either a connect request or an op on a connected conn
+func decodeWsFrame(subprotocol string, data []byte) (op *proto.ClientOp, connReq *proto.ConnectRequest, err error) {
+	var frame *envelope.Frame
+	switch subprotocol {
+	case envelope.SubprotocolBinary:
+		frame, err = envelope.DecodeBinary(data)
+	case envelope.SubprotocolJSON:
+		frame, err = envelope.DecodeJSON(data)
+	default:
+		// legacy clients send a bare ClientOp, or a ConnectRequest which has no op
+		var clientOp proto.ClientOp
+		if err = json.Unmarshal(data, &clientOp); err == nil && clientOp.Op != 0 {
+			return &clientOp, nil, nil
+		}
+		connReq = new(proto.ConnectRequest)
+		err = json.Unmarshal(data, connReq)
+		return
+	}
+	if err != nil {
+		return
+	}
+	if frame.Op == config.OpBuildTcpConn {
+		connReq = new(proto.ConnectRequest)
+		err = json.Unmarshal(frame.Body, connReq)
+		return
+	}
+	op = new(proto.ClientOp)
+	if len(frame.Body) > 0 {
+		if err = json.Unmarshal(frame.Body, op); err != nil {
+			return
+		}
+	}
+	// op and seq of the envelope win over the body
+	op.Op = frame.Op
+	op.SeqId = frame.Seq
+	return
+}
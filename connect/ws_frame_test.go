@@ -0,0 +1,92 @@
+package connect
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gochat/config"
+	"gochat/pkg/envelope"
+	"gochat/proto"
+)
+
+func TestPreparedWsFrameShared(t *testing.T) {
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpRoomSend, SeqId: "1", Body: []byte(`{"msg":"hi"}`)}
+	shareFrames(msg)
+	first, err := preparedWsFrame(envelope.SubprotocolJSON, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := preparedWsFrame(envelope.SubprotocolJSON, msg)
+	if first != again {
+		t.Error("the same subprotocol should reuse the encoded frame")
+	}
+	legacy, _ := preparedWsFrame("", msg)
+	if legacy == first || legacy.size != len(msg.Body) {
+		t.Error("legacy conns should get their own frame of the bare body")
+	}
+}
+
+// wsPair upgrade a conn on a test server, return the server side channel and the client conn
+func wsPair(t testing.TB, s *Server, subprotocols ...string) (*Channel, *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: s.Options.Compression, Subprotocols: subprotocols}
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	dialer := websocket.Dialer{EnableCompression: true, Subprotocols: subprotocols}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ch := NewChannel(4, DropNewest, 0)
+	ch.conn = <-conns
+	t.Cleanup(func() { ch.conn.Close() })
+	return ch, client
+}
+
+func TestWriteWsMsgCompressedRoomMsg(t *testing.T) {
+	s := NewServer(nil, nil, ServerOptions{Compression: true, CompressionLevel: 1, CompressionThreshold: 64})
+	body := bytes.Repeat([]byte("a"), 1024)
+	msg := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpRoomSend, Body: body}
+	shareFrames(msg)
+	small := &proto.Msg{Ver: config.MsgVersion, Operation: config.OpRoomSend, Body: []byte("small")}
+
+	// two conns share the encoded room msg
+	for i := 0; i < 2; i++ {
+		ch, client := wsPair(t, s)
+		if err := s.writeWsMsg(ch, msg); err != nil {
+			t.Fatalf("writeWsMsg: %v", err)
+		}
+		if err := s.writeWsMsg(ch, small); err != nil {
+			t.Fatalf("writeWsMsg small: %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, data, err := client.ReadMessage(); err != nil || !bytes.Equal(data, body) {
+			t.Fatalf("conn %d read room msg: %v", i, err)
+		}
+		if _, data, err := client.ReadMessage(); err != nil || string(data) != "small" {
+			t.Fatalf("conn %d read small msg: %v", i, err)
+		}
+	}
+	n := 0
+	msg.Frames.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("room msg encoded %d times, want once", n)
+	}
+}
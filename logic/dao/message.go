@@ -0,0 +1,76 @@
+package dao
+
+import (
+	"gochat/db"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+type Message struct {
+	Id           int   `gorm:"primary_key"`
+	RoomId       int   `gorm:"unique_index:idx_room_msg"`
+	MsgId        int64 `gorm:"unique_index:idx_room_msg"` // per room increasing id
+	FromUserId   int
+	FromUserName string
+	Content      string `gorm:"type:text"`
+	CreateTime   time.Time
+	db.DbGoChat
+}
+
+func init() {
+	if dbIns != nil {
+		dbIns.AutoMigrate(&Message{})
+	}
+}
+
+func (m *Message) TableName() string {
+	return "message"
+}
+
+func (m *Message) Add() (id int, err error) {
+	if m.RoomId <= 0 || m.MsgId <= 0 {
+		return 0, errors.New("room_id or msg_id empty!")
+	}
+	m.CreateTime = time.Now()
+	if err = dbIns.Table(m.TableName()).Create(m).Error; err != nil {
+		return 0, err
+	}
+	return m.Id, nil
+}
+
+// GetMaxMsgId return the biggest msg id already stored for the room, 0 if room has no message
+func (m *Message) GetMaxMsgId(roomId int) (msgId int64, err error) {
+	var data Message
+	err = dbIns.Table(m.TableName()).Where("room_id=?", roomId).Order("msg_id desc").Take(&data).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 0, nil
+	}
+	return data.MsgId, err
+}
+
+// GetRoomHistory page room messages by msg id cursor, the result is always in ascending msg id order.
+// before > 0 return the newest messages older than before,
+// after > 0 return the oldest messages newer than after,
+// both empty return the newest messages of the room.
+func (m *Message) GetRoomHistory(roomId int, before int64, after int64, limit int) (list []Message, err error) {
+	query := dbIns.Table(m.TableName()).Where("room_id=?", roomId)
+	if before > 0 {
+		query = query.Where("msg_id<?", before)
+	}
+	if after > 0 {
+		query = query.Where("msg_id>?", after)
+	}
+	if after > 0 && before <= 0 {
+		err = query.Order("msg_id asc").Limit(limit).Find(&list).Error
+		return
+	}
+	if err = query.Order("msg_id desc").Limit(limit).Find(&list).Error; err != nil {
+		return
+	}
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return
+}
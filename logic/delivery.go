@@ -0,0 +1,73 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gochat/config"
+	"gochat/proto"
+)
+
+// setMsgStatus record the delivery status of a single msg, so the sender can query it later
+func (logic *Logic) setMsgStatus(seqId string, fromUserId int, toUserId int, status string) (err error) {
+	key := logic.getMsgStatusKey(seqId)
+	pipe := RedisClient.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"fromUserId": fromUserId,
+		"toUserId":   toUserId,
+		"status":     status,
+	})
+	pipe.Expire(key, config.OfflineMsgValidTime*time.Second)
+	_, err = pipe.Exec()
+	return
+}
+
+// ackMsg mark the single msg delivered, only the receiver can ack it
+func (logic *Logic) ackMsg(userId int, seqId string) (err error) {
+	key := logic.getMsgStatusKey(seqId)
+	toUserId, err := RedisClient.HGet(key, "toUserId").Int()
+	if err == redis.Nil {
+		return errors.New("no this msg")
+	}
+	if err != nil {
+		return
+	}
+	if toUserId != userId {
+		return errors.New("not the receiver of the msg")
+	}
+	return RedisClient.HSet(key, "status", config.MsgStatusDelivered).Err()
+}
+
+// getMsgStatus return the receiver and delivery status of a single msg, only for its sender
+func (logic *Logic) getMsgStatus(userId int, seqId string) (toUserId int, status string, err error) {
+	info, err := RedisClient.HGetAll(logic.getMsgStatusKey(seqId)).Result()
+	if err != nil {
+		return
+	}
+	if len(info) == 0 || info["fromUserId"] != strconv.Itoa(userId) {
+		err = errors.New("no this msg")
+		return
+	}
+	toUserId, _ = strconv.Atoi(info["toUserId"])
+	status = info["status"]
+	return
+}
+
+// ackOfflineMembers mark the msgs of offline inbox members ("id|msg") delivered
+func (logic *Logic) ackOfflineMembers(userId int, members []string) {
+	for _, member := range members {
+		parts := strings.SplitN(member, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var send proto.Send
+		if json.Unmarshal([]byte(parts[1]), &send) != nil || send.SeqId == "" {
+			continue
+		}
+		_ = logic.ackMsg(userId, send.SeqId)
+	}
+}
@@ -0,0 +1,50 @@
+package logic
+
+import (
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"gochat/logic/dao"
+	"gochat/proto"
+)
+
+var (
+	// incr the counter only if it exists, 0 if it does not
+	incrRoomMsgId = redis.NewScript(`if redis.call("EXISTS", KEYS[1]) == 1 then return redis.call("INCR", KEYS[1]) end return 0`)
+	// seed the counter unless another logic did it first, then incr it
+	seedRoomMsgId = redis.NewScript(`redis.call("SETNX", KEYS[1], ARGV[1]) return redis.call("INCR", KEYS[1])`)
+)
+
+// nextRoomMsgId alloc a per room increasing msg id,
+// the redis counter is seeded from db so ids keep increasing after redis data lost.
+// both steps are scripts, a counter lost in between is never incr from 0
+func (logic *Logic) nextRoomMsgId(roomId int) (msgId int64, err error) {
+	keys := []string{logic.getRoomMsgIdKey(strconv.Itoa(roomId))}
+	if msgId, err = incrRoomMsgId.Run(RedisClient, keys).Int64(); err != nil || msgId > 0 {
+		return
+	}
+	m := new(dao.Message)
+	var maxId int64
+	if maxId, err = m.GetMaxMsgId(roomId); err != nil {
+		return 0, err
+	}
+	return seedRoomMsgId.Run(RedisClient, keys, maxId).Int64()
+}
+
+// saveRoomMsg persist a room msg and return the msg id given to it
+func (logic *Logic) saveRoomMsg(sendData *proto.Send) (msgId int64, err error) {
+	if msgId, err = logic.nextRoomMsgId(sendData.RoomId); err != nil {
+		return 0, err
+	}
+	m := &dao.Message{
+		RoomId:       sendData.RoomId,
+		MsgId:        msgId,
+		FromUserId:   sendData.FromUserId,
+		FromUserName: sendData.FromUserName,
+		Content:      sendData.Msg,
+	}
+	if _, err = m.Add(); err != nil {
+		return 0, err
+	}
+	return msgId, nil
+}
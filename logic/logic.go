@@ -65,6 +65,6 @@ func (logic *Logic) Run() {
 
 	//init rpc server
 	if err := logic.InitRpcServer(); err != nil {
-		logrus.Panicf("logic init rpc server fail")
+		logrus.Panicf("logic init rpc server fail:%s", err.Error())
 	}
 }
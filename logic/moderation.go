@@ -0,0 +1,186 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	"gochat/config"
+	"gochat/proto"
+)
+
+// room moderation: a kick remove the user from the room on every connect server, a mute stop
+// the user from sending to the room for a while, and a ban is a kick that also keeps the user
+// out of the room until unbanned. only the moderators of [logic-moderation] may do them
+
+const (
+	ModerationKick = "kick"
+	ModerationBan  = "ban"
+)
+
+// isModerator check the user id, a user name can be registered by anyone who asks first
+func isModerator(userId int) bool {
+	for _, moderatorId := range config.Conf.Logic.LogicModeration.Moderators {
+		if moderatorId > 0 && moderatorId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModerateRequest return why the request is refused, empty if it is allowed
+func checkModerateRequest(args *proto.ModerateRequest) string {
+	if args.RoomId <= 0 || args.UserId <= 0 {
+		return "roomId or userId empty"
+	}
+	if !isModerator(args.OperatorId) {
+		logrus.Warnf("logic,moderate userId=%d is not a moderator", args.OperatorId)
+		return "not a moderator"
+	}
+	return ""
+}
+
+func (logic *Logic) isBanned(roomId int, userId int) bool {
+	banned, err := RedisClient.SIsMember(logic.getRoomBanKey(strconv.Itoa(roomId)), strconv.Itoa(userId)).Result()
+	if err != nil {
+		logrus.Warnf("logic,isBanned redis err:%s", err.Error())
+	}
+	return banned
+}
+
+func (logic *Logic) isMuted(roomId int, userId int) bool {
+	n, err := RedisClient.Exists(logic.getRoomMuteKey(strconv.Itoa(roomId), strconv.Itoa(userId))).Result()
+	if err != nil {
+		logrus.Warnf("logic,isMuted redis err:%s", err.Error())
+	}
+	return n > 0
+}
+
+// roomSendDenied return why the user may not send to the room, empty if it may
+func (logic *Logic) roomSendDenied(roomId int, userId int) string {
+	if logic.isBanned(roomId, userId) {
+		return "banned from room"
+	}
+	if logic.isMuted(roomId, userId) {
+		return "muted in room"
+	}
+	return ""
+}
+
+func (rpc *RpcLogic) KickUser(ctx context.Context, args *proto.ModerateRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if reply.Msg = checkModerateRequest(args); reply.Msg != "" {
+		return
+	}
+	logic := new(Logic)
+	if err = logic.PublishKick(args.RoomId, args.UserId, ModerationKick, args.Reason); err != nil {
+		logrus.Errorf("logic,KickUser publish err:%s", err.Error())
+		return
+	}
+	logrus.Infof("logic,%s kick userId=%d from roomId=%d", args.OperatorName, args.UserId, args.RoomId)
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+func (rpc *RpcLogic) MuteUser(ctx context.Context, args *proto.ModerateRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if reply.Msg = checkModerateRequest(args); reply.Msg != "" {
+		return
+	}
+	if args.Duration < 0 {
+		reply.Msg = "duration must not be negative"
+		return
+	}
+	logic := new(Logic)
+	key := logic.getRoomMuteKey(strconv.Itoa(args.RoomId), strconv.Itoa(args.UserId))
+	if args.Duration == 0 {
+		err = RedisClient.Del(key).Err()
+	} else {
+		err = RedisClient.Set(key, args.OperatorId, time.Duration(args.Duration)*time.Second).Err()
+	}
+	if err != nil {
+		logrus.Errorf("logic,MuteUser redis err:%s", err.Error())
+		return
+	}
+	logrus.Infof("logic,%s mute userId=%d in roomId=%d for %ds", args.OperatorName, args.UserId, args.RoomId, args.Duration)
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+func (rpc *RpcLogic) BanUser(ctx context.Context, args *proto.ModerateRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if reply.Msg = checkModerateRequest(args); reply.Msg != "" {
+		return
+	}
+	logic := new(Logic)
+	if err = RedisClient.SAdd(logic.getRoomBanKey(strconv.Itoa(args.RoomId)), strconv.Itoa(args.UserId)).Err(); err != nil {
+		logrus.Errorf("logic,BanUser redis err:%s", err.Error())
+		return
+	}
+	// the ban is kept even if the kick fails, the user can not come back
+	if err = logic.PublishKick(args.RoomId, args.UserId, ModerationBan, args.Reason); err != nil {
+		logrus.Errorf("logic,BanUser publish kick err:%s", err.Error())
+		return
+	}
+	logrus.Infof("logic,%s ban userId=%d from roomId=%d", args.OperatorName, args.UserId, args.RoomId)
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+func (rpc *RpcLogic) UnbanUser(ctx context.Context, args *proto.ModerateRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if reply.Msg = checkModerateRequest(args); reply.Msg != "" {
+		return
+	}
+	logic := new(Logic)
+	if err = RedisClient.SRem(logic.getRoomBanKey(strconv.Itoa(args.RoomId)), strconv.Itoa(args.UserId)).Err(); err != nil {
+		logrus.Errorf("logic,UnbanUser redis err:%s", err.Error())
+		return
+	}
+	logrus.Infof("logic,%s unban userId=%d from roomId=%d", args.OperatorName, args.UserId, args.RoomId)
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+// PublishKick ask task to remove the user from the room on every connect server
+func (logic *Logic) PublishKick(roomId int, userId int, action string, reason string) (err error) {
+	msg, err := json.Marshal(proto.ModerationInfo{
+		Op:     config.OpKick,
+		RoomId: roomId,
+		Action: action,
+		Reason: reason,
+	})
+	if err != nil {
+		return
+	}
+	var redisMsg = &proto.RedisMsg{
+		Op:     config.OpKick,
+		RoomId: roomId,
+		UserId: userId,
+		Msg:    msg,
+	}
+	body, err := json.Marshal(redisMsg)
+	if err != nil {
+		logrus.Errorf("logic,PublishKick redisMsg error : %s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return RabbitMQClient.Publish(
+		ctx,
+		config.RabbitMQExchange,
+		config.RoutingKeyRoomKick,
+		false,
+		false,
+		amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "application/json",
+			Body:         body,
+		},
+	)
+}
@@ -0,0 +1,83 @@
+package logic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"gochat/config"
+)
+
+// SaveOfflineMsg keep a single msg in the user offline inbox,
+// inbox is a sorted set scored by a per user increasing id, member is "id|msg".
+// a msg with a seq is kept once, connect may save a msg logic already saved or
+// one the receiver acked on another server, those are skipped
+func (logic *Logic) SaveOfflineMsg(userId int, seqId string, msg []byte) (err error) {
+	validTime := config.OfflineMsgValidTime * time.Second
+	var seqKey string
+	if seqId != "" {
+		if status, _ := RedisClient.HGet(logic.getMsgStatusKey(seqId), "status").Result(); status == config.MsgStatusDelivered {
+			return
+		}
+		seqKey = logic.getOfflineSeqKey(seqId)
+		var first bool
+		if first, err = RedisClient.SetNX(seqKey, userId, validTime).Result(); err != nil || !first {
+			return
+		}
+	}
+	if err = logic.addOfflineMsg(userId, msg, validTime); err != nil && seqKey != "" {
+		// not in the inbox, let a retry save it
+		RedisClient.Del(seqKey)
+	}
+	return
+}
+
+func (logic *Logic) addOfflineMsg(userId int, msg []byte, validTime time.Duration) (err error) {
+	key := logic.getOfflineKey(strconv.Itoa(userId))
+	idKey := logic.getOfflineIdKey(strconv.Itoa(userId))
+	var id int64
+	if id, err = RedisClient.Incr(idKey).Result(); err != nil {
+		return
+	}
+	pipe := RedisClient.TxPipeline()
+	pipe.ZAdd(key, redis.Z{Score: float64(id), Member: fmt.Sprintf("%d|%s", id, msg)})
+	// only keep the newest msgs
+	pipe.ZRemRangeByRank(key, 0, -config.OfflineMsgMaxSize-1)
+	pipe.Expire(key, validTime)
+	pipe.Expire(idKey, validTime)
+	_, err = pipe.Exec()
+	return
+}
+
+// GetOfflineMsg remove the msgs with id <= ackId from the user inbox, then return the next limit msgs
+func (logic *Logic) GetOfflineMsg(userId int, ackId int64, limit int) (msgs [][]byte, lastId int64, hasMore bool, err error) {
+	key := logic.getOfflineKey(strconv.Itoa(userId))
+	if ackId > 0 {
+		// client got the acked msgs, they are delivered
+		acked, _ := RedisClient.ZRangeByScore(key, redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(ackId, 10)}).Result()
+		logic.ackOfflineMembers(userId, acked)
+		if err = RedisClient.ZRemRangeByScore(key, "-inf", strconv.FormatInt(ackId, 10)).Err(); err != nil {
+			return
+		}
+	}
+	var members []string
+	// fetch one more to know if there is another batch
+	if members, err = RedisClient.ZRange(key, 0, int64(limit)).Result(); err != nil {
+		return
+	}
+	if len(members) > limit {
+		hasMore = true
+		members = members[:limit]
+	}
+	for _, member := range members {
+		parts := strings.SplitN(member, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lastId, _ = strconv.ParseInt(parts[0], 10, 64)
+		msgs = append(msgs, []byte(parts[1]))
+	}
+	return
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/smallnest/rpcx/server"
 	"gochat/config"
 	"gochat/pkg/middleware"
+	"gochat/pkg/tlsreload"
 	"gochat/proto"
 	"gochat/tools"
 	"strings"
@@ -64,6 +65,15 @@ func (logic *Logic) InitRabbitMQClient() error {
 
 func (logic *Logic) InitRpcServer() (err error) {
 	var network, addr string
+	var opts []server.OptionFn
+	if logicBase := config.Conf.Logic.LogicBase; logicBase.RpcTls {
+		var r *tlsreload.Reloader
+		if r, err = tlsreload.Load(logicBase.CertPath, logicBase.KeyPath); err != nil {
+			return
+		}
+		opts = append(opts, server.WithTLSConfig(r.ServerConfig()))
+		logrus.Infof("logic rpc tls on, cert:%s", logicBase.CertPath)
+	}
 	// a host multi port case
 	rpcAddressList := strings.Split(config.Conf.Logic.LogicBase.RpcAddress, ",")
 	for _, bind := range rpcAddressList {
@@ -71,13 +81,13 @@ func (logic *Logic) InitRpcServer() (err error) {
 			logrus.Panicf("InitLogicRpc ParseNetwork error : %s", err.Error())
 		}
 		logrus.Infof("logic start run at-->%s:%s", network, addr)
-		go logic.createRpcServer(network, addr)
+		go logic.createRpcServer(network, addr, opts...)
 	}
 	return
 }
 
-func (logic *Logic) createRpcServer(network string, addr string) {
-	s := server.NewServer()
+func (logic *Logic) createRpcServer(network string, addr string, opts ...server.OptionFn) {
+	s := server.NewServer(opts...)
 	s.Plugins.Add(middleware.NewPrometheusRPCPlugin("logic"))
 	logic.addRegistryPlugin(s, network, addr)
 	// serverId must be unique
@@ -107,11 +117,12 @@ func (logic *Logic) addRegistryPlugin(s *server.Server, network string, addr str
 	s.Plugins.Add(r)
 }
 
-func (logic *Logic) PublishToUser(serverId string, toUserId int, msg []byte) (err error) {
+func (logic *Logic) PublishToUser(serverId string, toUserId int, seqId string, msg []byte) (err error) {
 	redisMsg := proto.RedisMsg{
 		Op:       config.OpSingleSend,
 		ServerId: serverId,
 		UserId:   toUserId,
+		SeqId:    seqId,
 		Msg:      msg,
 	}
 	body, err := json.Marshal(redisMsg)
@@ -227,6 +238,39 @@ func (logic *Logic) PublishRoomInfo(roomId int, count int, roomUserInfo map[stri
 	)
 }
 
+// PublishRoomSignal publish a transient signal, it expires in the queue if task can not
+// relay it soon, a late typing signal is worse than none
+func (logic *Logic) PublishRoomSignal(roomId int, fromUserId int, msg []byte) (err error) {
+	var redisMsg = &proto.RedisMsg{
+		Op:     config.OpRoomSignal,
+		RoomId: roomId,
+		UserId: fromUserId,
+		Msg:    msg,
+	}
+	body, err := json.Marshal(redisMsg)
+	if err != nil {
+		logrus.Errorf("logic,PublishRoomSignal redisMsg error : %s", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return RabbitMQClient.Publish(
+		ctx,
+		config.RabbitMQExchange,
+		config.RoutingKeyRoomSignal,
+		false,
+		false,
+		amqp.Publishing{
+			DeliveryMode: amqp.Transient,
+			ContentType:  "application/json",
+			Expiration:   "5000", // ms
+			Body:         body,
+		},
+	)
+}
+
 func (logic *Logic) getRoomUserKey(authKey string) string {
 	var returnKey bytes.Buffer
 	returnKey.WriteString(config.RedisRoomPrefix)
@@ -241,9 +285,67 @@ func (logic *Logic) getRoomOnlineCountKey(authKey string) string {
 	return returnKey.String()
 }
 
-func (logic *Logic) getUserKey(authKey string) string {
+func (logic *Logic) getRoomMsgIdKey(roomId string) string {
 	var returnKey bytes.Buffer
-	returnKey.WriteString(config.RedisPrefix)
-	returnKey.WriteString(authKey)
+	returnKey.WriteString(config.RedisRoomMsgIdPrefix)
+	returnKey.WriteString(roomId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getOfflineKey(userId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisOfflinePrefix)
+	returnKey.WriteString(userId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getOfflineIdKey(userId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisOfflineIdPrefix)
+	returnKey.WriteString(userId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getOfflineSeqKey(seqId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisOfflineSeqPrefix)
+	returnKey.WriteString(seqId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getUserServerKey(userId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisUserServerPrefix)
+	returnKey.WriteString(userId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getMsgStatusKey(seqId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisMsgStatusPrefix)
+	returnKey.WriteString(seqId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getRoomMuteKey(roomId string, userId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisRoomMutePrefix)
+	returnKey.WriteString(roomId)
+	returnKey.WriteString("_")
+	returnKey.WriteString(userId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getRoomBanKey(roomId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisRoomBanPrefix)
+	returnKey.WriteString(roomId)
+	return returnKey.String()
+}
+
+func (logic *Logic) getRoomConnKey(roomId string) string {
+	var returnKey bytes.Buffer
+	returnKey.WriteString(config.RedisRoomConnPrefix)
+	returnKey.WriteString(roomId)
 	return returnKey.String()
 }
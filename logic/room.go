@@ -0,0 +1,79 @@
+package logic
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// joinRoom add user to the room member list, a user may join the same room from many conns,
+// so conns of the user in room are counted, the room online count only changes on the first conn
+func (logic *Logic) joinRoom(userId int, userName string, roomId int) (joined bool) {
+	conns, err := RedisClient.HIncrBy(logic.getRoomConnKey(strconv.Itoa(roomId)), strconv.Itoa(userId), 1).Result()
+	if err != nil {
+		logrus.Warnf("logic,joinRoom HIncrBy err:%s", err.Error())
+		return false
+	}
+	if conns > 1 {
+		return false
+	}
+	roomUserKey := logic.getRoomUserKey(strconv.Itoa(roomId))
+	joined, err = RedisClient.HSetNX(roomUserKey, fmt.Sprintf("%d", userId), userName).Result()
+	if err != nil {
+		logrus.Warnf("logic,joinRoom HSetNX err:%s", err.Error())
+		return false
+	}
+	if joined {
+		// add room user count ++
+		RedisClient.Incr(logic.getRoomOnlineCountKey(fmt.Sprintf("%d", roomId)))
+	}
+	return
+}
+
+// leaveRoom remove user from the room member list when the last conn of the user left the room
+func (logic *Logic) leaveRoom(userId int, roomId int) (left bool) {
+	connKey := logic.getRoomConnKey(strconv.Itoa(roomId))
+	conns, err := RedisClient.HIncrBy(connKey, strconv.Itoa(userId), -1).Result()
+	if err != nil {
+		logrus.Warnf("logic,leaveRoom HIncrBy err:%s", err.Error())
+		return false
+	}
+	if conns > 0 {
+		return false
+	}
+	RedisClient.HDel(connKey, strconv.Itoa(userId))
+	roomUserKey := logic.getRoomUserKey(strconv.Itoa(roomId))
+	removed, err := RedisClient.HDel(roomUserKey, fmt.Sprintf("%d", userId)).Result()
+	if err != nil {
+		logrus.Warnf("HDel getRoomUserKey err : %s", err)
+		return false
+	}
+	if removed > 0 {
+		// room user count --
+		countKey := logic.getRoomOnlineCountKey(fmt.Sprintf("%d", roomId))
+		if count, _ := RedisClient.Get(countKey).Int(); count > 0 {
+			RedisClient.Decr(countKey)
+		}
+	}
+	return removed > 0
+}
+
+// isRoomMember return true if a conn of the user is in the room
+func (logic *Logic) isRoomMember(roomId int, userId int) bool {
+	member, err := RedisClient.HExists(logic.getRoomUserKey(strconv.Itoa(roomId)), strconv.Itoa(userId)).Result()
+	if err != nil {
+		logrus.Warnf("logic,isRoomMember redis err:%s", err.Error())
+	}
+	return member
+}
+
+// publishRoomMembers push the room member list to the room after members changed
+func (logic *Logic) publishRoomMembers(roomId int) (err error) {
+	roomUserKey := logic.getRoomUserKey(strconv.Itoa(roomId))
+	roomUserInfo, err := RedisClient.HGetAll(roomUserKey).Result()
+	if err != nil {
+		logrus.Warnf("RedisCli HGetAll roomUserInfo key:%s, err: %s", roomUserKey, err)
+	}
+	return logic.PublishRoomInfo(roomId, len(roomUserInfo), roomUserInfo)
+}
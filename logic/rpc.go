@@ -9,10 +9,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gochat/config"
 	"gochat/logic/dao"
+	"gochat/pkg/metrics"
 	"gochat/proto"
 	"gochat/tools"
 	"strconv"
@@ -75,21 +77,18 @@ func (rpc *RpcLogic) Login(ctx context.Context, args *proto.LoginRequest, reply
 	userData := make(map[string]interface{})
 	userData["userId"] = data.Id
 	userData["userName"] = data.UserName
-	//check is login
-	token, _ := RedisSessClient.Get(loginSessionId).Result()
-	if token != "" {
-		//logout already login user session
-		oldSession := tools.CreateSessionId(token)
-		err := RedisSessClient.Del(oldSession).Err()
-		if err != nil {
-			return errors.New("logout user fail!token is:" + token)
-		}
+	// a user can login on many devices, every login keeps its own session,
+	// sess_map is the set of all live tokens of the user
+	if RedisSessClient.Type(loginSessionId).Val() == "string" {
+		// sess_map written by old version only held one token
+		RedisSessClient.Del(loginSessionId)
 	}
-	RedisSessClient.Do("MULTI")
-	RedisSessClient.HMSet(sessionId, userData)
-	RedisSessClient.Expire(sessionId, 86400*time.Second)
-	RedisSessClient.Set(loginSessionId, randToken, 86400*time.Second)
-	err = RedisSessClient.Do("EXEC").Err()
+	pipe := RedisSessClient.TxPipeline()
+	pipe.HMSet(sessionId, userData)
+	pipe.Expire(sessionId, 86400*time.Second)
+	pipe.SAdd(loginSessionId, randToken)
+	pipe.Expire(loginSessionId, 86400*time.Second)
+	_, err = pipe.Exec()
 	//err = RedisSessClient.Set(authToken, data.Id, 86400*time.Second).Err()
 	if err != nil {
 		logrus.Infof("register set redis token fail!")
@@ -150,20 +149,12 @@ func (rpc *RpcLogic) Logout(ctx context.Context, args *proto.LogoutRequest, repl
 	}
 	intUserId, _ := strconv.Atoi(userDataMap["userId"])
 	sessIdMap := tools.GetSessionIdByUserId(intUserId)
-	//del sess_map like sess_map_1
-	err = RedisSessClient.Del(sessIdMap).Err()
+	//only logout this session, other devices of the user stay logged in
+	err = RedisSessClient.SRem(sessIdMap, authToken).Err()
 	if err != nil {
 		logrus.Infof("logout del sess map error:%s", err.Error())
 		return err
 	}
-	//del serverId
-	logic := new(Logic)
-	serverIdKey := logic.getUserKey(fmt.Sprintf("%d", intUserId))
-	err = RedisSessClient.Del(serverIdKey).Err()
-	if err != nil {
-		logrus.Infof("logout del server id error:%s", err.Error())
-		return err
-	}
 	err = RedisSessClient.Del(sessionName).Err()
 	if err != nil {
 		logrus.Infof("logout error:%s", err.Error())
@@ -177,9 +168,16 @@ func (rpc *RpcLogic) Logout(ctx context.Context, args *proto.LogoutRequest, repl
 *
 single send msg
 */
-func (rpc *RpcLogic) Push(ctx context.Context, args *proto.Send, reply *proto.SuccessReply) (err error) {
+func (rpc *RpcLogic) Push(ctx context.Context, args *proto.Send, reply *proto.PushReply) (err error) {
 	reply.Code = config.FailReplyCode
 	sendData := args
+	if sendData.ToUserName == "" {
+		// msg sent on a connect conn only knows the receiver userId
+		sendData.ToUserName = new(dao.User).GetUserNameByUserId(sendData.ToUserId)
+	}
+	// every single msg has its own id, client ack it and sender query its delivery status by it
+	sendData.SeqId = tools.GetSnowflakeId()
+	reply.SeqId = sendData.SeqId
 	var bodyBytes []byte
 	bodyBytes, err = json.Marshal(sendData)
 	if err != nil {
@@ -187,18 +185,34 @@ func (rpc *RpcLogic) Push(ctx context.Context, args *proto.Send, reply *proto.Su
 		return
 	}
 	logic := new(Logic)
-	userSidKey := logic.getUserKey(fmt.Sprintf("%d", sendData.ToUserId))
-	serverIdStr := RedisSessClient.Get(userSidKey).Val()
-	//var serverIdInt int
-	//serverIdInt, err = strconv.Atoi(serverId)
-	if err != nil {
-		logrus.Errorf("logic,push parse int fail:%s", err.Error())
+	serverIds := logic.getUserServerIds(sendData.ToUserId)
+	if len(serverIds) == 0 {
+		// user not connected, keep msg in offline inbox until next connect
+		if err = logic.SaveOfflineMsg(sendData.ToUserId, sendData.SeqId, bodyBytes); err != nil {
+			logrus.Errorf("logic,push save offline msg err: %s", err.Error())
+			return
+		}
+		reply.Status = config.MsgStatusOffline
+		if err = logic.setMsgStatus(sendData.SeqId, sendData.FromUserId, sendData.ToUserId, reply.Status); err != nil {
+			logrus.Warnf("logic,push set msg status err: %s", err.Error())
+		}
+		reply.Code = config.SuccessReplyCode
+		reply.Msg = "offline"
 		return
 	}
-	err = logic.PublishToUser(serverIdStr, sendData.ToUserId, bodyBytes)
-	if err != nil {
-		logrus.Errorf("logic,redis publish err: %s", err.Error())
-		return
+	// status set before publish, so a fast client ack is not overwritten
+	reply.Status = config.MsgStatusSent
+	if err = logic.setMsgStatus(sendData.SeqId, sendData.FromUserId, sendData.ToUserId, reply.Status); err != nil {
+		logrus.Warnf("logic,push set msg status err: %s", err.Error())
+	}
+	// user may be connected to many connect servers, publish once per server,
+	// the connect server push the msg to every conn of the user on it
+	for _, serverId := range serverIds {
+		err = logic.PublishToUser(serverId, sendData.ToUserId, sendData.SeqId, bodyBytes)
+		if err != nil {
+			logrus.Errorf("logic,redis publish err: %s", err.Error())
+			return
+		}
 	}
 	reply.Code = config.SuccessReplyCode
 	return
@@ -214,6 +228,9 @@ func (rpc *RpcLogic) PushRoom(ctx context.Context, args *proto.Send, reply *prot
 	roomId := sendData.RoomId
 	logic := new(Logic)
 	roomUserInfo := make(map[string]string)
+	if reply.Msg = logic.roomSendDenied(roomId, args.FromUserId); reply.Msg != "" {
+		return
+	}
 	roomUserKey := logic.getRoomUserKey(strconv.Itoa(roomId))
 	roomUserInfo, err = RedisClient.HGetAll(roomUserKey).Result()
 	if err != nil {
@@ -230,6 +247,11 @@ func (rpc *RpcLogic) PushRoom(ctx context.Context, args *proto.Send, reply *prot
 	sendData.FromUserName = args.FromUserName
 	sendData.Op = config.OpRoomSend
 	sendData.CreateTime = tools.GetNowDateTime()
+	if sendData.MsgId, err = logic.saveRoomMsg(sendData); err != nil {
+		// the room still gets the msg, it is only missing from history
+		logrus.Errorf("logic,PushRoom save room msg roomId=%d err:%s", roomId, err.Error())
+		metrics.RoomMsgSaveFailuresTotal.Inc()
+	}
 	bodyBytes, err = json.Marshal(sendData)
 	if err != nil {
 		logrus.Errorf("logic,PushRoom Marshal err:%s", err.Error())
@@ -244,6 +266,92 @@ func (rpc *RpcLogic) PushRoom(ctx context.Context, args *proto.Send, reply *prot
 	return
 }
 
+/*
+*
+get room history msg, page by msg id cursor
+*/
+func (rpc *RpcLogic) GetRoomHistory(ctx context.Context, args *proto.GetRoomHistoryRequest, reply *proto.GetRoomHistoryReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.RoomId <= 0 || args.UserId <= 0 {
+		return errors.New("getRoomHistory roomId or userId empty")
+	}
+	logic := new(Logic)
+	if logic.isBanned(args.RoomId, args.UserId) {
+		return errors.New("banned from room")
+	}
+	if !logic.isRoomMember(args.RoomId, args.UserId) {
+		return errors.New("not in room")
+	}
+	limit := args.Limit
+	if limit <= 0 {
+		limit = config.RoomHistoryLimit
+	}
+	if limit > config.RoomHistoryMaxLimit {
+		limit = config.RoomHistoryMaxLimit
+	}
+	m := new(dao.Message)
+	// fetch one more row to know if there is another page
+	list, err := m.GetRoomHistory(args.RoomId, args.Before, args.After, limit+1)
+	if err != nil {
+		logrus.Errorf("logic,GetRoomHistory err:%s", err.Error())
+		return
+	}
+	if len(list) > limit {
+		reply.HasMore = true
+		if args.After > 0 && args.Before <= 0 {
+			list = list[:limit]
+		} else {
+			list = list[1:]
+		}
+	}
+	reply.Messages = make([]proto.RoomHistoryMsg, 0, len(list))
+	for _, item := range list {
+		reply.Messages = append(reply.Messages, proto.RoomHistoryMsg{
+			MsgId:        item.MsgId,
+			RoomId:       item.RoomId,
+			FromUserId:   item.FromUserId,
+			FromUserName: item.FromUserName,
+			Msg:          item.Content,
+			CreateTime:   item.CreateTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+/*
+*
+relay an ephemeral room signal like typing, it is not saved and not acked
+*/
+func (rpc *RpcLogic) PushRoomSignal(ctx context.Context, args *proto.Send, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.RoomId <= 0 || args.FromUserId <= 0 || args.Msg == "" {
+		logrus.Warnf("logic,PushRoomSignal bad signal %+v", args)
+		return
+	}
+	logic := new(Logic)
+	if reply.Msg = logic.roomSendDenied(args.RoomId, args.FromUserId); reply.Msg != "" {
+		return
+	}
+	body, err := json.Marshal(proto.RoomSignal{
+		Op:           config.OpRoomSignal,
+		RoomId:       args.RoomId,
+		FromUserId:   args.FromUserId,
+		FromUserName: args.FromUserName,
+		Signal:       args.Msg,
+	})
+	if err != nil {
+		logrus.Errorf("logic,PushRoomSignal Marshal err:%s", err.Error())
+		return
+	}
+	if err = logic.PublishRoomSignal(args.RoomId, args.FromUserId, body); err != nil {
+		logrus.Errorf("logic,PushRoomSignal err:%s", err.Error())
+		return
+	}
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
 /*
 *
 get room online person count
@@ -263,6 +371,28 @@ func (rpc *RpcLogic) Count(ctx context.Context, args *proto.Send, reply *proto.S
 	return
 }
 
+/*
+*
+return the room count, and the members for a room info query, to the asking conn only
+*/
+func (rpc *RpcLogic) GetRoomStat(ctx context.Context, args *proto.Send, reply *proto.RoomStatReply) (err error) {
+	reply.Code = config.FailReplyCode
+	logic := new(Logic)
+	roomId := strconv.Itoa(args.RoomId)
+	if args.Op == config.OpRoomInfoSend {
+		if reply.RoomUserInfo, err = RedisClient.HGetAll(logic.getRoomUserKey(roomId)).Result(); err != nil {
+			logrus.Errorf("logic,GetRoomStat roomId=%d err:%s", args.RoomId, err.Error())
+			return
+		}
+		reply.Count = len(reply.RoomUserInfo)
+	} else if reply.Count, err = RedisSessClient.Get(logic.getRoomOnlineCountKey(roomId)).Int(); err != nil && err != redis.Nil {
+		logrus.Errorf("logic,GetRoomStat roomId=%d err:%s", args.RoomId, err.Error())
+		return
+	}
+	reply.Code = config.SuccessReplyCode
+	return nil
+}
+
 /*
 *
 get room info
@@ -305,19 +435,18 @@ func (rpc *RpcLogic) Connect(ctx context.Context, args *proto.ConnectRequest, re
 		return
 	}
 	reply.UserId, _ = strconv.Atoi(userInfo["userId"])
-	roomUserKey := logic.getRoomUserKey(strconv.Itoa(args.RoomId))
+	reply.UserName = userInfo["userName"]
+	if reply.UserId != 0 && args.RoomId > 0 && logic.isBanned(args.RoomId, reply.UserId) {
+		logrus.Infof("logic,connect userId=%d banned from roomId=%d", reply.UserId, args.RoomId)
+		reply.UserId = 0
+		return errors.New("banned from room")
+	}
 	if reply.UserId != 0 {
-		userKey := logic.getUserKey(fmt.Sprintf("%d", reply.UserId))
-		logrus.Infof("logic redis set userKey:%s, serverId : %s", userKey, args.ServerId)
-		validTime := config.RedisBaseValidTime * time.Second
-		err = RedisClient.Set(userKey, args.ServerId, validTime).Err()
-		if err != nil {
-			logrus.Warnf("logic set err:%s", err)
+		if err = logic.addUserConn(reply.UserId, args.DeviceId, args.ServerId); err != nil {
+			logrus.Warnf("logic addUserConn err:%s", err)
 		}
-		if RedisClient.HGet(roomUserKey, fmt.Sprintf("%d", reply.UserId)).Val() == "" {
-			RedisClient.HSet(roomUserKey, fmt.Sprintf("%d", reply.UserId), userInfo["userName"])
-			// add room user count ++
-			RedisClient.Incr(logic.getRoomOnlineCountKey(fmt.Sprintf("%d", args.RoomId)))
+		if args.RoomId > 0 {
+			logic.joinRoom(reply.UserId, userInfo["userName"], args.RoomId)
 		}
 	}
 	logrus.Infof("logic rpc userId:%d", reply.UserId)
@@ -326,29 +455,138 @@ func (rpc *RpcLogic) Connect(ctx context.Context, args *proto.ConnectRequest, re
 
 func (rpc *RpcLogic) DisConnect(ctx context.Context, args *proto.DisConnectRequest, reply *proto.DisConnectReply) (err error) {
 	logic := new(Logic)
-	roomUserKey := logic.getRoomUserKey(strconv.Itoa(args.RoomId))
-	// room user count --
-	if args.RoomId > 0 {
-		count, _ := RedisSessClient.Get(logic.getRoomOnlineCountKey(fmt.Sprintf("%d", args.RoomId))).Int()
-		if count > 0 {
-			RedisClient.Decr(logic.getRoomOnlineCountKey(fmt.Sprintf("%d", args.RoomId))).Result()
-		}
+	// device conn only removed if not already reconnected to another server,
+	// so single push of an offline user goes to offline inbox
+	if args.UserId != 0 && args.ServerId != "" {
+		logic.delUserConn(args.UserId, args.DeviceId, args.ServerId)
 	}
-	// room login user--
-	if args.UserId != 0 {
-		err = RedisClient.HDel(roomUserKey, fmt.Sprintf("%d", args.UserId)).Err()
-		if err != nil {
-			logrus.Warnf("HDel getRoomUserKey err : %s", err)
+	// room membership is per room, leave every room the conn joined
+	for _, roomId := range args.RoomIds {
+		if roomId <= 0 || !logic.leaveRoom(args.UserId, roomId) {
+			continue
+		}
+		if err = logic.publishRoomMembers(roomId); err != nil {
+			logrus.Warnf("publish room members roomId=%d err: %s", roomId, err.Error())
 		}
 	}
-	//below code can optimize send a signal to queue,another process get a signal from queue,then push event to websocket
-	roomUserInfo, err := RedisClient.HGetAll(roomUserKey).Result()
+	return
+}
+
+/*
+*
+save a single msg to user offline inbox, called by connect layer when user not online
+*/
+func (rpc *RpcLogic) SaveOfflineMsg(ctx context.Context, args *proto.SaveOfflineMsgRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 {
+		return errors.New("saveOfflineMsg userId empty")
+	}
+	logic := new(Logic)
+	if err = logic.SaveOfflineMsg(args.UserId, args.SeqId, args.Msg); err != nil {
+		logrus.Errorf("logic,SaveOfflineMsg err:%s", err.Error())
+		return
+	}
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+/*
+*
+ack user offline inbox up to AckId, then return the next msgs of it
+*/
+func (rpc *RpcLogic) GetOfflineMsg(ctx context.Context, args *proto.OfflineMsgRequest, reply *proto.OfflineMsgReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 {
+		return errors.New("getOfflineMsg userId empty")
+	}
+	limit := args.Limit
+	if limit <= 0 || limit > config.OfflineMsgBatch {
+		limit = config.OfflineMsgBatch
+	}
+	logic := new(Logic)
+	reply.Msgs, reply.AckId, reply.HasMore, err = logic.GetOfflineMsg(args.UserId, args.AckId, limit)
 	if err != nil {
-		logrus.Warnf("RedisCli HGetAll roomUserInfo key:%s, err: %s", roomUserKey, err)
+		logrus.Errorf("logic,GetOfflineMsg err:%s", err.Error())
+		return
+	}
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+/*
+*
+user join a room on an existing conn
+*/
+func (rpc *RpcLogic) JoinRoom(ctx context.Context, args *proto.RoomMemberRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 || args.RoomId <= 0 {
+		return errors.New("joinRoom userId or roomId empty")
+	}
+	logic := new(Logic)
+	if logic.isBanned(args.RoomId, args.UserId) {
+		return errors.New("banned from room")
 	}
-	if err = logic.PublishToRoom(args.RoomId, len(roomUserInfo), roomUserInfo, nil); err != nil {
-		logrus.Warnf("publish RedisPublishRoomCount err: %s", err.Error())
+	u := new(dao.User)
+	if logic.joinRoom(args.UserId, u.GetUserNameByUserId(args.UserId), args.RoomId) {
+		if err = logic.publishRoomMembers(args.RoomId); err != nil {
+			logrus.Warnf("publish room members roomId=%d err: %s", args.RoomId, err.Error())
+		}
+	}
+	reply.Code = config.SuccessReplyCode
+	return nil
+}
+
+/*
+*
+user leave a room on an existing conn
+*/
+func (rpc *RpcLogic) LeaveRoom(ctx context.Context, args *proto.RoomMemberRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 || args.RoomId <= 0 {
+		return errors.New("leaveRoom userId or roomId empty")
+	}
+	logic := new(Logic)
+	if logic.leaveRoom(args.UserId, args.RoomId) {
+		if err = logic.publishRoomMembers(args.RoomId); err != nil {
+			logrus.Warnf("publish room members roomId=%d err: %s", args.RoomId, err.Error())
+		}
+	}
+	reply.Code = config.SuccessReplyCode
+	return nil
+}
+
+/*
+*
+client acked a single msg, mark it delivered
+*/
+func (rpc *RpcLogic) AckMsg(ctx context.Context, args *proto.MsgAckRequest, reply *proto.SuccessReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 || args.SeqId == "" {
+		return errors.New("ackMsg userId or seqId empty")
+	}
+	logic := new(Logic)
+	if err = logic.ackMsg(args.UserId, args.SeqId); err != nil {
+		logrus.Warnf("logic,AckMsg userId=%d seq=%s err:%s", args.UserId, args.SeqId, err.Error())
+		return
+	}
+	reply.Code = config.SuccessReplyCode
+	return
+}
+
+/*
+*
+sender query the delivery status of a single msg
+*/
+func (rpc *RpcLogic) GetMsgStatus(ctx context.Context, args *proto.MsgStatusRequest, reply *proto.MsgStatusReply) (err error) {
+	reply.Code = config.FailReplyCode
+	if args.UserId <= 0 || args.SeqId == "" {
+		return errors.New("getMsgStatus userId or seqId empty")
+	}
+	logic := new(Logic)
+	reply.SeqId = args.SeqId
+	if reply.ToUserId, reply.Status, err = logic.getMsgStatus(args.UserId, args.SeqId); err != nil {
 		return
 	}
+	reply.Code = config.SuccessReplyCode
 	return
 }
@@ -0,0 +1,48 @@
+package logic
+
+import (
+	"strconv"
+	"time"
+
+	"gochat/config"
+)
+
+// addUserConn record which connect server a device of the user connected to,
+// the user conns is a hash of deviceId => serverId, so a user can be online on many devices
+func (logic *Logic) addUserConn(userId int, deviceId string, serverId string) (err error) {
+	if deviceId == "" {
+		deviceId = serverId
+	}
+	key := logic.getUserServerKey(strconv.Itoa(userId))
+	pipe := RedisClient.TxPipeline()
+	pipe.HSet(key, deviceId, serverId)
+	pipe.Expire(key, config.RedisBaseValidTime*time.Second)
+	_, err = pipe.Exec()
+	return
+}
+
+// delUserConn remove the device conn, only if the device not reconnected to another server yet
+// an empty deviceId means the device still online with a newer conn on the same server
+func (logic *Logic) delUserConn(userId int, deviceId string, serverId string) {
+	if deviceId == "" {
+		return
+	}
+	key := logic.getUserServerKey(strconv.Itoa(userId))
+	if RedisClient.HGet(key, deviceId).Val() == serverId {
+		RedisClient.HDel(key, deviceId)
+	}
+}
+
+// getUserServerIds return the distinct connect servers the user online on
+func (logic *Logic) getUserServerIds(userId int) (serverIds []string) {
+	key := logic.getUserServerKey(strconv.Itoa(userId))
+	seen := make(map[string]struct{})
+	for _, serverId := range RedisClient.HVals(key).Val() {
+		if _, ok := seen[serverId]; ok || serverId == "" {
+			continue
+		}
+		seen[serverId] = struct{}{}
+		serverIds = append(serverIds, serverId)
+	}
+	return
+}
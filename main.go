@@ -12,6 +12,7 @@ import (
 	"gochat/connect"
 	"gochat/logic"
 	"gochat/pkg/logging"
+	"gochat/pkg/tlsreload"
 	"gochat/site"
 	"gochat/task"
 	"os"
@@ -29,9 +30,16 @@ func main() {
 	case "logic":
 		logic.New().Run()
 	case "connect_websocket":
+		// Run and RunTcp return after the server is stopped and drained
 		connect.New().Run()
+		return
 	case "connect_tcp":
 		connect.New().RunTcp()
+		return
+	case "connect_http":
+		// sse and long poll
+		connect.New().RunHttp()
+		return
 	case "task":
 		task.New().Run()
 	case "api":
@@ -45,6 +53,13 @@ func main() {
 	fmt.Println(fmt.Sprintf("run %s module done!", module))
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	<-quit
+	for sig := range quit {
+		if sig == syscall.SIGHUP {
+			// reload tls certs, conns already open keep their cert
+			tlsreload.ReloadAll()
+			continue
+		}
+		break
+	}
 	fmt.Println("Server exiting")
 }
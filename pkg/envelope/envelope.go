@@ -0,0 +1,183 @@
+// Package envelope implements the frame format of proto.Msg on the websocket wire.
+//
+// A websocket client picks the format by the Sec-WebSocket-Protocol header:
+//
+//	gochat.v1.json  text frames   {"ver":1,"op":3,"seq":"abc","body":{...}}
+//	gochat.v1.bin   binary frames ver(1) | op(2, big endian) | seqLen(1) | seq | body
+//
+// Without a subprotocol the conn stays on the legacy format, only the body is sent.
+// A batch frame carries several frames in its body: a json array of frames, or binary
+// frames each prefixed by its length (4, big endian).
+// See docs/websocket_protocol.md for the ops and bodies.
+package envelope
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+)
+
+const (
+	SubprotocolJSON   = "gochat.v1.json"
+	SubprotocolBinary = "gochat.v1.bin"
+
+	binaryHeaderLength = 4 // ver + op + seqLen
+	batchLengthSize    = 4 // length prefix of a frame in a binary batch
+)
+
+var (
+	ErrShortFrame  = errors.New("envelope: frame too short")
+	ErrSeqTooLong  = errors.New("envelope: seq longer than 255 bytes")
+	ErrOpOverflow  = errors.New("envelope: op or ver out of range")
+	ErrInvalidBody = errors.New("envelope: json body invalid")
+)
+
+// Subprotocols are the formats the server supports, in the order it prefers them
+var Subprotocols = []string{SubprotocolBinary, SubprotocolJSON}
+
+// Frame is one proto.Msg on the wire
+type Frame struct {
+	Ver  int
+	Op   int
+	Seq  string
+	Body []byte
+}
+
+type jsonFrame struct {
+	Ver  int             `json:"ver"`
+	Op   int             `json:"op"`
+	Seq  string          `json:"seq,omitempty"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// EncodeJSON encode the frame as a json object, body must be json itself and is embedded as is
+func EncodeJSON(f *Frame) ([]byte, error) {
+	wire := jsonFrame{Ver: f.Ver, Op: f.Op, Seq: f.Seq}
+	if len(f.Body) > 0 {
+		if !json.Valid(f.Body) {
+			return nil, ErrInvalidBody
+		}
+		wire.Body = f.Body
+	}
+	return json.Marshal(wire)
+}
+
+// DecodeJSON decode a json frame, the body is returned as the raw json of the body field
+func DecodeJSON(data []byte) (*Frame, error) {
+	var wire jsonFrame
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return nil, err
+	}
+	return &Frame{Ver: wire.Ver, Op: wire.Op, Seq: wire.Seq, Body: wire.Body}, nil
+}
+
+// EncodeBinary encode the frame as ver(1) | op(2) | seqLen(1) | seq | body
+func EncodeBinary(f *Frame) ([]byte, error) {
+	if len(f.Seq) > math.MaxUint8 {
+		return nil, ErrSeqTooLong
+	}
+	if f.Ver < 0 || f.Ver > math.MaxUint8 || f.Op < 0 || f.Op > math.MaxUint16 {
+		return nil, ErrOpOverflow
+	}
+	buf := make([]byte, binaryHeaderLength+len(f.Seq)+len(f.Body))
+	buf[0] = byte(f.Ver)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(f.Op))
+	buf[3] = byte(len(f.Seq))
+	n := copy(buf[binaryHeaderLength:], f.Seq)
+	copy(buf[binaryHeaderLength+n:], f.Body)
+	return buf, nil
+}
+
+// DecodeBinary decode a binary frame, the body shares memory with data
+func DecodeBinary(data []byte) (*Frame, error) {
+	if len(data) < binaryHeaderLength {
+		return nil, ErrShortFrame
+	}
+	seqLen := int(data[3])
+	if len(data) < binaryHeaderLength+seqLen {
+		return nil, ErrShortFrame
+	}
+	return &Frame{
+		Ver:  int(data[0]),
+		Op:   int(binary.BigEndian.Uint16(data[1:3])),
+		Seq:  string(data[binaryHeaderLength : binaryHeaderLength+seqLen]),
+		Body: data[binaryHeaderLength+seqLen:],
+	}, nil
+}
+
+// EncodeJSONBatch put encoded json frames in the body of one batch frame of op
+func EncodeJSONBatch(ver, op int, frames [][]byte) []byte {
+	n := 32
+	for _, frame := range frames {
+		n += len(frame) + 1
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, `{"ver":`...)
+	buf = strconv.AppendInt(buf, int64(ver), 10)
+	buf = append(buf, `,"op":`...)
+	buf = strconv.AppendInt(buf, int64(op), 10)
+	buf = append(buf, `,"body":[`...)
+	for i, frame := range frames {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, frame...)
+	}
+	return append(buf, "]}"...)
+}
+
+// DecodeJSONBatch split the body of a json batch frame into its frames
+func DecodeJSONBatch(body []byte) ([]*Frame, error) {
+	var wire []jsonFrame
+	if err := json.Unmarshal(body, &wire); err != nil {
+		return nil, err
+	}
+	frames := make([]*Frame, len(wire))
+	for i, w := range wire {
+		frames[i] = &Frame{Ver: w.Ver, Op: w.Op, Seq: w.Seq, Body: w.Body}
+	}
+	return frames, nil
+}
+
+// EncodeBinaryBatch put encoded binary frames in the body of one batch frame of op
+func EncodeBinaryBatch(ver, op int, frames [][]byte) ([]byte, error) {
+	if ver < 0 || ver > math.MaxUint8 || op < 0 || op > math.MaxUint16 {
+		return nil, ErrOpOverflow
+	}
+	n := binaryHeaderLength
+	for _, frame := range frames {
+		n += batchLengthSize + len(frame)
+	}
+	buf := make([]byte, binaryHeaderLength, n)
+	buf[0] = byte(ver)
+	binary.BigEndian.PutUint16(buf[1:3], uint16(op))
+	for _, frame := range frames {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(frame)))
+		buf = append(buf, frame...)
+	}
+	return buf, nil
+}
+
+// DecodeBinaryBatch split the body of a binary batch frame into its frames, they share memory with body
+func DecodeBinaryBatch(body []byte) ([]*Frame, error) {
+	var frames []*Frame
+	for len(body) > 0 {
+		if len(body) < batchLengthSize {
+			return nil, ErrShortFrame
+		}
+		n := binary.BigEndian.Uint32(body)
+		body = body[batchLengthSize:]
+		if uint64(len(body)) < uint64(n) {
+			return nil, ErrShortFrame
+		}
+		frame, err := DecodeBinary(body[:n])
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+		body = body[n:]
+	}
+	return frames, nil
+}
@@ -0,0 +1,112 @@
+package envelope
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	cases := []*Frame{
+		{Ver: 1, Op: 3, Seq: "abc", Body: []byte(`{"msg":"hi"}`)},
+		{Ver: 1, Op: 11, Seq: "", Body: []byte(`{}`)},
+		{Ver: 1, Op: 65535, Seq: "s", Body: nil},
+	}
+	for _, f := range cases {
+		data, err := EncodeBinary(f)
+		if err != nil {
+			t.Fatalf("EncodeBinary(%+v) err:%v", f, err)
+		}
+		got, err := DecodeBinary(data)
+		if err != nil {
+			t.Fatalf("DecodeBinary err:%v", err)
+		}
+		if got.Ver != f.Ver || got.Op != f.Op || got.Seq != f.Seq || !bytes.Equal(got.Body, f.Body) {
+			t.Errorf("round trip mismatch, want %+v got %+v", f, got)
+		}
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	if _, err := EncodeBinary(&Frame{Op: 1 << 16}); err != ErrOpOverflow {
+		t.Errorf("want ErrOpOverflow, got %v", err)
+	}
+	if _, err := EncodeBinary(&Frame{Seq: string(make([]byte, 256))}); err != ErrSeqTooLong {
+		t.Errorf("want ErrSeqTooLong, got %v", err)
+	}
+	if _, err := DecodeBinary([]byte{1, 0}); err != ErrShortFrame {
+		t.Errorf("want ErrShortFrame, got %v", err)
+	}
+	// seq length says 5 but only 2 bytes follow
+	if _, err := DecodeBinary([]byte{1, 0, 3, 5, 'a', 'b'}); err != ErrShortFrame {
+		t.Errorf("want ErrShortFrame, got %v", err)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	f := &Frame{Ver: 1, Op: 3, Seq: "42", Body: []byte(`{"roomId":1,"msg":"hi"}`)}
+	data, err := EncodeJSON(f)
+	if err != nil {
+		t.Fatalf("EncodeJSON err:%v", err)
+	}
+	want := `{"ver":1,"op":3,"seq":"42","body":{"roomId":1,"msg":"hi"}}`
+	if string(data) != want {
+		t.Errorf("EncodeJSON want %s got %s", want, data)
+	}
+	got, err := DecodeJSON(data)
+	if err != nil {
+		t.Fatalf("DecodeJSON err:%v", err)
+	}
+	if got.Ver != f.Ver || got.Op != f.Op || got.Seq != f.Seq || !bytes.Equal(got.Body, f.Body) {
+		t.Errorf("round trip mismatch, want %+v got %+v", f, got)
+	}
+	if _, err := EncodeJSON(&Frame{Body: []byte("not json")}); err != ErrInvalidBody {
+		t.Errorf("want ErrInvalidBody, got %v", err)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	frames := []*Frame{
+		{Ver: 1, Op: 3, Seq: "1", Body: []byte(`{"msg":"hi"}`)},
+		{Ver: 1, Op: 4, Body: []byte(`{"count":2}`)},
+	}
+	var jsonFrames, binFrames [][]byte
+	for _, f := range frames {
+		data, _ := EncodeJSON(f)
+		jsonFrames = append(jsonFrames, data)
+		data, _ = EncodeBinary(f)
+		binFrames = append(binFrames, data)
+	}
+
+	batch, err := DecodeJSON(EncodeJSONBatch(1, 20, jsonFrames))
+	if err != nil || batch.Op != 20 {
+		t.Fatalf("json batch frame %+v err:%v", batch, err)
+	}
+	gotJSON, err := DecodeJSONBatch(batch.Body)
+	if err != nil {
+		t.Fatalf("DecodeJSONBatch err:%v", err)
+	}
+	data, err := EncodeBinaryBatch(1, 20, binFrames)
+	if err != nil {
+		t.Fatalf("EncodeBinaryBatch err:%v", err)
+	}
+	if batch, err = DecodeBinary(data); err != nil || batch.Op != 20 {
+		t.Fatalf("binary batch frame %+v err:%v", batch, err)
+	}
+	gotBin, err := DecodeBinaryBatch(batch.Body)
+	if err != nil {
+		t.Fatalf("DecodeBinaryBatch err:%v", err)
+	}
+	for _, got := range [][]*Frame{gotJSON, gotBin} {
+		if len(got) != len(frames) {
+			t.Fatalf("got %d frames, want %d", len(got), len(frames))
+		}
+		for i, f := range frames {
+			if got[i].Op != f.Op || got[i].Seq != f.Seq || !bytes.Equal(got[i].Body, f.Body) {
+				t.Errorf("frame %d: want %+v got %+v", i, f, got[i])
+			}
+		}
+	}
+	if _, err := DecodeBinaryBatch(batch.Body[:len(batch.Body)-1]); err != ErrShortFrame {
+		t.Errorf("cut batch: want ErrShortFrame, got %v", err)
+	}
+}
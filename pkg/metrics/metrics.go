@@ -88,7 +88,7 @@ var (
 			Name: "gochat_connections_active",
 			Help: "Current active connections",
 		},
-		[]string{"service", "type"}, // type: websocket/tcp
+		[]string{"service", "type"}, // type: ws/tcp/sse/poll
 	)
 
 	ConnectionsTotal = promauto.NewCounterVec(
@@ -96,7 +96,7 @@ var (
 			Name: "gochat_connections_total",
 			Help: "Total connection attempts",
 		},
-		[]string{"service", "type", "status"},
+		[]string{"service", "type", "status"}, // status: accepted/rejected
 	)
 
 	MessagesTotal = promauto.NewCounterVec(
@@ -106,6 +106,54 @@ var (
 		},
 		[]string{"service", "direction"}, // direction: sent/received
 	)
+
+	ChannelDroppedMessagesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gochat_channel_dropped_messages_total",
+			Help: "Total messages dropped because a client send queue was full",
+		},
+		[]string{"room", "reason"}, // reason: drop_newest/drop_oldest/timeout/disconnect
+	)
+
+	RateLimitViolationsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gochat_ratelimit_violations_total",
+			Help: "Total client frames over the inbound rate limit",
+		},
+		[]string{"scope", "op", "action"}, // scope: conn/user, action: warn/throttle/close
+	)
+
+	ConnectionRTT = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gochat_connection_rtt_seconds",
+			Help:    "Round trip time of heartbeat pings",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"type"},
+	)
+
+	HeartbeatTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gochat_heartbeat_timeouts_total",
+			Help: "Total connections closed after missed heartbeats",
+		},
+		[]string{"type"},
+	)
+
+	AdmissionRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gochat_admission_rejected_total",
+			Help: "Total connections refused by admission control",
+		},
+		[]string{"type", "reason"}, // reason: max_conns/max_conns_per_ip/max_conns_per_user/accept_rate
+	)
+
+	AdmissionSourceIPs = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gochat_admission_source_ips",
+			Help: "Current distinct source ips with open connections",
+		},
+	)
 )
 
 // Business Metrics
@@ -126,6 +174,13 @@ var (
 		[]string{"operation"}, // operation: push_single/push_room/count/room_info
 	)
 
+	RoomMsgSaveFailuresTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gochat_room_msg_save_failures_total",
+			Help: "Total room messages published without a msg id, the save to history failed",
+		},
+	)
+
 	QueueMessagesTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gochat_queue_messages_total",
@@ -11,8 +11,14 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Route is an extra handler served next to the metrics, like a debug page of the service
+type Route struct {
+	Pattern string
+	Handler http.Handler
+}
+
 // StartMetricsServer starts an HTTP server for Prometheus metrics and pprof endpoints
-func StartMetricsServer(port int) *http.Server {
+func StartMetricsServer(port int, routes ...Route) *http.Server {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +38,9 @@ func StartMetricsServer(port int) *http.Server {
 	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
 	mux.Handle("/debug/pprof/mutex", pprof.Handler("mutex"))
 	mux.Handle("/debug/pprof/allocs", pprof.Handler("allocs"))
+	for _, route := range routes {
+		mux.Handle(route.Pattern, route.Handler)
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
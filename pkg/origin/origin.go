@@ -0,0 +1,84 @@
+// Package origin check the Origin of browser requests against an allowlist, it is shared by
+// the websocket upgrader of the connect layer and the CORS middleware of the api layer.
+package origin
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Allowlist is a parsed list of allowed origins. a pattern is one of:
+//
+//	"*"                          any origin
+//	"https://chat.example.com"   this origin only, scheme and port must match
+//	"https://*.example.com"      any subdomain of example.com, not example.com itself
+//	"*.example.com"              same, any scheme
+//
+// the port is part of the host, https://chat.example.com:8443 needs its own pattern
+type Allowlist struct {
+	any      bool
+	patterns []pattern
+}
+
+type pattern struct {
+	scheme   string // empty match any scheme
+	host     string // host[:port], lower case
+	wildcard bool   // host is a suffix like ".example.com"
+}
+
+// New parse the patterns, empty patterns are skipped
+func New(patterns []string) *Allowlist {
+	a := new(Allowlist)
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			a.any = true
+			continue
+		}
+		var pat pattern
+		if i := strings.Index(p, "://"); i >= 0 {
+			pat.scheme, p = p[:i], p[i+3:]
+		}
+		p = strings.TrimSuffix(p, "/")
+		if strings.HasPrefix(p, "*.") {
+			pat.wildcard = true
+			p = p[1:]
+		}
+		pat.host = p
+		a.patterns = append(a.patterns, pat)
+	}
+	return a
+}
+
+// AllowAny is true if the list has "*"
+func (a *Allowlist) AllowAny() bool {
+	return a.any
+}
+
+// Allowed check an Origin header value, a malformed or "null" origin is never allowed
+// unless the list has "*"
+func (a *Allowlist) Allowed(origin string) bool {
+	if a.any {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, p := range a.patterns {
+		if p.scheme != "" && p.scheme != u.Scheme {
+			continue
+		}
+		if p.wildcard {
+			if strings.HasSuffix(u.Host, p.host) && len(u.Host) > len(p.host) {
+				return true
+			}
+		} else if u.Host == p.host {
+			return true
+		}
+	}
+	return false
+}
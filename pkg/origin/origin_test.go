@@ -0,0 +1,45 @@
+package origin
+
+import "testing"
+
+func TestAllowed(t *testing.T) {
+	a := New([]string{"https://chat.example.com", "https://*.example.org", "*.example.net", " HTTP://LOCALHOST:8080/ ", ""})
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://chat.example.com", true},
+		{"http://chat.example.com", false},
+		{"https://chat.example.com:8443", false},
+		{"https://evil.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://a.example.org", false},
+		{"http://a.example.net", true},
+		{"https://a.example.net", true},
+		{"http://localhost:8080", true},
+		{"null", false},
+		{"", false},
+		{"not a url", false},
+	}
+	for _, c := range cases {
+		if got := a.Allowed(c.origin); got != c.want {
+			t.Errorf("Allowed(%q) = %v, want %v", c.origin, got, c.want)
+		}
+	}
+	if a.AllowAny() {
+		t.Error("list without * should not allow any")
+	}
+}
+
+func TestAllowAny(t *testing.T) {
+	a := New([]string{"https://chat.example.com", "*"})
+	if !a.AllowAny() || !a.Allowed("null") || !a.Allowed("https://other.com") {
+		t.Error("* should allow any origin")
+	}
+	if New(nil).Allowed("https://chat.example.com") {
+		t.Error("empty list should allow nothing")
+	}
+}
@@ -0,0 +1,216 @@
+package stickpackage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// v2 frame, all numbers big endian. length is the length of the body only, crc is the
+// crc32 (IEEE) of the body
+//
+//	+---------+------------+--------+-----------+----------+----------+------+
+//	| ver (2) | length (4) | op (2) | flags (1) | seq (8)  | crc (4)  | body |
+//	+---------+------------+--------+-----------+----------+----------+------+
+//
+// a v1 frame is the StickPackage: ver 'v','1', a 2 byte length of the whole frame, body.
+// the version of the first frame a client sends is the version of the conn
+const (
+	Version1 = 1
+	Version2 = 2
+
+	V1HeaderLength = 4
+	V2HeaderLength = 21
+	// v1 length is read by old clients as an int16
+	V1MaxFrameSize  = 1<<15 - 1
+	DefaultMaxFrame = 64 << 10
+)
+
+var VersionContentV2 = [2]byte{'v', '2'}
+
+var (
+	ErrVersion       = errors.New("stickpackage: unknown frame version")
+	ErrFrameTooLarge = errors.New("stickpackage: frame too large")
+	ErrFrameLength   = errors.New("stickpackage: bad frame length")
+	ErrChecksum      = errors.New("stickpackage: frame checksum mismatch")
+)
+
+// Frame is one decoded frame, Op, Flags and Seq are zero for v1 frames
+type Frame struct {
+	Version int
+	Op      uint16
+	Flags   uint8 // reserved for extensions, passed through as is
+	Seq     uint64
+	Body    []byte
+}
+
+// Decoder read frames from a stream. any error is final, the stream can not be resynced
+// after a malformed frame and the conn should be closed
+type Decoder struct {
+	r        *bufio.Reader
+	maxFrame int
+	header   [V2HeaderLength]byte
+}
+
+// NewDecoder read frames of at most maxFrame bytes with header, DefaultMaxFrame if maxFrame <= 0
+func NewDecoder(r io.Reader, maxFrame int) *Decoder {
+	if maxFrame <= 0 {
+		maxFrame = DefaultMaxFrame
+	}
+	return &Decoder{r: bufio.NewReader(r), maxFrame: maxFrame}
+}
+
+// Decode read the next frame. io.EOF is returned only on a clean end between frames,
+// a stream cut inside a frame gives io.ErrUnexpectedEOF
+func (d *Decoder) Decode() (*Frame, error) {
+	h := d.header[:]
+	if _, err := io.ReadFull(d.r, h[:2]); err != nil {
+		return nil, err
+	}
+	headerLen, err := headerLength(h)
+	if err != nil {
+		return nil, err
+	}
+	if err := readFull(d.r, h[2:headerLen]); err != nil {
+		return nil, err
+	}
+	f, bodyLen, crc, err := parseHeader(h[:headerLen], d.maxFrame)
+	if err != nil {
+		return nil, err
+	}
+	f.Body = make([]byte, bodyLen)
+	if err := readFull(d.r, f.Body); err != nil {
+		return nil, err
+	}
+	if f.Version == Version2 && crc32.ChecksumIEEE(f.Body) != crc {
+		return nil, ErrChecksum
+	}
+	return f, nil
+}
+
+// Parse decode the frame at the start of buf, for callers which read the stream themselves.
+// n is the length of the frame, 0 with no error if buf does not hold the whole frame yet.
+// the body shares memory with buf
+func Parse(buf []byte, maxFrame int) (f *Frame, n int, err error) {
+	if maxFrame <= 0 {
+		maxFrame = DefaultMaxFrame
+	}
+	if len(buf) < 2 {
+		return nil, 0, nil
+	}
+	headerLen, err := headerLength(buf)
+	if err != nil || len(buf) < headerLen {
+		return nil, 0, err
+	}
+	f, bodyLen, crc, err := parseHeader(buf[:headerLen], maxFrame)
+	if err != nil || len(buf) < headerLen+bodyLen {
+		return nil, 0, err
+	}
+	n = headerLen + bodyLen
+	f.Body = buf[headerLen:n:n]
+	if f.Version == Version2 && crc32.ChecksumIEEE(f.Body) != crc {
+		return nil, 0, ErrChecksum
+	}
+	return f, n, nil
+}
+
+// headerLength is the header length of the version in the first 2 bytes of a frame
+func headerLength(h []byte) (int, error) {
+	if h[0] != 'v' {
+		return 0, ErrVersion
+	}
+	switch h[1] {
+	case '1':
+		return V1HeaderLength, nil
+	case '2':
+		return V2HeaderLength, nil
+	default:
+		return 0, ErrVersion
+	}
+}
+
+// parseHeader decode a whole header, the body is not set. crc is only set for v2
+func parseHeader(h []byte, maxFrame int) (f *Frame, bodyLen int, crc uint32, err error) {
+	f = new(Frame)
+	if h[1] == '1' {
+		f.Version = Version1
+		// read as unsigned, a v1 length over 32767 is negative to old peers but still valid here
+		frameLen := int(binary.BigEndian.Uint16(h[2:4]))
+		if frameLen < V1HeaderLength {
+			return nil, 0, 0, ErrFrameLength
+		}
+		if frameLen > maxFrame {
+			return nil, 0, 0, ErrFrameTooLarge
+		}
+		return f, frameLen - V1HeaderLength, 0, nil
+	}
+	f.Version = Version2
+	length := binary.BigEndian.Uint32(h[2:6])
+	if uint64(length)+V2HeaderLength > uint64(maxFrame) {
+		return nil, 0, 0, ErrFrameTooLarge
+	}
+	f.Op = binary.BigEndian.Uint16(h[6:8])
+	f.Flags = h[8]
+	f.Seq = binary.BigEndian.Uint64(h[9:17])
+	return f, int(length), binary.BigEndian.Uint32(h[17:21]), nil
+}
+
+// readFull is io.ReadFull with io.EOF turned into io.ErrUnexpectedEOF, used inside a frame
+func readFull(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// AppendFrame append the encoded frame to buf, in the version of the frame
+func AppendFrame(buf []byte, f *Frame) ([]byte, error) {
+	buf, err := AppendHeader(buf, f)
+	if err != nil {
+		return buf, err
+	}
+	return append(buf, f.Body...), nil
+}
+
+// AppendHeader append the header of the frame to buf, the body must follow it as is.
+// buf is returned unchanged on error
+func AppendHeader(buf []byte, f *Frame) ([]byte, error) {
+	if f.Version == Version1 {
+		frameLen := V1HeaderLength + len(f.Body)
+		if frameLen > V1MaxFrameSize {
+			return buf, ErrFrameTooLarge
+		}
+		buf = append(buf, VersionContent[0], VersionContent[1], 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(frameLen))
+		return buf, nil
+	}
+	if f.Version != Version2 {
+		return buf, ErrVersion
+	}
+	if uint64(len(f.Body)) > 1<<32-1 {
+		return buf, ErrFrameTooLarge
+	}
+	var h [V2HeaderLength]byte
+	h[0], h[1] = VersionContentV2[0], VersionContentV2[1]
+	binary.BigEndian.PutUint32(h[2:6], uint32(len(f.Body)))
+	binary.BigEndian.PutUint16(h[6:8], f.Op)
+	h[8] = f.Flags
+	binary.BigEndian.PutUint64(h[9:17], f.Seq)
+	binary.BigEndian.PutUint32(h[17:21], crc32.ChecksumIEEE(f.Body))
+	return append(buf, h[:]...), nil
+}
+
+// WriteFrame encode the frame and write it with a single write
+func WriteFrame(w io.Writer, f *Frame) error {
+	buf, err := AppendFrame(make([]byte, 0, V2HeaderLength+len(f.Body)), f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
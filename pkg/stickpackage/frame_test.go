@@ -0,0 +1,129 @@
+package stickpackage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestDecodeMixedVersions(t *testing.T) {
+	frames := []*Frame{
+		{Version: Version2, Op: 3, Flags: 1, Seq: 1700000000001, Body: []byte(`{"msg":"hi"}`)},
+		{Version: Version1, Body: []byte(`{"op":3}`)},
+		{Version: Version2, Op: 12, Body: nil},
+	}
+	buf := new(bytes.Buffer)
+	for _, f := range frames {
+		if err := WriteFrame(buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the old v1 pack is read by the decoder too
+	pack := &StickPackage{Version: VersionContent, Msg: []byte("old")}
+	pack.Length = pack.GetPackageLength()
+	_ = pack.Pack(buf)
+
+	d := NewDecoder(buf, 0)
+	for i, want := range append(frames, &Frame{Version: Version1, Body: []byte("old")}) {
+		got, err := d.Decode()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Version != want.Version || got.Op != want.Op || got.Flags != want.Flags ||
+			got.Seq != want.Seq || !bytes.Equal(got.Body, want.Body) {
+			t.Errorf("frame %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("end of stream: got %v, want io.EOF", err)
+	}
+}
+
+func encode(t *testing.T, f *Frame) []byte {
+	t.Helper()
+	b, err := AppendFrame(nil, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	v2 := encode(t, &Frame{Version: Version2, Op: 3, Body: []byte("hello")})
+	badCrc := append([]byte(nil), v2...)
+	badCrc[len(badCrc)-1] ^= 0xff
+	huge := append([]byte(nil), v2[:V2HeaderLength]...)
+	binary.BigEndian.PutUint32(huge[2:6], 1<<31)
+	cases := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"version", []byte("x2abcdefg"), ErrVersion},
+		{"unknown version", []byte("v9abcdefg"), ErrVersion},
+		{"checksum", badCrc, ErrChecksum},
+		{"too large", huge, ErrFrameTooLarge},
+		{"v1 short length", []byte{'v', '1', 0, 2}, ErrFrameLength},
+		{"truncated header", v2[:10], io.ErrUnexpectedEOF},
+		{"truncated body", v2[:len(v2)-2], io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		if _, err := NewDecoder(bytes.NewReader(c.data), 1024).Decode(); err != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestV1Limits(t *testing.T) {
+	// a v1 length over 32767 is negative as int16, still read as a length
+	body := bytes.Repeat([]byte("a"), 40000)
+	data := []byte{'v', '1', 0, 0}
+	binary.BigEndian.PutUint16(data[2:], uint16(V1HeaderLength+len(body)))
+	data = append(data, body...)
+	f, err := NewDecoder(bytes.NewReader(data), 1<<20).Decode()
+	if err != nil || len(f.Body) != len(body) {
+		t.Fatalf("large v1 frame: %v", err)
+	}
+	if _, err := NewDecoder(bytes.NewReader(data), 1024).Decode(); err != ErrFrameTooLarge {
+		t.Errorf("v1 frame over max: got %v", err)
+	}
+	// the server never sends a v1 frame old clients would read as negative
+	if _, err := AppendFrame(nil, &Frame{Version: Version1, Body: body}); err != ErrFrameTooLarge {
+		t.Errorf("encode large v1 frame: got %v", err)
+	}
+	if b := encode(t, &Frame{Version: Version2, Body: body}); len(b) != V2HeaderLength+len(body) {
+		t.Errorf("v2 frame of %d bytes", len(b))
+	}
+}
+
+func TestParse(t *testing.T) {
+	stream := encode(t, &Frame{Version: Version2, Op: 3, Seq: 7, Body: []byte(`{"msg":"hi"}`)})
+	first := len(stream)
+	stream = append(stream, encode(t, &Frame{Version: Version1, Body: []byte("old")})...)
+	// a frame cut anywhere is not parsed yet
+	for i := 0; i < first; i++ {
+		if f, n, err := Parse(stream[:i], 0); f != nil || n != 0 || err != nil {
+			t.Fatalf("prefix of %d bytes: got %v %d %v", i, f, n, err)
+		}
+	}
+	f, n, err := Parse(stream, 0)
+	if err != nil || n != first || f.Op != 3 || f.Seq != 7 || string(f.Body) != `{"msg":"hi"}` {
+		t.Fatalf("first frame: %+v %d %v", f, n, err)
+	}
+	if f, n, err = Parse(stream[n:], 0); err != nil || n != len(stream)-first || string(f.Body) != "old" {
+		t.Fatalf("second frame: %+v %d %v", f, n, err)
+	}
+
+	badCrc := append([]byte(nil), stream[:first]...)
+	badCrc[first-1] ^= 0xff
+	if _, _, err := Parse(badCrc, 0); err != ErrChecksum {
+		t.Errorf("checksum: got %v", err)
+	}
+	if _, _, err := Parse([]byte("x2"), 0); err != ErrVersion {
+		t.Errorf("version: got %v", err)
+	}
+	if _, _, err := Parse(stream[:V2HeaderLength], V2HeaderLength+4); err != ErrFrameTooLarge {
+		t.Errorf("too large: got %v", err)
+	}
+}
@@ -24,20 +24,29 @@ type StickPackage struct {
 }
 
 func (p *StickPackage) Pack(writer io.Writer) error {
-	var err error
-	err = binary.Write(writer, binary.BigEndian, &p.Version)
-	err = binary.Write(writer, binary.BigEndian, &p.Length)
-	err = binary.Write(writer, binary.BigEndian, &p.Msg)
-	return err
+	if err := binary.Write(writer, binary.BigEndian, &p.Version); err != nil {
+		return err
+	}
+	if err := binary.Write(writer, binary.BigEndian, &p.Length); err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, &p.Msg)
 }
 
 func (p *StickPackage) Unpack(reader io.Reader) error {
-	var err error
-	err = binary.Read(reader, binary.BigEndian, &p.Version)
-	err = binary.Read(reader, binary.BigEndian, &p.Length)
-	p.Msg = make([]byte, p.Length-4)
-	err = binary.Read(reader, binary.BigEndian, &p.Msg)
-	return err
+	if err := binary.Read(reader, binary.BigEndian, &p.Version); err != nil {
+		return err
+	}
+	if err := binary.Read(reader, binary.BigEndian, &p.Length); err != nil {
+		return err
+	}
+	// a length under the header would make a negative msg size
+	frameLen := int(uint16(p.Length))
+	if frameLen < TcpHeaderLength {
+		return ErrFrameLength
+	}
+	p.Msg = make([]byte, frameLen-TcpHeaderLength)
+	return binary.Read(reader, binary.BigEndian, &p.Msg)
 }
 
 func (p *StickPackage) String() string {
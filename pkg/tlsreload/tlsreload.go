@@ -0,0 +1,109 @@
+// Package tlsreload serves TLS listeners from a certificate pair on disk that can be
+// swapped without a restart: ReloadAll, called on SIGHUP, reads every loaded pair again.
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	lock      sync.Mutex
+	reloaders = make(map[string]*Reloader) // by cert and key path, a pair is loaded once
+)
+
+// Reloader hold the current certificate of a pair
+type Reloader struct {
+	certPath string
+	keyPath  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// Load read the pair and keep it for ReloadAll, loading the same pair again return the same Reloader
+func Load(certPath, keyPath string) (*Reloader, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, errors.New("tls needs both certPath and keyPath")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	key := certPath + "\x00" + keyPath
+	if r, ok := reloaders[key]; ok {
+		return r, nil
+	}
+	r := &Reloader{certPath: certPath, keyPath: keyPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	reloaders[key] = r
+	return r, nil
+}
+
+// Reload read the pair from disk again, on error the old certificate stays in use
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("load tls pair %s %s: %w", r.certPath, r.keyPath, err)
+	}
+	r.lock.Lock()
+	r.cert = &cert
+	r.lock.Unlock()
+	return nil
+}
+
+// GetCertificate is the tls.Config hook, new handshakes get the latest certificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// ServerConfig return a server tls.Config using the latest certificate
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// ReloadAll reload every loaded pair, errors are logged and the old certificates kept
+func ReloadAll() {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, r := range reloaders {
+		if err := r.Reload(); err != nil {
+			logrus.Errorf("tls reload err:%s", err.Error())
+			continue
+		}
+		logrus.Infof("tls reload %s done", r.certPath)
+	}
+}
+
+// ClientConfig return a client tls.Config trusting the certs in caPath, serverName override the
+// name checked in the cert if the dialed address is not in it. caPath is read once, it must be
+// the ca that signs the served leaf and not the leaf itself, so a leaf rotated by ReloadAll
+// is still trusted
+func ClientConfig(caPath, serverName string) (*tls.Config, error) {
+	if caPath == "" {
+		return nil, errors.New("tls client needs a ca path")
+	}
+	pem, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("read tls ca %s: %w", caPath, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no cert found in %s", caPath)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: serverName,
+	}, nil
+}
@@ -0,0 +1,224 @@
+package tlsreload
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair write a new self signed cert for localhost, return the cert der
+func writePair(t *testing.T, certPath, keyPath string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func currentDer(t *testing.T, r *Reloader) []byte {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("no certificate: %v", err)
+	}
+	return cert.Certificate[0]
+}
+
+func TestLoadAndReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writePair(t, certPath, keyPath)
+
+	r, err := Load(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if again, _ := Load(certPath, keyPath); again != r {
+		t.Error("loading the same pair should return the same reloader")
+	}
+	if !bytes.Equal(currentDer(t, r), first) {
+		t.Fatal("loaded cert mismatch")
+	}
+
+	second := writePair(t, certPath, keyPath)
+	ReloadAll()
+	if !bytes.Equal(currentDer(t, r), second) {
+		t.Error("cert not swapped by ReloadAll")
+	}
+
+	// a broken pair on disk keeps the last good cert
+	if err := os.WriteFile(keyPath, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("reload of a broken pair should fail")
+	}
+	if !bytes.Equal(currentDer(t, r), second) {
+		t.Error("broken reload should keep the old cert")
+	}
+}
+
+func TestLoadMissingPath(t *testing.T) {
+	if _, err := Load("cert.pem", ""); err == nil {
+		t.Error("Load without key path should fail")
+	}
+}
+
+func TestClientConfigHandshake(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair(t, certPath, keyPath)
+	r, err := Load(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	// the dialed ip is not in the cert, the server name override is checked instead
+	clientConfig, err := ClientConfig(certPath, "localhost")
+	if err != nil {
+		t.Fatalf("ClientConfig: %v", err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("handshake with trusted cert failed: %v", err)
+	}
+	conn.Close()
+}
+
+// writeSigned write a new leaf for localhost signed by the ca
+func writeSigned(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConfigRotation(t *testing.T) {
+	dir := t.TempDir()
+	caPath, caKeyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caDer := writePair(t, caPath, caKeyPath)
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPair, err := tls.LoadX509KeyPair(caPath, caKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey := caPair.PrivateKey.(*ecdsa.PrivateKey)
+	writeSigned(t, ca, caKey, certPath, keyPath)
+	r, err := Load(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	clientConfig, err := ClientConfig(caPath, "localhost")
+	if err != nil {
+		t.Fatalf("ClientConfig: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+		if err != nil {
+			t.Fatalf("handshake %d failed: %v", i, err)
+		}
+		conn.Close()
+		// the leaf is rotated, the client keeps trusting the ca
+		writeSigned(t, ca, caKey, certPath, keyPath)
+		ReloadAll()
+	}
+
+	if _, err := ClientConfig("", "localhost"); err == nil {
+		t.Error("ClientConfig without ca path should fail")
+	}
+}
@@ -5,11 +5,20 @@
  */
 package proto
 
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
 type Msg struct {
 	Ver       int    `json:"ver"`  // protocol version
 	Operation int    `json:"op"`   // operation for request
 	SeqId     string `json:"seq"`  // sequence number chosen by client
 	Body      []byte `json:"body"` // binary body bytes
+	// Frames is set by the connect layer on a msg pushed to many conns, it caches the
+	// encoded websocket frame per subprotocol so the msg is encoded once, never sent by rpc
+	Frames *sync.Map `json:"-" msgpack:"-"`
 }
 
 type PushMsgRequest struct {
@@ -18,11 +27,147 @@ type PushMsgRequest struct {
 }
 
 type PushRoomMsgRequest struct {
-	RoomId int
-	Msg    Msg
+	RoomId       int
+	Msg          Msg
+	ExceptUserId int // not pushed to this user, the sender of a room signal
 }
 
 type PushRoomCountRequest struct {
 	RoomId int
 	Count  int
 }
+
+// OfflineMsg is the body of a OpOfflineMsg push, msgs are the same json as a single push
+type OfflineMsg struct {
+	Op      int               `json:"op"`
+	AckId   int64             `json:"ackId"`
+	HasMore bool              `json:"hasMore"`
+	Msgs    []json.RawMessage `json:"msgs"`
+}
+
+// ClientOp is a frame sent by client on an already connected conn, op decide which fields are used,
+// the sender of a msg is always the user of the conn
+type ClientOp struct {
+	Op       int    `json:"op"`
+	SeqId    string `json:"seq,omitempty"`      // chosen by client, if set the op is answered by a OpReply frame, OpMsgAck: seq of the acked msg
+	AckId    int64  `json:"ackId,omitempty"`    // OpOfflineAck, sent after got a OpOfflineMsg push
+	RoomId   int    `json:"roomId,omitempty"`   // OpRoomJoin, OpRoomLeave, OpRoomSend, OpRoomCountSend, OpRoomInfoSend
+	ToUserId int    `json:"toUserId,omitempty"` // OpSingleSend
+	Msg      string `json:"msg,omitempty"`      // OpSingleSend, OpRoomSend
+	Signal   string `json:"signal,omitempty"`   // OpRoomSignal, like typing or stopped
+}
+
+// SessionInfo is the body of a OpSession push, sent after connect or resume
+type SessionInfo struct {
+	Op          int    `json:"op"`
+	ResumeToken string `json:"resumeToken"`
+	Resumed     bool   `json:"resumed"`          // true if the conn took over a dropped session
+	Resync      bool   `json:"resync,omitempty"` // resumed, but the msgs after lastSeq are not all kept
+}
+
+// HttpSession is the open event of a sse stream and the reply of a long poll connect,
+// the sid goes with every later request of the session
+type HttpSession struct {
+	Sid string `json:"sid"`
+}
+
+// PollReply is the reply of a long poll, msgs are gochat.v1.json frames, oldest first
+type PollReply struct {
+	Msgs []json.RawMessage `json:"msgs"`
+}
+
+// Heartbeat is the body of a OpPing or OpPong frame, the pong has the seq of the ping
+type Heartbeat struct {
+	Op    int    `json:"op"`
+	SeqId string `json:"seq"`
+}
+
+// RoomSignal is the body of a OpRoomSignal push, an ephemeral signal of a room member
+type RoomSignal struct {
+	Op           int    `json:"op"`
+	RoomId       int    `json:"roomId"`
+	FromUserId   int    `json:"fromUserId"`
+	FromUserName string `json:"fromUserName"`
+	Signal       string `json:"signal"` // typing, stopped, viewing, ...
+}
+
+// KickRequest ask a connect server to remove the user from a room
+type KickRequest struct {
+	RoomId int
+	UserId int
+	Msg    Msg // OpKick notice pushed to the user before
+}
+
+// ModerationInfo is the body of a OpKick push
+type ModerationInfo struct {
+	Op     int    `json:"op"`
+	RoomId int    `json:"roomId"`
+	Action string `json:"action"` // kick or ban
+	Reason string `json:"reason,omitempty"`
+}
+
+// IntrospectRequest ask a connect server what it holds, bucket stats are always returned
+type IntrospectRequest struct {
+	UserId int  // if set, look up the conns of this user
+	Rooms  bool // list the rooms with their local online count
+}
+
+// IntrospectReply is a read only view of a connect server, for debugging
+type IntrospectReply struct {
+	ServerId string        `json:"serverId"`
+	Buckets  []BucketStats `json:"buckets"`
+	Rooms    []RoomStats   `json:"rooms,omitempty"`
+	Conns    []ConnInfo    `json:"conns,omitempty"` // conns of the user, empty if not connected
+}
+
+type BucketStats struct {
+	Index         int   `json:"index"`
+	Users         int   `json:"users"`
+	Channels      int   `json:"channels"`
+	Rooms         int   `json:"rooms"`
+	RoutineQueues []int `json:"routineQueues"` // room pushes waiting in each routine
+}
+
+type RoomStats struct {
+	RoomId int `json:"roomId"`
+	Online int `json:"online"` // conns in the room on this server
+}
+
+type ConnInfo struct {
+	DeviceId    string    `json:"deviceId"`
+	Transport   string    `json:"transport"` // ws, tcp, sse or poll
+	ConnectedAt time.Time `json:"connectedAt"`
+	Age         string    `json:"age"`
+	QueueDepth  int       `json:"queueDepth"` // chat msgs waiting to be written
+	QueueCap    int       `json:"queueCap"`
+	Unacked     int       `json:"unacked"`
+	Rooms       []int     `json:"rooms"`
+	Detached    bool      `json:"detached"` // dropped, waiting for resume
+	RTT         string    `json:"rtt,omitempty"`
+	Priority    int       `json:"priority"` // control and system msgs waiting, written before the chat
+}
+
+// ReconnectHint is the body of a OpReconnect push, the last msg before a draining server closes the conn
+type ReconnectHint struct {
+	Op    int `json:"op"`
+	Delay int `json:"delay"` // ms the client should wait before it reconnects
+}
+
+// RateLimitInfo is the body of a OpRateLimit push, sent instead of the reply of a limited op
+type RateLimitInfo struct {
+	Op         int    `json:"op"`
+	SeqId      string `json:"seq,omitempty"`
+	ReqOp      int    `json:"reqOp"`
+	Action     string `json:"action"`     // warn: the op is dropped, throttle: the op is delayed
+	RetryAfter int    `json:"retryAfter"` // ms until the limit allows the op again
+}
+
+// OpReply is the body of a OpReply push, answer of a client op by seq
+type OpReply struct {
+	Op     int    `json:"op"`
+	SeqId  string `json:"seq"`
+	ReqOp  int    `json:"reqOp"`
+	Code   int    `json:"code"`
+	Msg    string `json:"msg,omitempty"`
+	MsgSeq string `json:"msgSeq,omitempty"` // OpSingleSend, id of the sent msg to query its delivery status
+}
@@ -57,15 +57,27 @@ type ConnectRequest struct {
 	AuthToken string `json:"authToken"`
 	RoomId    int    `json:"roomId"`
 	ServerId  string `json:"serverId"`
+	DeviceId  string `json:"deviceId"` // chosen by client, connect layer generate one if empty
+	// resume a dropped session instead of starting a new one, only handled by connect layer
+	ResumeToken string `json:"resumeToken,omitempty"`
+	LastSeq     string `json:"lastSeq,omitempty"` // seq of the last msg client got, msgs after it are replayed
 }
 
 type ConnectReply struct {
-	UserId int
+	UserId   int
+	UserName string
 }
 
 type DisConnectRequest struct {
-	RoomId int
+	RoomIds  []int // all rooms the conn joined
+	UserId   int
+	ServerId string
+	DeviceId string
+}
+
+type RoomMemberRequest struct {
 	UserId int
+	RoomId int
 }
 
 type DisConnectReply struct {
@@ -82,6 +94,8 @@ type Send struct {
 	RoomId       int    `json:"roomId"`
 	Op           int    `json:"op"`
 	CreateTime   string `json:"createTime"`
+	MsgId        int64  `json:"msgId,omitempty"` // per room message id, only set for room msg
+	SeqId        string `json:"seq,omitempty"`   // id of a single msg, used by client ack and delivery status
 }
 
 type SendTcp struct {
@@ -94,5 +108,94 @@ type SendTcp struct {
 	RoomId       int    `json:"roomId"`
 	Op           int    `json:"op"`
 	CreateTime   string `json:"createTime"`
-	AuthToken    string `json:"authToken"` //仅tcp时使用，发送msg时带上
+	AuthToken    string `json:"authToken"`       //仅tcp时使用，发送msg时带上
+	AckId        int64  `json:"ackId,omitempty"` // only used by OpOfflineAck
+	DeviceId     string `json:"deviceId,omitempty"`
+	SeqId        string `json:"seq,omitempty"` // if set, the op is answered by a OpReply frame
+	ResumeToken  string `json:"resumeToken,omitempty"`
+	LastSeq      string `json:"lastSeq,omitempty"`
+}
+
+type GetRoomHistoryRequest struct {
+	UserId int // only members of the room, not banned from it, get its history
+	RoomId int
+	Before int64 // return messages with msgId < Before
+	After  int64 // return messages with msgId > After
+	Limit  int
+}
+
+type RoomHistoryMsg struct {
+	MsgId        int64  `json:"msgId"`
+	RoomId       int    `json:"roomId"`
+	FromUserId   int    `json:"fromUserId"`
+	FromUserName string `json:"fromUserName"`
+	Msg          string `json:"msg"`
+	CreateTime   string `json:"createTime"`
+}
+
+type GetRoomHistoryReply struct {
+	Code     int
+	Messages []RoomHistoryMsg
+	HasMore  bool
+}
+
+type SaveOfflineMsgRequest struct {
+	UserId int
+	SeqId  string // the msg is kept once per seq, empty for no check
+	Msg    []byte
+}
+
+// OfflineMsgRequest ack the offline inbox up to AckId (if > 0), then fetch the next Limit msgs
+type OfflineMsgRequest struct {
+	UserId int
+	AckId  int64
+	Limit  int
+}
+
+type OfflineMsgReply struct {
+	Code    int
+	Msgs    [][]byte
+	AckId   int64 // id of the last msg in Msgs, send it back to clear them
+	HasMore bool
+}
+
+// RoomStatReply is the room count, and the members for a room info query
+type RoomStatReply struct {
+	Code         int
+	Count        int
+	RoomUserInfo map[string]string
+}
+
+type PushReply struct {
+	Code   int
+	Msg    string
+	SeqId  string // id of the single msg, to query its delivery status
+	Status string
+}
+
+// ModerateRequest ask logic to kick, mute, ban or unban a user of a room
+type ModerateRequest struct {
+	OperatorId   int // the moderator, checked by logic
+	OperatorName string
+	RoomId       int
+	UserId       int
+	Duration     int // seconds of a mute, 0 lift the mute
+	Reason       string
+}
+
+type MsgAckRequest struct {
+	UserId int
+	SeqId  string
+}
+
+type MsgStatusRequest struct {
+	UserId int // only the sender can query the msg
+	SeqId  string
+}
+
+type MsgStatusReply struct {
+	Code     int
+	SeqId    string
+	ToUserId int
+	Status   string
 }
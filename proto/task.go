@@ -10,6 +10,7 @@ type RedisMsg struct {
 	ServerId     string            `json:"serverId,omitempty"`
 	RoomId       int               `json:"roomId,omitempty"`
 	UserId       int               `json:"userId,omitempty"`
+	SeqId        string            `json:"seq,omitempty"`
 	Msg          []byte            `json:"msg"`
 	Count        int               `json:"count"`
 	RoomUserInfo map[string]string `json:"roomUserInfo"`
@@ -23,8 +24,9 @@ type RedisRoomInfo struct {
 }
 
 type RedisRoomCountMsg struct {
-	Count int `json:"count,omitempty"`
-	Op    int `json:"op"`
+	Count  int `json:"count,omitempty"`
+	Op     int `json:"op"`
+	RoomId int `json:"roomId,omitempty"`
 }
 
 type SuccessReply struct {
@@ -16,6 +16,7 @@ import (
 type PushParams struct {
 	ServerId string
 	UserId   int
+	SeqId    string
 	Msg      []byte
 	RoomId   int
 }
@@ -38,7 +39,7 @@ func (task *Task) processSinglePush(ch chan *PushParams) {
 	for {
 		arg = <-ch
 		//@todo when arg.ServerId server is down, user could be reconnect other serverId but msg in queue no consume
-		task.pushSingleToConnect(arg.ServerId, arg.UserId, arg.Msg)
+		task.pushSingleToConnect(arg.ServerId, arg.UserId, arg.SeqId, arg.Msg)
 	}
 }
 
@@ -53,6 +54,7 @@ func (task *Task) Push(msg string) {
 		pushChannel[rand.Int()%config.Conf.Task.TaskBase.PushChan] <- &PushParams{
 			ServerId: m.ServerId,
 			UserId:   m.UserId,
+			SeqId:    m.SeqId,
 			Msg:      m.Msg,
 		}
 	case config.OpRoomSend:
@@ -61,5 +63,9 @@ func (task *Task) Push(msg string) {
 		task.broadcastRoomCountToConnect(m.RoomId, m.Count)
 	case config.OpRoomInfoSend:
 		task.broadcastRoomInfoToConnect(m.RoomId, m.RoomUserInfo)
+	case config.OpRoomSignal:
+		task.broadcastRoomSignalToConnect(m.RoomId, m.UserId, m.Msg)
+	case config.OpKick:
+		task.kickUserOnConnect(m.RoomId, m.UserId, m.Msg)
 	}
 }
@@ -46,7 +46,7 @@ func (task *Task) InitRabbitMQConsumer() error {
 	}{
 		{config.RabbitMQQueueSingle, []string{config.RoutingKeySingleSend}},
 		{config.RabbitMQQueueRoom, []string{config.RoutingKeyRoomSend}},
-		{config.RabbitMQQueueMeta, []string{config.RoutingKeyRoomCount, config.RoutingKeyRoomInfo}},
+		{config.RabbitMQQueueMeta, []string{config.RoutingKeyRoomCount, config.RoutingKeyRoomInfo, config.RoutingKeyRoomSignal, config.RoutingKeyRoomKick}},
 	}
 
 	// Declare and bind queues
@@ -7,10 +7,12 @@ package task
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"gochat/config"
 	"gochat/pkg/middleware"
+	"gochat/pkg/tlsreload"
 	"gochat/proto"
 	"gochat/tools"
 	"strings"
@@ -130,6 +132,14 @@ func (task *Task) InitConnectRpcClient() (err error) {
 
 func (task *Task) watchServicesChange(d client.ServiceDiscovery) {
 	etcdConfig := config.Conf.Common.CommonEtcd
+	// connect servers serve rpc over tls if rpcTls is on
+	var clientTLS *tls.Config
+	if connectBase := config.Conf.Connect.ConnectBase; connectBase.RpcTls {
+		var err error
+		if clientTLS, err = tlsreload.ClientConfig(connectBase.RpcCaPath, connectBase.RpcServerName); err != nil {
+			logrus.Fatalf("init task rpc client tls fail:%s", err.Error())
+		}
+	}
 	for kvChan := range d.WatchService() {
 		if len(kvChan) <= 0 {
 			logrus.Errorf("connect services change, connect alarm, no abailable ip")
@@ -161,6 +171,7 @@ func (task *Task) watchServicesChange(d client.ServiceDiscovery) {
 				BackupLatency:       10 * time.Millisecond,
 				SerializeType:       protocol.MsgPack,
 				CompressType:        protocol.None,
+				TLSConfig:           clientTLS,
 			}
 			c := client.NewXClient(etcdConfig.ServerPathConnect, client.Failtry, client.RandomSelect, d, opt)
 			ins := Instance{
@@ -181,14 +192,18 @@ func (task *Task) watchServicesChange(d client.ServiceDiscovery) {
 	}
 }
 
-func (task *Task) pushSingleToConnect(serverId string, userId int, msg []byte) {
+func (task *Task) pushSingleToConnect(serverId string, userId int, seqId string, msg []byte) {
 	logrus.Debugf("pushSingleToConnect Body %s", string(msg))
+	// client ack the msg by the seq logic gave it, msgs of old logic have none
+	if seqId == "" {
+		seqId = tools.GetSnowflakeId()
+	}
 	pushMsgReq := &proto.PushMsgRequest{
 		UserId: userId,
 		Msg: proto.Msg{
 			Ver:       config.MsgVersion,
 			Operation: config.OpSingleSend,
-			SeqId:     tools.GetSnowflakeId(),
+			SeqId:     seqId,
 			Body:      msg,
 		},
 	}
@@ -225,10 +240,51 @@ func (task *Task) broadcastRoomToConnect(roomId int, msg []byte) {
 	}
 }
 
+// broadcastRoomSignalToConnect push a room signal to the other members, it has no seq since
+// it is never acked
+func (task *Task) broadcastRoomSignalToConnect(roomId int, fromUserId int, msg []byte) {
+	pushRoomMsgReq := &proto.PushRoomMsgRequest{
+		RoomId: roomId,
+		Msg: proto.Msg{
+			Ver:       config.MsgVersion,
+			Operation: config.OpRoomSignal,
+			Body:      msg,
+		},
+		ExceptUserId: fromUserId,
+	}
+	reply := &proto.SuccessReply{}
+	rpcList := RClient.GetAllConnectTypeRpcClient()
+	for _, rpc := range rpcList {
+		middleware.InstrumentedCall(context.Background(), rpc, "task", "connect", "PushRoomMsg", pushRoomMsgReq, reply)
+	}
+}
+
+// kickUserOnConnect ask every connect server to remove the user from the room, only the servers
+// holding a conn of the user in the room do anything
+func (task *Task) kickUserOnConnect(roomId int, userId int, msg []byte) {
+	kickReq := &proto.KickRequest{
+		RoomId: roomId,
+		UserId: userId,
+		Msg: proto.Msg{
+			Ver:       config.MsgVersion,
+			Operation: config.OpKick,
+			SeqId:     tools.GetSnowflakeId(),
+			Body:      msg,
+		},
+	}
+	reply := &proto.SuccessReply{}
+	for _, rpc := range RClient.GetAllConnectTypeRpcClient() {
+		if err := middleware.InstrumentedCall(context.Background(), rpc, "task", "connect", "KickUser", kickReq, reply); err != nil {
+			logrus.Errorf("kickUserOnConnect Call err %v", err)
+		}
+	}
+}
+
 func (task *Task) broadcastRoomCountToConnect(roomId, count int) {
 	msg := &proto.RedisRoomCountMsg{
-		Count: count,
-		Op:    config.OpRoomCountSend,
+		Count:  count,
+		Op:     config.OpRoomCountSend,
+		RoomId: roomId,
 	}
 	var body []byte
 	var err error
@@ -116,6 +116,33 @@ func (c *APIClient) GetRoomInfo(roomId int) (*APIResponse, error) {
 	})
 }
 
+// History fetches a page of room message history
+func (c *APIClient) History(authToken string, roomId int, before, after int64, limit int) (*APIResponse, error) {
+	return c.post("/push/history", map[string]interface{}{
+		"authToken": authToken,
+		"roomId":    roomId,
+		"before":    before,
+		"after":     after,
+		"limit":     limit,
+	})
+}
+
+// Offline clears the offline inbox up to ackId and fetches the next page
+func (c *APIClient) Offline(authToken string, ackId int64) (*APIResponse, error) {
+	return c.post("/push/offline", map[string]interface{}{
+		"authToken": authToken,
+		"ackId":     ackId,
+	})
+}
+
+// MsgStatus queries the delivery status of a single message the user sent
+func (c *APIClient) MsgStatus(authToken, seq string) (*APIResponse, error) {
+	return c.post("/push/status", map[string]interface{}{
+		"authToken": authToken,
+		"seq":       seq,
+	})
+}
+
 func (c *APIClient) post(path string, body interface{}) (*APIResponse, error) {
 	jsonData, err := json.Marshal(body)
 	if err != nil {
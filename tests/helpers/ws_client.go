@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"gochat/pkg/envelope"
 )
 
 // WSClient wraps WebSocket client for testing
@@ -27,13 +28,26 @@ type ConnectRequest struct {
 	AuthToken string `json:"authToken"`
 	RoomId    int    `json:"roomId"`
 	ServerId  string `json:"serverId"`
+	DeviceId  string `json:"deviceId,omitempty"`
+	// ResumeToken and LastSeq resume a dropped session, see ConnectResume
+	ResumeToken string `json:"resumeToken,omitempty"`
+	LastSeq     string `json:"lastSeq,omitempty"`
 }
 
 // NewWSClient creates and connects a WebSocket client
 func NewWSClient(url string) (*WSClient, error) {
+	return NewWSClientWithSubprotocol(url, "")
+}
+
+// NewWSClientWithSubprotocol connects asking for an envelope format,
+// e.g. envelope.SubprotocolJSON or envelope.SubprotocolBinary
+func NewWSClientWithSubprotocol(url, subprotocol string) (*WSClient, error) {
 	dialer := websocket.Dialer{
 		HandshakeTimeout: 10 * time.Second,
 	}
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
 	conn, _, err := dialer.Dial(url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("websocket dial: %w", err)
@@ -61,6 +75,146 @@ func (c *WSClient) Connect(authToken string, roomId int) error {
 	return c.SendJSON(req)
 }
 
+// ConnectDevice is like Connect but identifies the client device,
+// a new connection from the same device replaces the old one
+func (c *WSClient) ConnectDevice(authToken string, roomId int, deviceId string) error {
+	req := ConnectRequest{
+		AuthToken: authToken,
+		RoomId:    roomId,
+		DeviceId:  deviceId,
+	}
+	return c.SendJSON(req)
+}
+
+// ConnectResume resumes the dropped session of resumeToken, the server replays
+// the messages after lastSeq before anything new
+func (c *WSClient) ConnectResume(authToken, resumeToken, lastSeq string) error {
+	req := ConnectRequest{
+		AuthToken:   authToken,
+		ResumeToken: resumeToken,
+		LastSeq:     lastSeq,
+	}
+	return c.SendJSON(req)
+}
+
+// SessionInfo matches proto.SessionInfo, pushed with op 13 after connect
+type SessionInfo struct {
+	Op          int    `json:"op"`
+	ResumeToken string `json:"resumeToken"`
+	Resumed     bool   `json:"resumed"`
+}
+
+// WaitForSession waits for the session info frame and returns it
+func (c *WSClient) WaitForSession(timeout time.Duration) (*SessionInfo, error) {
+	raw, err := c.WaitForMessageContaining(`"resumeToken"`, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var info SessionInfo
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return nil, fmt.Errorf("parse session info: %w", err)
+	}
+	return &info, nil
+}
+
+// RoomOp matches proto.ClientOp for join/leave room frames
+type RoomOp struct {
+	Op     int `json:"op"`
+	RoomId int `json:"roomId"`
+}
+
+// JoinRoom subscribes the existing connection to another room
+func (c *WSClient) JoinRoom(roomId int) error {
+	return c.SendJSON(RoomOp{Op: 9, RoomId: roomId})
+}
+
+// LeaveRoom unsubscribes the existing connection from a room
+func (c *WSClient) LeaveRoom(roomId int) error {
+	return c.SendJSON(RoomOp{Op: 10, RoomId: roomId})
+}
+
+// ClientOp matches proto.ClientOp for upstream frames on a connected socket
+type ClientOp struct {
+	Op       int    `json:"op"`
+	SeqId    string `json:"seq,omitempty"`
+	RoomId   int    `json:"roomId,omitempty"`
+	ToUserId int    `json:"toUserId,omitempty"`
+	Msg      string `json:"msg,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+}
+
+// SendSignal sends an ephemeral signal like "typing" to a joined room
+func (c *WSClient) SendSignal(roomId int, signal string) error {
+	return c.SendJSON(ClientOp{Op: 18, RoomId: roomId, Signal: signal})
+}
+
+// SendRoomMsg sends a chat message to a joined room over the socket
+func (c *WSClient) SendRoomMsg(seq string, roomId int, msg string) error {
+	return c.SendJSON(ClientOp{Op: 3, SeqId: seq, RoomId: roomId, Msg: msg})
+}
+
+// SendSingleMsg sends a direct message to a user over the socket
+func (c *WSClient) SendSingleMsg(seq string, toUserId int, msg string) error {
+	return c.SendJSON(ClientOp{Op: 2, SeqId: seq, ToUserId: toUserId, Msg: msg})
+}
+
+// AckMsg acknowledges a pushed single message by its seq
+func (c *WSClient) AckMsg(seq string) error {
+	return c.SendJSON(ClientOp{Op: 12, SeqId: seq})
+}
+
+// OpReply matches proto.OpReply, the answer to an upstream frame
+type OpReply struct {
+	Op     int    `json:"op"`
+	SeqId  string `json:"seq"`
+	ReqOp  int    `json:"reqOp"`
+	Code   int    `json:"code"`
+	Msg    string `json:"msg"`
+	MsgSeq string `json:"msgSeq"`
+}
+
+// WaitForReply waits for the reply frame of the given seq
+func (c *WSClient) WaitForReply(seq string, timeout time.Duration) (*OpReply, error) {
+	msg, err := c.WaitForMessageContaining(fmt.Sprintf(`"seq":%q`, seq), timeout)
+	if err != nil {
+		return nil, err
+	}
+	var reply OpReply
+	if err := json.Unmarshal(msg, &reply); err != nil {
+		return nil, fmt.Errorf("parse reply: %w", err)
+	}
+	return &reply, nil
+}
+
+// Subprotocol returns the envelope format the server agreed on
+func (c *WSClient) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+// SendFrame encodes an envelope in the negotiated format and sends it
+func (c *WSClient) SendFrame(frame *envelope.Frame) error {
+	var (
+		data        []byte
+		err         error
+		messageType = websocket.TextMessage
+	)
+	if c.Subprotocol() == envelope.SubprotocolBinary {
+		data, err = envelope.EncodeBinary(frame)
+		messageType = websocket.BinaryMessage
+	} else {
+		data, err = envelope.EncodeJSON(frame)
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return fmt.Errorf("connection closed")
+	}
+	return c.conn.WriteMessage(messageType, data)
+}
+
 // SendJSON marshals and sends JSON message
 func (c *WSClient) SendJSON(v interface{}) error {
 	c.mu.Lock()
@@ -125,8 +279,18 @@ func (c *WSClient) DrainMessages(timeout time.Duration) {
 	}
 }
 
-// Close cleanly closes the connection
+// Close cleanly closes the connection with a normal close frame, which ends the session
 func (c *WSClient) Close() error {
+	return c.close(true)
+}
+
+// Drop closes the connection without a close frame, like a lost network,
+// so the session can be resumed
+func (c *WSClient) Drop() error {
+	return c.close(false)
+}
+
+func (c *WSClient) close(clean bool) error {
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -134,6 +298,11 @@ func (c *WSClient) Close() error {
 	}
 	c.closed = true
 	close(c.done)
+	if clean {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+	}
 	err := c.conn.Close()
 	c.mu.Unlock()
 	return err
@@ -190,6 +359,7 @@ type ReceivedMessage struct {
 	RoomId       int    `json:"roomId"`
 	Op           int    `json:"op"`
 	CreateTime   string `json:"createTime"`
+	SeqId        string `json:"seq"`
 }
 
 // ParseMessage parses a raw message into ReceivedMessage
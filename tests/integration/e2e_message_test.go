@@ -343,4 +343,345 @@ func TestE2EMessage(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("Offline_Inbox", func(t *testing.T) {
+		sender := testdata.NewTestUser()
+		senderResp, err := apiClient.Register(sender.UserName, sender.Password)
+		if err != nil {
+			t.Fatalf("Register sender failed: %v", err)
+		}
+		sender.AuthToken = senderResp.GetDataAsString()
+
+		receiver := testdata.NewTestUser()
+		receiverResp, err := apiClient.Register(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Register receiver failed: %v", err)
+		}
+		receiver.AuthToken = receiverResp.GetDataAsString()
+
+		authResp, err := apiClient.CheckAuth(receiver.AuthToken)
+		if err != nil {
+			t.Fatalf("CheckAuth failed: %v", err)
+		}
+		receiverUserId := fmt.Sprintf("%.0f", authResp.GetDataAsMap()["userId"].(float64))
+
+		// Receiver never connected, message goes to the offline inbox
+		testMsg := testdata.TestMessage("offline")
+		if _, err := apiClient.Push(sender.AuthToken, testMsg, receiverUserId, testdata.DefaultRoomID); err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+
+		// Inbox is drained on connect
+		wsClient, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		wsClient.Connect(receiver.AuthToken, testdata.DefaultRoomID)
+		msg, err := wsClient.WaitForMessageContaining(testMsg, 10*time.Second)
+		wsClient.Close()
+		if err != nil {
+			t.Fatalf("Failed to receive offline message on connect: %v", err)
+		}
+		t.Logf("Received offline drain: %s", string(msg))
+
+		// Not acked over the socket, so it is still in the inbox; fetch and clear it via API
+		resp, err := apiClient.Offline(receiver.AuthToken, 0)
+		if err != nil {
+			t.Fatalf("Offline fetch failed: %v", err)
+		}
+		data := resp.GetDataAsMap()
+		msgs, _ := data["msgs"].([]interface{})
+		if len(msgs) == 0 {
+			t.Fatal("Expected unacked offline message to still be in inbox")
+		}
+		ackId := int64(data["ackId"].(float64))
+		resp, err = apiClient.Offline(receiver.AuthToken, ackId)
+		if err != nil {
+			t.Fatalf("Offline ack failed: %v", err)
+		}
+		if msgs, _ := resp.GetDataAsMap()["msgs"].([]interface{}); len(msgs) != 0 {
+			t.Errorf("Expected inbox empty after ack, got %d messages", len(msgs))
+		}
+	})
+
+	t.Run("Multi_Device", func(t *testing.T) {
+		sender := testdata.NewTestUser()
+		senderResp, err := apiClient.Register(sender.UserName, sender.Password)
+		if err != nil {
+			t.Fatalf("Register sender failed: %v", err)
+		}
+		sender.AuthToken = senderResp.GetDataAsString()
+
+		receiver := testdata.NewTestUser()
+		if _, err := apiClient.Register(receiver.UserName, receiver.Password); err != nil {
+			t.Fatalf("Register receiver failed: %v", err)
+		}
+		// Two logins of the same user, both sessions stay valid
+		phoneResp, err := apiClient.Login(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Login phone failed: %v", err)
+		}
+		desktopResp, err := apiClient.Login(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Login desktop failed: %v", err)
+		}
+		phoneToken, desktopToken := phoneResp.GetDataAsString(), desktopResp.GetDataAsString()
+		if resp, err := apiClient.CheckAuth(phoneToken); err != nil || resp.Code != testdata.CodeSuccess {
+			t.Fatalf("First session invalidated by second login: %v", err)
+		}
+		authResp, err := apiClient.CheckAuth(desktopToken)
+		if err != nil {
+			t.Fatalf("CheckAuth failed: %v", err)
+		}
+		receiverUserId := fmt.Sprintf("%.0f", authResp.GetDataAsMap()["userId"].(float64))
+
+		phone, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		defer phone.Close()
+		desktop, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		defer desktop.Close()
+		phone.ConnectDevice(phoneToken, testdata.DefaultRoomID, "phone")
+		desktop.ConnectDevice(desktopToken, testdata.DefaultRoomID, "desktop")
+		time.Sleep(1 * time.Second)
+		phone.DrainMessages(500 * time.Millisecond)
+		desktop.DrainMessages(500 * time.Millisecond)
+
+		// A single push reaches every device of the user
+		testMsg := testdata.TestMessage("multi_device")
+		if _, err := apiClient.Push(sender.AuthToken, testMsg, receiverUserId, testdata.DefaultRoomID); err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+		if _, err := phone.WaitForMessageContaining(testMsg, 10*time.Second); err != nil {
+			t.Errorf("Phone did not receive message: %v", err)
+		}
+		if _, err := desktop.WaitForMessageContaining(testMsg, 10*time.Second); err != nil {
+			t.Errorf("Desktop did not receive message: %v", err)
+		}
+
+		// Logging out one session keeps the other one
+		if _, err := apiClient.Logout(phoneToken); err != nil {
+			t.Fatalf("Logout failed: %v", err)
+		}
+		if resp, err := apiClient.CheckAuth(desktopToken); err != nil || resp.Code != testdata.CodeSuccess {
+			t.Errorf("Desktop session invalidated by phone logout: %v", err)
+		}
+	})
+
+	t.Run("Upstream_Over_WebSocket", func(t *testing.T) {
+		sender := testdata.NewTestUser()
+		senderResp, err := apiClient.Register(sender.UserName, sender.Password)
+		if err != nil {
+			t.Fatalf("Register sender failed: %v", err)
+		}
+		sender.AuthToken = senderResp.GetDataAsString()
+
+		receiver := testdata.NewTestUser()
+		receiverResp, err := apiClient.Register(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Register receiver failed: %v", err)
+		}
+		receiver.AuthToken = receiverResp.GetDataAsString()
+		authResp, err := apiClient.CheckAuth(receiver.AuthToken)
+		if err != nil {
+			t.Fatalf("CheckAuth failed: %v", err)
+		}
+		receiverUserId := int(authResp.GetDataAsMap()["userId"].(float64))
+
+		senderWS, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		defer senderWS.Close()
+		receiverWS, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		defer receiverWS.Close()
+		senderWS.Connect(sender.AuthToken, testdata.DefaultRoomID)
+		receiverWS.Connect(receiver.AuthToken, testdata.DefaultRoomID)
+		time.Sleep(1 * time.Second)
+		senderWS.DrainMessages(500 * time.Millisecond)
+		receiverWS.DrainMessages(500 * time.Millisecond)
+
+		// Room send, sender identity comes from the connection
+		roomMsg := testdata.TestMessage("ws_room")
+		if err := senderWS.SendRoomMsg("r1", testdata.DefaultRoomID, roomMsg); err != nil {
+			t.Fatalf("SendRoomMsg failed: %v", err)
+		}
+		reply, err := senderWS.WaitForReply("r1", 10*time.Second)
+		if err != nil {
+			t.Fatalf("No reply to room send: %v", err)
+		}
+		if reply.Code != testdata.CodeSuccess || reply.ReqOp != testdata.OpRoomSend {
+			t.Errorf("Unexpected room send reply: %+v", reply)
+		}
+		msg, err := receiverWS.WaitForMessageContaining(roomMsg, 10*time.Second)
+		if err != nil {
+			t.Fatalf("Receiver did not get room message: %v", err)
+		}
+		if parsed, _ := helpers.ParseMessage(msg); parsed == nil || parsed.FromUserName != sender.UserName {
+			t.Errorf("Room message sender mismatch: %s", string(msg))
+		}
+
+		// Single send
+		directMsg := testdata.TestMessage("ws_direct")
+		senderWS.SendSingleMsg("s1", receiverUserId, directMsg)
+		if reply, err := senderWS.WaitForReply("s1", 10*time.Second); err != nil || reply.Code != testdata.CodeSuccess {
+			t.Errorf("Bad reply to single send: %+v, err: %v", reply, err)
+		}
+		if _, err := receiverWS.WaitForMessageContaining(directMsg, 10*time.Second); err != nil {
+			t.Errorf("Receiver did not get direct message: %v", err)
+		}
+
+		// Sending to a room the connection has not joined is refused
+		senderWS.SendRoomMsg("r2", testdata.AlternateRoomID, testdata.TestMessage("ws_not_joined"))
+		if reply, err := senderWS.WaitForReply("r2", 10*time.Second); err != nil || reply.Code != testdata.CodeFail {
+			t.Errorf("Expected failure reply for room not joined: %+v, err: %v", reply, err)
+		}
+	})
+
+	t.Run("Delivery_Ack", func(t *testing.T) {
+		sender := testdata.NewTestUser()
+		senderResp, err := apiClient.Register(sender.UserName, sender.Password)
+		if err != nil {
+			t.Fatalf("Register sender failed: %v", err)
+		}
+		sender.AuthToken = senderResp.GetDataAsString()
+
+		receiver := testdata.NewTestUser()
+		receiverResp, err := apiClient.Register(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Register receiver failed: %v", err)
+		}
+		receiver.AuthToken = receiverResp.GetDataAsString()
+		authResp, err := apiClient.CheckAuth(receiver.AuthToken)
+		if err != nil {
+			t.Fatalf("CheckAuth failed: %v", err)
+		}
+		receiverUserId := fmt.Sprintf("%.0f", authResp.GetDataAsMap()["userId"].(float64))
+
+		wsClient, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		defer wsClient.Close()
+		wsClient.Connect(receiver.AuthToken, testdata.DefaultRoomID)
+		time.Sleep(1 * time.Second)
+		wsClient.DrainMessages(500 * time.Millisecond)
+
+		testMsg := testdata.TestMessage("ack")
+		pushResp, err := apiClient.Push(sender.AuthToken, testMsg, receiverUserId, testdata.DefaultRoomID)
+		if err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+		seq, _ := pushResp.GetDataAsMap()["seq"].(string)
+		if seq == "" {
+			t.Fatalf("Push returned no seq: %+v", pushResp.Data)
+		}
+
+		raw, err := wsClient.WaitForMessageContaining(testMsg, 10*time.Second)
+		if err != nil {
+			t.Fatalf("Failed to receive message: %v", err)
+		}
+		parsed, _ := helpers.ParseMessage(raw)
+		if parsed == nil || parsed.SeqId != seq {
+			t.Fatalf("Pushed message seq mismatch, want %s: %s", seq, string(raw))
+		}
+
+		// Not acked yet, so it is redelivered with the same seq
+		if _, err := wsClient.WaitForMessageContaining(seq, 15*time.Second); err != nil {
+			t.Errorf("Unacked message was not redelivered: %v", err)
+		}
+
+		wsClient.AckMsg(seq)
+		time.Sleep(500 * time.Millisecond)
+		statusResp, err := apiClient.MsgStatus(sender.AuthToken, seq)
+		if err != nil {
+			t.Fatalf("MsgStatus failed: %v", err)
+		}
+		if status, _ := statusResp.GetDataAsMap()["status"].(string); status != "delivered" {
+			t.Errorf("Expected delivered status after ack, got %+v", statusResp.Data)
+		}
+
+		// Only the sender can query the message
+		if resp, err := apiClient.MsgStatus(receiver.AuthToken, seq); err == nil && resp.Code == testdata.CodeSuccess {
+			t.Error("Receiver should not be able to query the sender's message status")
+		}
+	})
+
+	t.Run("Session_Resume", func(t *testing.T) {
+		sender := testdata.NewTestUser()
+		senderResp, err := apiClient.Register(sender.UserName, sender.Password)
+		if err != nil {
+			t.Fatalf("Register sender failed: %v", err)
+		}
+		sender.AuthToken = senderResp.GetDataAsString()
+
+		receiver := testdata.NewTestUser()
+		receiverResp, err := apiClient.Register(receiver.UserName, receiver.Password)
+		if err != nil {
+			t.Fatalf("Register receiver failed: %v", err)
+		}
+		receiver.AuthToken = receiverResp.GetDataAsString()
+		authResp, err := apiClient.CheckAuth(receiver.AuthToken)
+		if err != nil {
+			t.Fatalf("CheckAuth failed: %v", err)
+		}
+		receiverUserId := fmt.Sprintf("%.0f", authResp.GetDataAsMap()["userId"].(float64))
+
+		wsClient, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket connection failed: %v", err)
+		}
+		wsClient.Connect(receiver.AuthToken, testdata.DefaultRoomID)
+		session, err := wsClient.WaitForSession(5 * time.Second)
+		if err != nil {
+			wsClient.Close()
+			t.Fatalf("No session info after connect: %v", err)
+		}
+		if session.ResumeToken == "" || session.Resumed {
+			t.Fatalf("Unexpected session info on connect: %+v", session)
+		}
+
+		firstMsg := testdata.TestMessage("before_drop")
+		apiClient.Push(sender.AuthToken, firstMsg, receiverUserId, testdata.DefaultRoomID)
+		raw, err := wsClient.WaitForMessageContaining(firstMsg, 10*time.Second)
+		if err != nil {
+			wsClient.Close()
+			t.Fatalf("Failed to receive message before drop: %v", err)
+		}
+		first, _ := helpers.ParseMessage(raw)
+		wsClient.AckMsg(first.SeqId)
+
+		// Lose the connection, the message pushed meanwhile waits for the resume
+		wsClient.Drop()
+		time.Sleep(500 * time.Millisecond)
+		missedMsg := testdata.TestMessage("while_dropped")
+		if _, err := apiClient.Push(sender.AuthToken, missedMsg, receiverUserId, testdata.DefaultRoomID); err != nil {
+			t.Fatalf("Push failed: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+
+		resumed, err := helpers.NewWSClient(cfg.WSBaseURL)
+		if err != nil {
+			t.Fatalf("WebSocket reconnect failed: %v", err)
+		}
+		defer resumed.Close()
+		resumed.ConnectResume(receiver.AuthToken, session.ResumeToken, first.SeqId)
+		info, err := resumed.WaitForSession(5 * time.Second)
+		if err != nil {
+			t.Fatalf("No session info after resume: %v", err)
+		}
+		if !info.Resumed || info.ResumeToken != session.ResumeToken {
+			t.Errorf("Expected the session to be resumed: %+v", info)
+		}
+		if _, err := resumed.WaitForMessageContaining(missedMsg, 5*time.Second); err != nil {
+			t.Errorf("Missed message was not replayed: %v", err)
+		}
+	})
 }
@@ -437,4 +437,174 @@ func TestRoomOperations(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("Room_Signal", func(t *testing.T) {
+		t.Run("typing_reaches_other_members_only", func(t *testing.T) {
+			roomId := testdata.DefaultRoomID
+			var conns []*helpers.WSClient
+			for i := 0; i < 2; i++ {
+				user := testdata.NewTestUserWithName("signal")
+				regResp, err := apiClient.Register(user.UserName, user.Password)
+				if err != nil {
+					t.Fatalf("Register user %d failed: %v", i, err)
+				}
+				ws, err := helpers.NewWSClient(cfg.WSBaseURL)
+				if err != nil {
+					t.Fatalf("WebSocket connection %d failed: %v", i, err)
+				}
+				defer ws.Close()
+				ws.Connect(regResp.GetDataAsString(), roomId)
+				conns = append(conns, ws)
+			}
+			time.Sleep(1 * time.Second)
+			for _, ws := range conns {
+				ws.DrainMessages(500 * time.Millisecond)
+			}
+
+			if err := conns[0].SendSignal(roomId, "typing"); err != nil {
+				t.Fatalf("SendSignal failed: %v", err)
+			}
+			if _, err := conns[1].WaitForMessageContaining(`"signal":"typing"`, 5*time.Second); err != nil {
+				t.Errorf("other member did not get the signal: %v", err)
+			}
+			if msg, err := conns[0].WaitForMessageContaining(`"signal":"typing"`, 1*time.Second); err == nil {
+				t.Errorf("sender got its own signal: %s", msg)
+			}
+		})
+	})
+
+	t.Run("Multi_Room", func(t *testing.T) {
+		t.Run("join_and_leave_on_same_connection", func(t *testing.T) {
+			user := testdata.NewTestUserWithName("multi_room")
+			regResp, err := apiClient.Register(user.UserName, user.Password)
+			if err != nil {
+				t.Fatalf("Register failed: %v", err)
+			}
+			user.AuthToken = regResp.GetDataAsString()
+
+			ws, err := helpers.NewWSClient(cfg.WSBaseURL)
+			if err != nil {
+				t.Fatalf("WebSocket connection failed: %v", err)
+			}
+			defer ws.Close()
+			ws.Connect(user.AuthToken, testdata.DefaultRoomID)
+			time.Sleep(500 * time.Millisecond)
+
+			if err := ws.JoinRoom(testdata.AlternateRoomID); err != nil {
+				t.Fatalf("JoinRoom failed: %v", err)
+			}
+			time.Sleep(1 * time.Second)
+			ws.DrainMessages(500 * time.Millisecond)
+
+			// Messages from both rooms arrive on the one connection
+			msg1 := testdata.TestMessage("multi_room1")
+			msg2 := testdata.TestMessage("multi_room2")
+			apiClient.PushRoom(user.AuthToken, msg1, testdata.DefaultRoomID)
+			apiClient.PushRoom(user.AuthToken, msg2, testdata.AlternateRoomID)
+			if _, err := ws.WaitForMessageContaining(msg1, 10*time.Second); err != nil {
+				t.Errorf("Did not receive message from first room: %v", err)
+			}
+			if _, err := ws.WaitForMessageContaining(msg2, 10*time.Second); err != nil {
+				t.Errorf("Did not receive message from joined room: %v", err)
+			}
+
+			// After leaving, the connection stays open but gets no more messages from that room
+			if err := ws.LeaveRoom(testdata.AlternateRoomID); err != nil {
+				t.Fatalf("LeaveRoom failed: %v", err)
+			}
+			time.Sleep(500 * time.Millisecond)
+			ws.DrainMessages(500 * time.Millisecond)
+			msg3 := testdata.TestMessage("multi_room_left")
+			apiClient.PushRoom(user.AuthToken, msg3, testdata.AlternateRoomID)
+			if _, err := ws.WaitForMessageContaining(msg3, 3*time.Second); err == nil {
+				t.Error("Should not receive messages from a room after leaving it")
+			}
+			if ws.IsClosed() {
+				t.Error("Connection should remain open after leaving a room")
+			}
+		})
+	})
+
+	t.Run("Room_History", func(t *testing.T) {
+		t.Run("late_joiner_reads_history", func(t *testing.T) {
+			roomId := testdata.AlternateRoomID
+
+			user := testdata.NewTestUserWithName("history")
+			regResp, err := apiClient.Register(user.UserName, user.Password)
+			if err != nil {
+				t.Fatalf("Register failed: %v", err)
+			}
+			user.AuthToken = regResp.GetDataAsString()
+
+			// Send messages before anybody reads them
+			var sent []string
+			for i := 0; i < 3; i++ {
+				testMsg := testdata.TestMessage("history")
+				if _, err := apiClient.PushRoom(user.AuthToken, testMsg, roomId); err != nil {
+					t.Fatalf("PushRoom %d failed: %v", i, err)
+				}
+				sent = append(sent, testMsg)
+			}
+
+			reader := testdata.NewTestUserWithName("history_reader")
+			regResp, err = apiClient.Register(reader.UserName, reader.Password)
+			if err != nil {
+				t.Fatalf("Register failed: %v", err)
+			}
+			reader.AuthToken = regResp.GetDataAsString()
+
+			// Only room members read its history
+			resp, err := apiClient.History(reader.AuthToken, roomId, 0, 0, 2)
+			if err != nil {
+				t.Fatalf("History failed: %v", err)
+			}
+			if resp.Code == testdata.CodeSuccess {
+				t.Fatal("Expected history to be refused before joining the room")
+			}
+
+			wsClient, err := helpers.NewWSClient(cfg.WSBaseURL)
+			if err != nil {
+				t.Fatalf("WebSocket connection failed: %v", err)
+			}
+			defer wsClient.Close()
+			if err := wsClient.Connect(reader.AuthToken, roomId); err != nil {
+				t.Fatalf("Join room failed: %v", err)
+			}
+			wsClient.DrainMessages(500 * time.Millisecond)
+
+			resp, err = apiClient.History(reader.AuthToken, roomId, 0, 0, 2)
+			if err != nil {
+				t.Fatalf("History failed: %v", err)
+			}
+			if resp.Code != testdata.CodeSuccess {
+				t.Fatalf("History returned code %d: %v", resp.Code, resp.Message)
+			}
+			data := resp.GetDataAsMap()
+			messages, _ := data["messages"].([]interface{})
+			if len(messages) != 2 {
+				t.Fatalf("Expected 2 messages, got %d", len(messages))
+			}
+			if hasMore, _ := data["hasMore"].(bool); !hasMore {
+				t.Error("Expected hasMore to be true")
+			}
+			last, _ := messages[1].(map[string]interface{})
+			if last["msg"] != sent[2] {
+				t.Errorf("Expected newest message %q, got %v", sent[2], last["msg"])
+			}
+
+			// Page backwards from the oldest message of the first page
+			first, _ := messages[0].(map[string]interface{})
+			before := int64(first["msgId"].(float64))
+			resp, err = apiClient.History(reader.AuthToken, roomId, before, 0, 2)
+			if err != nil {
+				t.Fatalf("History before cursor failed: %v", err)
+			}
+			older, _ := resp.GetDataAsMap()["messages"].([]interface{})
+			for _, m := range older {
+				if id := int64(m.(map[string]interface{})["msgId"].(float64)); id >= before {
+					t.Errorf("Expected msgId < %d, got %d", before, id)
+				}
+			}
+		})
+	})
 }
@@ -1,9 +1,13 @@
 package integration
 
 import (
+	"encoding/json"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"gochat/pkg/envelope"
 	"gochat/tests/helpers"
 	"gochat/tests/testdata"
 )
@@ -85,6 +89,37 @@ func TestWebSocketLifecycle(t *testing.T) {
 		})
 	})
 
+	t.Run("Upgrade_Auth", func(t *testing.T) {
+		t.Run("invalid_token_rejected_before_upgrade", func(t *testing.T) {
+			wsClient, err := helpers.NewWSClient(cfg.WSBaseURL + "?token=invalid_token_12345")
+			if err == nil {
+				wsClient.Close()
+				t.Fatal("Upgrade with an invalid token should be rejected")
+			}
+		})
+
+		t.Run("connect_frame_without_token", func(t *testing.T) {
+			username := testdata.GenerateTestUserName()
+			regResp, err := apiClient.Register(username, testdata.TestPassword)
+			if err != nil {
+				t.Fatalf("Register failed: %v", err)
+			}
+			authToken := regResp.GetDataAsString()
+
+			wsClient, err := helpers.NewWSClient(cfg.WSBaseURL + "?token=" + url.QueryEscape(authToken))
+			if err != nil {
+				t.Fatalf("Upgrade with a valid token failed: %v", err)
+			}
+			defer wsClient.Close()
+
+			// The token of the upgrade is used by the connect frame
+			wsClient.Connect("", testdata.DefaultRoomID)
+			if _, err := wsClient.WaitForSession(5 * time.Second); err != nil {
+				t.Errorf("Connect without token after an authenticated upgrade failed: %v", err)
+			}
+		})
+	})
+
 	t.Run("Graceful_Disconnect", func(t *testing.T) {
 		// Register user
 		username := testdata.GenerateTestUserName()
@@ -247,4 +282,70 @@ func TestWebSocketLifecycle(t *testing.T) {
 			t.Error("Reconnection should succeed")
 		}
 	})
+
+	t.Run("Envelope_Subprotocols", func(t *testing.T) {
+		for _, subprotocol := range []string{envelope.SubprotocolJSON, envelope.SubprotocolBinary} {
+			t.Run(subprotocol, func(t *testing.T) {
+				username := testdata.GenerateTestUserName()
+				regResp, err := apiClient.Register(username, testdata.TestPassword)
+				if err != nil {
+					t.Fatalf("Register failed: %v", err)
+				}
+				authToken := regResp.GetDataAsString()
+
+				wsClient, err := helpers.NewWSClientWithSubprotocol(cfg.WSBaseURL, subprotocol)
+				if err != nil {
+					t.Fatalf("WebSocket connection failed: %v", err)
+				}
+				defer wsClient.Close()
+				if wsClient.Subprotocol() != subprotocol {
+					t.Fatalf("Expected subprotocol %s, got %q", subprotocol, wsClient.Subprotocol())
+				}
+
+				connBody, _ := json.Marshal(helpers.ConnectRequest{AuthToken: authToken, RoomId: testdata.DefaultRoomID})
+				if err := wsClient.SendFrame(&envelope.Frame{Ver: 1, Op: 6, Body: connBody}); err != nil {
+					t.Fatalf("Send connect frame failed: %v", err)
+				}
+				time.Sleep(1 * time.Second)
+				wsClient.DrainMessages(500 * time.Millisecond)
+
+				testMsg := testdata.TestMessage("envelope")
+				sendBody, _ := json.Marshal(map[string]interface{}{"roomId": testdata.DefaultRoomID, "msg": testMsg})
+				if err := wsClient.SendFrame(&envelope.Frame{Ver: 1, Op: testdata.OpRoomSend, Seq: "env1", Body: sendBody}); err != nil {
+					t.Fatalf("Send room frame failed: %v", err)
+				}
+
+				// Both the reply and the broadcast come back enveloped
+				deadline := time.Now().Add(10 * time.Second)
+				gotReply, gotBroadcast := false, false
+				for time.Now().Before(deadline) && !(gotReply && gotBroadcast) {
+					raw, err := wsClient.WaitForMessage(time.Until(deadline))
+					if err != nil {
+						break
+					}
+					var frame *envelope.Frame
+					if subprotocol == envelope.SubprotocolBinary {
+						frame, err = envelope.DecodeBinary(raw)
+					} else {
+						frame, err = envelope.DecodeJSON(raw)
+					}
+					if err != nil {
+						t.Fatalf("Frame is not an envelope: %v, %s", err, string(raw))
+					}
+					switch {
+					case frame.Op == testdata.OpReply && frame.Seq == "env1":
+						gotReply = true
+					case frame.Op == testdata.OpRoomSend && strings.Contains(string(frame.Body), testMsg):
+						gotBroadcast = frame.Seq != ""
+					}
+				}
+				if !gotReply {
+					t.Error("Did not receive enveloped reply")
+				}
+				if !gotBroadcast {
+					t.Error("Did not receive enveloped room broadcast with seq")
+				}
+			})
+		}
+	})
 }
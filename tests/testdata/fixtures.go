@@ -22,10 +22,18 @@ const (
 
 // Operation codes (matching config/op.go)
 const (
-	OpSingleSend    = 2 // Single user message
-	OpRoomSend      = 3 // Room broadcast
-	OpRoomCountSend = 4 // Room count update
-	OpRoomInfoSend  = 5 // Room info update
+	OpSingleSend    = 2  // Single user message
+	OpRoomSend      = 3  // Room broadcast
+	OpRoomCountSend = 4  // Room count update
+	OpRoomInfoSend  = 5  // Room info update
+	OpOfflineMsg    = 7  // Offline inbox push
+	OpOfflineAck    = 8  // Offline inbox ack
+	OpRoomJoin      = 9  // Join a room on current connection
+	OpRoomLeave     = 10 // Leave a room on current connection
+	OpReply         = 11 // Reply to an upstream frame, matched by seq
+	OpMsgAck        = 12 // Ack a pushed single message by seq
+	OpSession       = 13 // Session info with the resume token
+	OpRoomSignal    = 18 // Ephemeral room signal like typing
 )
 
 // GenerateTestUserName creates a unique test username